@@ -0,0 +1,181 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package websock
+
+import (
+    "bytes"
+    "strings"
+    "net/http"
+    "crypto/hmac"
+    "crypto/sha256"
+    "crypto/ed25519"
+
+    "github.com/AlexRuzin/util"
+)
+
+/************************************************************
+ * Client authentication                                    *
+ ************************************************************/
+
+/*
+ * The client proves possession of either a long-term ed25519 key, or of a pre-shared
+ *  key, by sending a proof in the HS_FIELD_CLIENT_AUTH field of its hello:
+ *
+ *  [CLIENT_AUTH_KEY][32 byte ed25519 public key][64 byte signature]
+ *  [CLIENT_AUTH_PSK][1 byte id length][id][32 byte HMAC-SHA256]
+ *
+ * Both proofs are computed over clientAuthTranscript(), which binds them to the
+ *  ephemeral ECDH key of this exchange. A replayed proof is therefore of no use to
+ *  anyone who does not hold the matching ephemeral private key. A client that holds
+ *  a resumption ticket presents CLIENT_AUTH_TICKET instead, see resume.go
+ */
+const (
+    CLIENT_AUTH_NONE            byte = iota
+    CLIENT_AUTH_KEY
+    CLIENT_AUTH_PSK
+    CLIENT_AUTH_TICKET
+)
+
+var (
+    ERROR_CLIENT_AUTH           = util.RetErrStr("client identity could not be verified")
+    ERROR_CLIENT_NOT_AUTHORIZED = util.RetErrStr("client is not authorized")
+)
+
+/* The verified identity of a client, see NetInstance.Identity */
+type ClientIdentity struct {
+    /* Set when the client proved possession of a long-term key */
+    PublicKey                   ed25519.PublicKey
+
+    /* Set when the client authenticated using a pre-shared key */
+    KeyID                       string
+
+    /* KeyFingerprint(PublicKey) for key based clients, or the KeyID for PSK clients */
+    Fingerprint                 string
+}
+
+/*
+ * Decides whether a client may open a circuit. identity is nil if the client did not
+ *  present any credentials. Returning an error refuses the client before a NetInstance
+ *  is created, or IncomingHandler is invoked
+ */
+type ClientAuthorizer func(identity *ClientIdentity, request *http.Request) error
+
+/* An authorizer that accepts authenticated clients with one of the listed fingerprints or PSK IDs */
+func AllowClients(fingerprints ...string) ClientAuthorizer {
+    var allowed = make(map[string]bool)
+    for _, k := range fingerprints {
+        allowed[strings.ToLower(k)] = true
+    }
+
+    return func(identity *ClientIdentity, request *http.Request) error {
+        if identity == nil || !allowed[strings.ToLower(identity.Fingerprint)] {
+            return ERROR_CLIENT_NOT_AUTHORIZED
+        }
+
+        return nil
+    }
+}
+
+func clientAuthTranscript(curve CurveID, clientPublic []byte) []byte {
+    var transcript = bytes.Buffer{}
+    transcript.WriteString("websock client auth")
+    transcript.WriteByte(byte(curve))
+    transcript.Write(clientPublic)
+    return transcript.Bytes()
+}
+
+func (f *NetChannelClient) genClientAuth(transcript []byte) []byte {
+    if ticket, secret := f.resumption(); ticket != nil {
+        return genResumptionProof(ticket, secret, transcript)
+    }
+
+    if f.clientKey != nil {
+        var proof = []byte{CLIENT_AUTH_KEY}
+        proof = append(proof, f.clientKey.Public().(ed25519.PublicKey)...)
+        return append(proof, ed25519.Sign(f.clientKey, transcript)...)
+    }
+
+    if f.pskId != "" {
+        mac := hmac.New(sha256.New, f.psk)
+        mac.Write(transcript)
+
+        var proof = []byte{CLIENT_AUTH_PSK, byte(len(f.pskId))}
+        proof = append(proof, []byte(f.pskId)...)
+        return mac.Sum(proof)
+    }
+
+    return nil
+}
+
+/*
+ * Verifies the HS_FIELD_CLIENT_AUTH proof. A nil identity with a nil error means
+ *  that the client did not present any credentials
+ */
+func (f *NetChannelService) verifyClientAuth(proof []byte, transcript []byte) (*ClientIdentity, error) {
+    if len(proof) == 0 {
+        return nil, nil
+    }
+
+    switch proof[0] {
+    case CLIENT_AUTH_KEY:
+        if len(proof) != 1 + ed25519.PublicKeySize + ed25519.SignatureSize {
+            return nil, ERROR_CLIENT_AUTH
+        }
+
+        var key = ed25519.PublicKey(proof[1:1 + ed25519.PublicKeySize])
+        if !ed25519.Verify(key, transcript, proof[1 + ed25519.PublicKeySize:]) {
+            return nil, ERROR_CLIENT_AUTH
+        }
+
+        return &ClientIdentity{
+            PublicKey:      key,
+            Fingerprint:    KeyFingerprint(key),
+        }, nil
+
+    case CLIENT_AUTH_PSK:
+        if len(proof) < 2 || len(proof) != 2 + int(proof[1]) + sha256.Size {
+            return nil, ERROR_CLIENT_AUTH
+        }
+
+        var id = string(proof[2:2 + int(proof[1])])
+        psk, ok := f.preSharedKeys[id]
+        if !ok {
+            return nil, ERROR_CLIENT_AUTH
+        }
+
+        mac := hmac.New(sha256.New, psk)
+        mac.Write(transcript)
+        if !hmac.Equal(mac.Sum(nil), proof[2 + int(proof[1]):]) {
+            return nil, ERROR_CLIENT_AUTH
+        }
+
+        return &ClientIdentity{
+            KeyID:          id,
+            Fingerprint:    id,
+        }, nil
+    }
+
+    return nil, ERROR_CLIENT_AUTH
+}
+
+/* EOF */
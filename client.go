@@ -24,18 +24,24 @@ package websock
 
 import (
     "io"
+    "os"
     "time"
     "bytes"
     "strings"
-    "crypto"
     "strconv"
+    "sync"
+    "sync/atomic"
     "net"
     "net/url"
+    "crypto/rand"
+    "crypto/tls"
+    "crypto/ed25519"
     "net/http"
+    "net/http/httptrace"
+    "context"
     "io/ioutil"
 
     "github.com/AlexRuzin/util"
-    "github.com/wsddn/go-ecdh"
 
     "github.com/tatsushid/go-fastping"
 )
@@ -56,70 +62,145 @@ type NetChannelClient struct {
     clientId            []byte
     clientIdString      string
 
-    /* ECDH secret */
-    secret              []byte
+    /* ECDH curve and the traffic keys for each direction */
+    curve               CurveID
+    postQuantum         bool
+    txKey               *trafficState
+    rxKey               *trafficState
+    rekeyLimits         rekeyLimits
+
+    /* The receiving key of the exchange the circuit was resumed from, guarded by rxLock */
+    previousRxKey       *trafficState
+    previousSuite       CipherSuite
+
+    /* Options offered in the key exchange, and those selected by the server */
+    maxFrameSize        uint32
+    compression         []CompressionAlgorithm
+    negotiated          Capabilities
+
+    /* Fragmentation of large writes and reassembly of large responses, see fragment.go */
+    messageId           uint32
+    reassembly          reassembler
+
+    /* Pinned server identity, either the key itself or its fingerprint */
+    serverKey           ed25519.PublicKey
+    serverFingerprint   string
+
+    /* Client credentials, either a long-term key or a pre-shared key */
+    clientKey           ed25519.PrivateKey
+    pskId               string
+    psk                 []byte
+
+    /* Resumption ticket issued by the server, guarded by rxLock, see resume.go */
+    ticket              []byte
+    resumptionSecret    []byte
+
+    /* Debugging only, see WithKeyLog */
+    keyLog              *keyLogWriter
 
     /* States and configuration */
     flags               FlagVal
-    connected           bool
+    connected           atomic.Bool         /* Cleared by the poll or socket goroutine, and by Close() */
 
-    /* Data coming in from the server */
+    /* Data coming in from the server, guarded by rxLock. rxSignal wakes a blocked Read() */
     responseData        *bytes.Buffer
+    rxLock              sync.Mutex
+    rxSignal            readSignal
+    closed              bool
 
-    /* Request elements */
+    /* net.Conn deadlines and the addresses of the last HTTP connection, see conn.go */
+    deadlines           deadlines
+    addrs               connAddrs
+
+    /* Keep-alive connections shared by every request of the circuit, see transport.go */
     transport           *http.Transport
-    request             *http.Request
-    getReqKilled        bool
+    httpClient          *http.Client
+
+    /* TLS settings for an https gate URI, see tls.go */
+    tlsConfig           *tls.Config
+    pinnedSPKI          []string
+
+    /* The proxy to the gate, and the longest the server may hold a poll, see proxy.go */
+    proxyURL            *url.URL
+    proxyAuth           *url.Userinfo
+    pollTimeout         time.Duration
+
+    /* Set while the circuit is carried over a WebSocket, see websocket.go */
+    socket              atomic.Pointer[socketConn]
 
     /* Main config */
     config              *ProtocolConfig
 }
 
-type transferUnit struct {
-    GlobalIP            string
-    LocalIP             string
-    TimeStamp           string
-    ClientID            string
-    Data                []byte
-    DecryptedSum        string
-    Direction           FlagVal
-    Flags               FlagVal
-}
-
+/*
+ * Blocks until data has arrived from the server, and reads at most len(p) bytes of it.
+ *  Data that does not fit in p remains buffered for the next Read(). io.EOF is only
+ *  returned once Close() has been called and the buffer is empty, and
+ *  os.ErrDeadlineExceeded once the read deadline has passed
+ */
 func (f *NetChannelClient) Read(p []byte) (read int, err error) {
-    read, err = f.readInternal(p)
-    if err != io.EOF {
-        return 0, err
-    }
-
-    return
+    return f.readInternal(p)
 }
 
+/* A successful Write() returns len(p) and a nil error */
 func (f *NetChannelClient) Write(p []byte) (written int, err error) {
+    if len(p) == 0 {
+        return 0, nil
+    }
+    if deadlinePassed(f.deadlines.writing()) {
+        return 0, os.ErrDeadlineExceeded
+    }
+
     written, err = f.writeInternal(p)
     if err != io.EOF {
         return 0, err
     }
+    if written != len(p) {
+        return written, io.ErrShortWrite
+    }
 
-    return written, io.EOF
+    return written, nil
 }
 
 func (f *NetChannelClient) Len() int {
-    if f.connected == false {
+    if !f.connected.Load() {
         return 0
-    } else if f.responseData == nil {
+    }
+
+    f.rxLock.Lock()
+    defer f.rxLock.Unlock()
+
+    if f.responseData == nil {
         return 0
     }
 
     return f.responseData.Len()
 }
 
+func (f *NetChannelClient) Stats() SessionStats {
+    return collectStats(f.txKey, f.rxKey)
+}
+
+/* True if the circuit was negotiated using the hybrid ML-KEM exchange, see FLAG_HYBRID_MLKEM */
+func (f *NetChannelClient) PostQuantum() bool {
+    return f.postQuantum
+}
+
+/* The protocol version and options selected by the server in the last key exchange */
+func (f *NetChannelClient) Negotiated() Capabilities {
+    return f.negotiated
+}
+
+/*
+ * Deprecated: Read() blocks until data arrives, use SetReadDeadline() to bound the
+ *  time it waits
+ */
 func (f *NetChannelClient) Wait(timeoutMilliseconds time.Duration) (responseLen int, err error) {
     responseLen = 0
     err = WAIT_TIMEOUT_REACHED
 
     for i := timeoutMilliseconds / 100; i != 0; i -= 1 {
-        if f.connected == false {
+        if !f.connected.Load() {
             err = WAIT_CLOSED
             responseLen = -1
             break
@@ -137,7 +218,7 @@ func (f *NetChannelClient) Wait(timeoutMilliseconds time.Duration) (responseLen
     return
 }
 
-func BuildChannel(gateURI string, flags FlagVal) (*NetChannelClient, error) {
+func BuildChannel(gateURI string, flags FlagVal, options ...ChannelOption) (*NetChannelClient, error) {
     if (flags & FLAG_DO_NOT_USE) == 1  {
         return nil, util.RetErrStr("Invalid flag: FLAG_DO_NOT_USE")
     }
@@ -166,27 +247,43 @@ func BuildChannel(gateURI string, flags FlagVal) (*NetChannelClient, error) {
     if err != nil {
         return nil, err
     }
-    if mainURL.Scheme != "http" {
-        return nil, util.RetErrStr("HTTP scheme must not use TLS")
+    if mainURL.Scheme != "http" && mainURL.Scheme != "https" {
+        return nil, util.RetErrStr("gate URI must use the http or https scheme")
     }
 
     port, _ := strconv.Atoi(mainURL.Port())
+    var transport = newTransport(flags)
     var ioChannel = &NetChannelClient{
         controllerURL:      mainURL,
         inputURI:           gateURI,
         port:               int16(port),
         flags:              flags,
-        connected:          false,
+        curve:              CURVE_P384,
         path:               mainURL.Path,
         host:               mainURL.Host,
-        secret:             nil,
+        txKey:              nil,
+        rxKey:              nil,
+        rekeyLimits:        defaultRekeyLimits(),
+        maxFrameSize:       DEFAULT_MAX_FRAME_SIZE,
         responseData:       nil,
-        transport:          nil,
-        request:            nil,
+        rxSignal:           newReadSignal(),
+        transport:          transport,
+        httpClient:         &http.Client{Transport: transport},
         config:             tmpConfig,
         testCircuit:        false,
         pingServer:         false,
-        getReqKilled:       false,
+    }
+
+    for _, option := range options {
+        if err := option(ioChannel); err != nil {
+            return nil, err
+        }
+    }
+    if err := ioChannel.configureTLS(); err != nil {
+        return nil, err
+    }
+    if err := ioChannel.configureProxy(); err != nil {
+        return nil, err
     }
 
     if (flags & FLAG_TEST_CIRCUIT) > 0 {
@@ -209,17 +306,30 @@ func (f *NetChannelClient) InitializeCircuit() error {
      * Determine if we can pull anything from the target URI
      */
     if f.pingServer == true {
-        if checkServerStatus := checkServerAliveStatus(f.controllerURL.String()); checkServerStatus != ERROR_SERVER_UP {
+        if checkServerStatus := checkServerAliveStatus(f.httpClient, f.controllerURL.String()); checkServerStatus != ERROR_SERVER_UP {
             return checkServerStatus
         }
     }
 
-    /* Transmit and receive public keys, generate secret */
+    /*
+     * Transmit and receive public keys, generate secret. If the circuit was lost, the
+     *  ticket reattaches to the same NetInstance, otherwise a full exchange is made
+     */
     if pkeStatus := f.initializePKE(); pkeStatus != nil {
-        return pkeStatus
+        if ticket, _ := f.resumption(); ticket == nil {
+            return pkeStatus
+        }
+
+        f.forgetTicket()
+        if pkeStatus = f.initializePKE(); pkeStatus != nil {
+            return pkeStatus
+        }
     }
 
-    f.connected = true
+    f.rxLock.Lock()
+    f.closed = false
+    f.rxLock.Unlock()
+    f.connected.Store(true)
 
     /*
      * Test the circuit
@@ -231,6 +341,18 @@ func (f *NetChannelClient) InitializeCircuit() error {
         }
     }
 
+    /*
+     * Move the circuit to a WebSocket if FLAG_WEBSOCKET is set, and fall back to polling
+     *  if the upgrade is refused
+     */
+    if (f.flags & FLAG_WEBSOCKET) > 0 {
+        if err := f.upgradeSocket(); err == nil {
+            return nil
+        } else if (f.flags & FLAG_DEBUG) > 0 {
+            util.DebugOut("WebSocket upgrade refused, polling instead: " + err.Error())
+        }
+    }
+
     /*
      * Keep sending POSTs until some data is written to the controller write interface
      */
@@ -240,7 +362,7 @@ func (f *NetChannelClient) InitializeCircuit() error {
     return nil
 }
 
-func checkServerAliveStatus(URI string) error {
+func checkServerAliveStatus(client *http.Client, URI string) error {
     var (
         parsedURI       *url.URL
         parseStatus     error
@@ -293,9 +415,10 @@ func checkServerAliveStatus(URI string) error {
         response        *http.Response
         responseStatus  error
     )
-    if response, responseStatus = http.Get(URI); responseStatus != nil || response == nil {
+    if response, responseStatus = client.Get(URI); responseStatus != nil || response == nil {
         return ERROR_SERVER_DOWN
     }
+    response.Body.Close()
 
     return ERROR_SERVER_UP
 }
@@ -306,24 +429,51 @@ func checkWriteThread(client *NetChannelClient) {
      *  socket. This is the primary i/o subsystem
      */
     go func (client *NetChannelClient) {
+        var retries = 0
         for {
-            client.getReqKilled = false
-            read, _, err := client.writeStream(nil, FLAG_CHECK_STREAM_DATA)
+            /* A poll sent again asks for the frame the cut one may have carried, see proxy.go */
+            read, _, err := client.writeStream(encodePoll(client.pollTimeout, retries != 0), FLAG_CHECK_STREAM_DATA)
+            if err == io.EOF || err == ERROR_REPLAY {
+                retries = 0
+            }
+
             if err == io.EOF && read == 0 {
-                /* Connection is closed due to a Write() request */
-                if (client.flags & FLAG_DEBUG) > 0 && read == 0 && client.getReqKilled == false {
+                /* The poll timed out on the server */
+                if (client.flags & FLAG_DEBUG) > 0 {
                     util.DebugOut("[" + time.Now().String() + "] FLAG_CHECK_STREAM_DATA: Keep-alive -- no data")
                 }
                 util.Sleep(100 * time.Millisecond)
                 continue
             } else if read != 0 {
-                /* Data inbound from server */
+                /* Data inbound from server, poll again at once in case more is queued */
+                continue
+            }
+
+            if err == ERROR_REPLAY || err == ERROR_RECORD_AUTH {
+                /* A forged or replayed response is dropped, see SessionStats */
+                if (client.flags & FLAG_DEBUG) > 0 {
+                    util.DebugOut("[" + time.Now().String() + "] FLAG_CHECK_STREAM_DATA: Record rejected: " + err.Error())
+                }
                 util.Sleep(100 * time.Millisecond)
                 continue
             }
 
-            /* Some other error -- i.e. the server terminates the socket */
-            client.Close()
+            if isTransientPollError(err) && retries != POLL_RETRIES {
+                /* The poll was cut on its way, i.e. by a proxy that times out idle requests */
+                if (client.flags & FLAG_DEBUG) > 0 {
+                    util.DebugOut("[" + time.Now().String() + "] FLAG_CHECK_STREAM_DATA: Poll lost: " + err.Error())
+                }
+                retries += 1
+                util.Sleep(POLL_RETRY_DELAY)
+                continue
+            }
+
+            /*
+             * Some other error -- i.e. the server terminates the socket. The NetInstance may
+             *  still exist, so the ticket is kept for InitializeCircuit() to resume with
+             */
+            client.connected.Store(false)
+            client.rxSignal.notify()
             return
         }
     } (client)
@@ -334,18 +484,18 @@ func (f *NetChannelClient) initializePKE() (error) {
      * Generate keypair, construct HTTP POST request parameter map
      */
     var ( /* Output reserved for keypair/post request generate method */
-        curve                   ecdh.ECDH
         request                 map[string]string
         curveStatus             error = nil
-        clientPrivateKey        crypto.PrivateKey
+        keyShare                *clientKeyShare
+        clientPool              []byte
     )
-    curve, request, clientPrivateKey, curveStatus = f.generateCurvePostRequest()
+    request, keyShare, clientPool, curveStatus = f.generateCurvePostRequest()
     if curveStatus != nil {
         return curveStatus
     }
 
     /* Perform HTTP TX, receive the public key from the server */
-    body, initStatus := f.sendTransmission(f.config.HTTPVerb/* POST */, f.inputURI, request)
+    body, initStatus := f.sendTransmission(f.config.HTTPVerb/* POST */, f.inputURI, request, time.Time{})
     if initStatus != nil {
         return initStatus
     }
@@ -354,116 +504,256 @@ func (f *NetChannelClient) initializePKE() (error) {
     }
 
     /*
-     * Decode the public key returned by the server and create a secret key
+     * Decode the public key returned by the server, create a secret key and derive the
+     *  session keys from it
      */
-    f.secret, initStatus = f.decodeServerPubkeyGenSecret(body, clientPrivateKey, curve)
+    var (
+        keys                    *sessionKeys
+        secret                  []byte
+        previous                = f.rxKey
+        previousSuite           = f.negotiated.CipherSuite
+        previousId              = f.clientIdString
+    )
+    keys, secret, initStatus = f.decodeServerPubkeyGenSecret(body, keyShare, clientPool)
     if initStatus != nil {
         return initStatus
     }
+    f.txKey = newTrafficState(keys.clientToServer, f.rekeyLimits)
+    f.rxKey = newTrafficState(keys.serverToClient, f.rekeyLimits)
+
+    /* A resumed NetInstance may still send a frame under the previous keys, see resume.go */
+    f.rxLock.Lock()
+    f.previousRxKey = nil
+    if previous != nil && f.clientIdString == previousId {
+        f.previousRxKey = previous
+        f.previousSuite = previousSuite
+    }
+    f.rxLock.Unlock()
+    f.keyLog.log(f.clientIdString, keys)
 
     if (f.flags & FLAG_DEBUG) > 0 {
         util.DebugOut("Client-side secret:")
-        util.DebugOutHex(f.secret)
+        util.DebugOutHex(secret)
     }
 
     return nil
 }
 
-func (f *NetChannelClient) Close() {
-    f.writeStream(nil, FLAG_TERMINATE_CONNECTION)
-    f.connected = false
+func (f *NetChannelClient) Close() error {
+    f.rxLock.Lock()
+    var closed = f.closed
+    f.closed = true
+    f.rxLock.Unlock()
+    if closed {
+        return net.ErrClosed
+    }
+
+    if f.connected.Load() {
+        f.sendControl(CONTROL_TERMINATE, nil)
+    }
+    if socket := f.socket.Swap(nil); socket != nil {
+        socket.close()
+    }
+    f.transport.CloseIdleConnections()
+    f.connected.Store(false)
+    f.forgetTicket()
+    f.rxSignal.notify()
+
+    return nil
 }
 
 func (f *NetChannelClient) readInternal(p []byte) (int, error) {
-    if f.connected == false {
-        return 0, util.RetErrStr("readInternal(): client not connected")
+    for {
+        f.rxLock.Lock()
+        if f.responseData != nil && f.responseData.Len() != 0 {
+            read, _ := f.responseData.Read(p)
+            f.rxLock.Unlock()
+            return read, nil
+        }
+        var closed = f.closed
+        f.rxLock.Unlock()
+
+        var deadline = f.deadlines.reading()
+        switch {
+        case closed:
+            return 0, io.EOF
+        case !f.connected.Load():
+            /* The circuit was lost, InitializeCircuit() may resume it */
+            return 0, ERROR_NOT_CONNECTED
+        case len(p) == 0:
+            return 0, nil
+        case !f.rxSignal.wait(deadline):
+            return 0, os.ErrDeadlineExceeded
+        }
     }
+}
 
-    if f.Len() == 0 {
-        return 0, io.EOF
+func (f *NetChannelClient) writeInternal(p []byte) (int, error) {
+    if !f.connected.Load() {
+        return 0, ERROR_NOT_CONNECTED
     }
 
-    read, err := f.readStream(p, 0)
+    /* The pending poll is left alone, the data is sent on another keep-alive connection */
+    _, wrote, err := f.writeStream(p, 0)
     if err != io.EOF {
         return 0, err
     }
 
-    return read, io.EOF
+    return wrote, io.EOF
 }
 
-func (f *NetChannelClient) writeInternal(p []byte) (int, error) {
-    if f.connected == false {
-        return 0, util.RetErrStr("writeInternal(): client not connected")
+func (f *NetChannelClient) testCircuitRoutine() error {
+    reply, err := f.sendControl(CONTROL_TEST, []byte(f.config.TestStream))
+    if err != nil {
+        return err
     }
 
-    if f.transport != nil {
-        f.transport.CancelRequest(f.request)
+    if reply.controlType != CONTROL_TEST || !bytes.Equal(reply.body, []byte(f.config.TestStream)) {
+        return util.RetErrStr("testCircuit() invalid response from server side")
     }
 
-    _, wrote, err := f.writeStream(p, 0)
-    if err != io.EOF {
+    return nil
+}
+
+/* Sends a CONTROL_PING, and returns the time taken for the server to acknowledge it */
+func (f *NetChannelClient) Ping() (time.Duration, error) {
+    var body = make([]byte, 8)
+    if _, err := rand.Read(body); err != nil {
         return 0, err
     }
 
-    return wrote, io.EOF
+    var start = time.Now()
+    reply, err := f.sendControl(CONTROL_PING, body)
+    if err != nil {
+        return 0, err
+    }
+    if reply.controlType != CONTROL_ACK || !bytes.Equal(reply.body, body) {
+        return 0, ERROR_CONTROL_UNEXPECTED
+    }
+
+    return time.Since(start), nil
 }
 
-func (f *NetChannelClient) testCircuitRoutine() error {
-    if _, _, err := f.writeStream(nil, FLAG_TEST_CONNECTION); err != io.EOF {
+/*
+ * Ratchets the traffic keys of both directions, regardless of the rekey limits. The
+ *  CONTROL_REKEY message is the first record sealed under the new client key, and the
+ *  server acknowledges it under its new key. Legacy circuits are never rekeyed
+ */
+func (f *NetChannelClient) Rekey() error {
+    if f.negotiated.CipherSuite == CIPHER_LEGACY_RC4 {
+        return util.RetErrStr("legacy circuits cannot be rekeyed")
+    }
+
+    f.txKey.requestRekey()
+    reply, err := f.sendControl(CONTROL_REKEY, nil)
+    if err != nil {
         return err
     }
+    if reply.controlType != CONTROL_ACK {
+        return ERROR_CONTROL_UNEXPECTED
+    }
 
-    if f.responseData.Len() == 0 {
-        return util.RetErrStr("testCircuit() failed on the server side")
+    return nil
+}
+
+/* Sends a control message in its own request, and returns the control message the server answers with */
+func (f *NetChannelClient) sendControl(controlType byte, body []byte) (*controlMessage, error) {
+    if !f.connected.Load() {
+        return nil, ERROR_NOT_CONNECTED
     }
 
-    var responseData = make([]byte, f.responseData.Len())
-    read, err := f.readStream(responseData, FLAG_TEST_CONNECTION)
-    if err != io.EOF || read != len(f.config.TestStream) {
-        return util.RetErrStr("testCircuit() invalid response from server side")
+    encrypted, err := encryptControl(&controlMessage{controlType: controlType, body: body}, f.txKey,
+        f.negotiated.CipherSuite, FLAG_DIRECTION_TO_SERVER)
+    if err != nil {
+        return nil, err
     }
 
-    if !util.IsAsciiPrintable(string(responseData)) ||
-        strings.Compare(string(responseData), f.config.TestStream) != 0 {
-        return util.RetErrStr("testCircuit() data corruption from server side")
+    if socket := f.socket.Load(); socket != nil {
+        return socket.exchangeControl(encrypted)
     }
 
-    return nil
+    response, err := f.sendTransmission(f.config.HTTPVerb, f.inputURI, f.postParameters(encrypted), time.Time{})
+    if err != nil {
+        return nil, err
+    }
+    if len(response) == 0 {
+        return nil, ERROR_CONTROL_NO_REPLY
+    }
+
+    payload, decoded, err := decryptData(string(response), f.rxKey, f.negotiated.CipherSuite,
+        FLAG_DIRECTION_TO_CLIENT)
+    if err != nil {
+        return nil, err
+    }
+    if decoded.frameType != FRAME_CONTROL {
+        return nil, ERROR_CONTROL_UNEXPECTED
+    }
+
+    return decodeControl(payload)
 }
 
 func (f *NetChannelClient) writeStream(rawData []byte, flags FlagVal) (read int, written int, err error) {
-    if !((flags & FLAG_TEST_CONNECTION) > 0) && f.connected == false {
+    if !((flags & FLAG_TEST_CONNECTION) > 0) && !f.connected.Load() {
         return 0,0, util.RetErrStr("writeStream(): client not connected")
     }
 
-    if (flags & FLAG_TERMINATE_CONNECTION) > 0 {
-        rawData, _ = returnCommandString(FLAG_TERMINATE_CONNECTION, *f.config)
+    /* A Write() larger than the negotiated frame size is sent one fragment per request */
+    if flags == 0 && len(rawData) > int(f.negotiated.MaxFrameSize) {
+        return f.writeFragments(rawData)
     }
-    if rawData == nil && (flags & FLAG_CHECK_STREAM_DATA) > 0 {
-        rawData, _ = returnCommandString(FLAG_CHECK_STREAM_DATA, *f.config)
+
+    return f.transmitFrame(rawData, nil, flags)
+}
+
+func (f *NetChannelClient) writeFragments(rawData []byte) (read int, written int, err error) {
+    var id = atomic.AddUint32(&f.messageId, 1)
+    for offset := 0; offset != len(rawData); {
+        fragment, header := nextFragment(rawData, id, offset, f.negotiated.MaxFrameSize)
+        fragmentRead, fragmentWritten, err := f.transmitFrame(fragment, header, 0)
+        if err != io.EOF {
+            return read, written, err
+        }
+
+        read += fragmentRead
+        written += fragmentWritten
+        offset += len(fragment)
     }
 
-    /* Generate parameters */
-    var (
-        parmMap             = make(map[string]string)
-        genPostStatus       error
-    )
-    if parmMap, genPostStatus = f.generatePOSTrequest(rawData, flags); genPostStatus != nil {
-        return 0, 0, genPostStatus
+    return read, written, io.EOF
+}
+
+func (f *NetChannelClient) transmitFrame(rawData []byte, fragment *fragmentHeader, flags FlagVal) (read int,
+    written int, err error) {
+    encrypted, sealStatus := f.sealRequest(rawData, fragment, flags)
+    if sealStatus != nil {
+        return 0, 0, sealStatus
+    }
+
+    /* Only the requests that carry a Write() are bound by the write deadline */
+    var deadline time.Time
+    if flags == 0 {
+        deadline = f.deadlines.writing()
+    }
+
+    /* Over a WebSocket, data from the server arrives in readSocket() instead */
+    if socket := f.socket.Load(); socket != nil {
+        if err := socket.send(encrypted, deadline); err != nil {
+            return 0, 0, err
+        }
+        return 0, len(rawData), io.EOF
     }
 
     /* Transmit */
     var body []byte
-    body, sendStatus := f.sendTransmission(f.config.HTTPVerb, f.inputURI, parmMap)
-    if sendStatus == nil && body == nil {
-        /* This is the case in which Write() abruptly forces an HTTP channel to close */
-        return 0,0, io.EOF
+    body, sendStatus := f.sendTransmission(f.config.HTTPVerb, f.inputURI, f.postParameters(encrypted), deadline)
+    if sendStatus != nil {
+        return 0, 0, sendStatus
     }
     read = len(body)
     written = len(rawData)
 
     if read != 0 {
-        /* Decode the body (TransferUnit) and store in NetChannelClient.ResponseData */
+        /* Decode the body (frame) and store in NetChannelClient.ResponseData */
         if _, err = f.processHTTPresponse(body, flags); err != nil {
             return 0, 0, err
         }
@@ -475,63 +765,89 @@ func (f *NetChannelClient) writeStream(rawData []byte, flags FlagVal) (read int,
 }
 
 func (f *NetChannelClient) processHTTPresponse(body []byte, flags FlagVal) (written int, err error) {
-    /* Decode the body (TransferUnit) and store in NetChannelClient.ResponseData */
-    clientId, rawData, _, err := decryptData(string(body), f.secret)
+    /* Decode the body (frame) and store in NetChannelClient.ResponseData */
+    record, err := util.B64D(string(body))
     if err != nil {
         return 0, err
     }
-    if strings.Compare(clientId, f.clientIdString) != 0 {
-        return 0, util.RetErrStr("Invalid server response")
+    rawData, decoded, err := f.openServerRecord(record)
+    if err != nil {
+        return 0, err
     }
 
-    if (f.flags & FLAG_COMPRESS) > 0 && !((flags & FLAG_TEST_CONNECTION) > 0) {
-        var (
-            streamStatus        error = nil
-            decompressed        []byte
-        )
+    return f.processFrame(rawData, decoded)
+}
 
-        decompressed, streamStatus = util.DecompressStream(rawData)
-        if streamStatus != nil && len(decompressed) == 0 {
-            return 0, err
+func (f *NetChannelClient) processFrame(rawData []byte, decoded *frame) (written int, err error) {
+    if err := checkFrameSize(decoded, f.negotiated.MaxFrameSize); err != nil {
+        return 0, err
+    }
+
+    /* The server only answers a poll with a control message once the NetInstance is closed */
+    if decoded.frameType == FRAME_CONTROL {
+        if message, err := decodeControl(rawData); err != nil || message.controlType != CONTROL_TERMINATE {
+            return 0, ERROR_CONTROL_UNEXPECTED
         }
 
-        rawData = decompressed
-    }
+        f.connected.Store(false)
+        f.rxLock.Lock()
+        f.closed = true
+        f.ticket = nil
+        f.resumptionSecret = nil
+        f.rxLock.Unlock()
+        f.rxSignal.notify()
 
-    /* Write either the compressed or decompressed stream */
-    if f.responseData == nil {
-        f.responseData = &bytes.Buffer{}
-    }
-    if written, err = f.responseData.Write(rawData); err != nil {
-        return written, err
+        return 0, ERROR_TERMINATE
     }
 
-    return written, nil
-}
+    /* Only frames sent with FRAME_FLAG_COMPRESSED are decompressed, see compress.go */
+    if rawData, err = decompressPayload(f.negotiated.Compression, decoded, rawData,
+        f.negotiated.MaxFrameSize); err != nil {
+        return 0, err
+    }
 
-func (f *NetChannelClient) generatePOSTrequest(rawData []byte, flags FlagVal) (map[string]string, error) {
-    if len(rawData) == 0 && flags != 0 {
-        var (
-            err error
-            tmp []byte
-        )
-        if tmp, err = returnCommandString(flags, *f.config); err == nil {
-            rawData = tmp
+    /* Nothing is delivered until the last fragment of a message has arrived */
+    if decoded.fragment != nil {
+        if rawData, err = f.reassembly.add(decoded.fragment, rawData); err != nil || rawData == nil {
+            return 0, err
         }
     }
 
-    if len(rawData) == 0 {
-        return nil, util.RetErrStr("No input data")
+    /* Write either the compressed or decompressed stream */
+    f.rxLock.Lock()
+    if f.responseData == nil {
+        f.responseData = &bytes.Buffer{}
     }
+    written, err = f.responseData.Write(rawData)
+    f.rxLock.Unlock()
+    f.rxSignal.notify()
+
+    return written, err
+}
 
+func (f *NetChannelClient) sealRequest(rawData []byte, fragment *fragmentHeader,
+    flags FlagVal) ([]byte, error) {
     var (
         encrypted           []byte
         processStatus       error
     )
-    if encrypted, processStatus = f.compressEncryptData(rawData, flags); processStatus != nil {
+    if control := controlForFlags(flags); control != 0 {
+        /* Internal commands are sent as control frames, see control.go */
+        encrypted, processStatus = encryptControl(&controlMessage{controlType: control, body: rawData}, f.txKey,
+            f.negotiated.CipherSuite, FLAG_DIRECTION_TO_SERVER)
+    } else if len(rawData) == 0 {
+        return nil, util.RetErrStr("No input data")
+    } else {
+        encrypted, processStatus = f.compressEncryptData(rawData, fragment, flags)
+    }
+    if processStatus != nil {
         return nil, processStatus
     }
 
+    return encrypted, nil
+}
+
+func (f *NetChannelClient) postParameters(encrypted []byte) map[string]string {
     var parmMap = make(map[string]string)
 
     /* key = b64(ClientIdString) value = b64(JSON(<data>)) */
@@ -539,30 +855,21 @@ func (f *NetChannelClient) generatePOSTrequest(rawData []byte, flags FlagVal) (m
     key := util.B64E([]byte(f.clientIdString))
     parmMap[key] = value
 
-    return parmMap, nil
+    return parmMap
 }
 
-func (f *NetChannelClient) compressEncryptData(rawData []byte, flags FlagVal) (encrypted []byte, err error) {
+func (f *NetChannelClient) compressEncryptData(rawData []byte, fragment *fragmentHeader,
+    flags FlagVal) (encrypted []byte, err error) {
     err = nil
 
-    /* Check for high-entropy compression inflation and generate a compression stream */
-    var (
-        compressionFlag     FlagVal = 0
-        deflateStatus       error = nil
-        txData              = rawData
-    )
-    if (f.flags & FLAG_COMPRESS) > 0 && len(rawData) > util.GetCompressedSize(rawData) &&
-        !((flags & FLAG_TEST_CONNECTION) > 0) /* Compression is not required for testing the circuit */ {
-        compressionFlag |= FLAG_COMPRESS
-
-        txData, deflateStatus = util.CompressStream(txData)
-        if deflateStatus != nil {
-            return nil, deflateStatus
-        }
+    /* High-entropy data is sent as is, see compress.go */
+    txData, compressionFlag, err := compressPayload(f.negotiated.Compression, rawData)
+    if err != nil {
+        return nil, err
     }
 
-    f.flags |= FLAG_DIRECTION_TO_SERVER
-    encrypted, err = encryptData(txData, f.secret, FLAG_DIRECTION_TO_SERVER, compressionFlag, f.clientIdString)
+    encrypted, err = encryptFragment(txData, fragment, f.txKey, f.negotiated.CipherSuite,
+        FLAG_DIRECTION_TO_SERVER, compressionFlag)
     if err != nil {
         return nil, err
     }
@@ -571,57 +878,62 @@ func (f *NetChannelClient) compressEncryptData(rawData []byte, flags FlagVal) (e
 }
 
 func (f *NetChannelClient) readStream(p []byte, flags FlagVal) (read int, err error) {
-    if !((flags & FLAG_TEST_CONNECTION) > 0) && f.connected == false {
+    if !((flags & FLAG_TEST_CONNECTION) > 0) && !f.connected.Load() {
         return 0, util.RetErrStr("readStream: client not connected")
     }
 
-    if f.responseData == nil {
-        return 0, io.EOF
-    }
+    f.rxLock.Lock()
+    defer f.rxLock.Unlock()
 
-    read = f.responseData.Len()
-    if read == 0 {
+    if f.responseData == nil || f.responseData.Len() == 0 {
         return 0, io.EOF
     }
 
-    f.responseData.Read(p)
+    read, _ = f.responseData.Read(p)
 
     return read, io.EOF
 }
 
-func (f* NetChannelClient) sendTransmission(verb string, URI string, params map[string]string) ([]byte, error) {
+/* A zero deadline does not bound the request */
+func (f* NetChannelClient) sendTransmission(verb string, URI string, params map[string]string,
+    deadline time.Time) ([]byte, error) {
+    var ctx = context.Background()
+    if !deadline.IsZero() {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithDeadline(ctx, deadline)
+        defer cancel()
+    }
+
     var (
         req             *http.Request
         resp            *http.Response
         reqError        error
     )
-    if req, reqError = f.generateHTTPheaders(URI, verb, params); reqError != nil {
+    if req, reqError = f.generateHTTPheaders(ctx, URI, verb, params); reqError != nil {
         return nil, reqError
     }
 
-    /*
-     * This method invokes a thread which waits for a Write() call, and terminates the read request
-     *  coming from the client to server. Consequently, the only type of request which ought to be
-     *  terminated is a FLAG_CHECK_STREAM_DATA request, which, upon termination, does not contain
-     *  data. If it does contain data, then a Write() was not called
-     */
-    resp, stopStatus := f.waitForWriteTxCancel(req)
-    if resp == nil && stopStatus == nil{
-        /*
-         * Graceful termination of the FLAG_CHECK_STREAM_DATA request. There is no response, as a
-         *  consequence of the abrupt termination of the stream. There is no data to be returned
-         */
-        return nil, nil
+    if resp, reqError = f.httpClient.Do(req); reqError != nil {
+        if ctx.Err() == context.DeadlineExceeded {
+            return nil, os.ErrDeadlineExceeded
+        }
+        return nil, reqError
     }
 
-    /*
-     * The FLAG_CHECK_STREAM_DATA request was terminated, but not by force due to Write(), but because
-     *  the server supplemented data on the stream. Check for a normal response
-     */
+    /* The body is read to the end, so that the connection is returned to the transport */
+    defer resp.Body.Close()
+    switch resp.StatusCode {
+    case http.StatusRequestTimeout, http.StatusBadGateway, http.StatusGatewayTimeout:
+        /* Answered by a proxy rather than the gate, see proxy.go */
+        io.Copy(io.Discard, resp.Body)
+        return nil, ERROR_PROXY_TIMEOUT
+    }
     if resp.Status != "200 OK" {
-        return nil, util.RetErrStr("HTTP 200 OK not returned")
+        /* The server describes handshake failures (i.e. a refused curve) in the body */
+        reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+        io.Copy(io.Discard, resp.Body)
+        return nil, util.RetErrStr("HTTP 200 OK not returned: " + strings.TrimSpace(string(reason)))
     }
-    defer resp.Body.Close()
 
     body, err := ioutil.ReadAll(resp.Body)
     if err != nil {
@@ -630,52 +942,7 @@ func (f* NetChannelClient) sendTransmission(verb string, URI string, params map[
     return body, nil
 }
 
-func (f *NetChannelClient) waitForWriteTxCancel(httpRequestInput *http.Request) (*http.Response, error) {
-    var (
-        tr                  = &http.Transport{}
-        httpClient          = &http.Client{Transport: tr}
-        respIo              = make(chan *http.Response)
-    )
-    f.request               = httpRequestInput
-    f.transport             = tr
-
-    go func (httpRequest *http.Request) {
-        util.Sleep(10 * time.Millisecond)
-        var (
-            response        *http.Response
-            rxStatus        error = nil
-        )
-        if response, rxStatus = httpClient.Do(httpRequest); rxStatus != nil {
-            /* If cancelled, the channel will close and the HTTP request will be cleaned up */
-            close(respIo)
-            return
-        }
-        /*
-         * In the instance of a regular transmit, this object should be passed, and this method
-         *  should ultimately server no purpose.
-         */
-        respIo <- response
-    } (f.request)
-
-    resp, ok := <- respIo
-    if !ok {
-        /* Forced write request -- the request is cancelled, so permit another transmit */
-        f.transport    = nil
-        f.request      = nil
-        f.getReqKilled = true
-        return nil, nil
-    } else {
-        defer close(respIo)
-    }
-
-    /*
-     * The timeout for FLAG_CHECK_STREAM_DATA was not reached, and the server has transmitted data
-     *  in the meantime, meaning a response body should exist.
-     */
-    return resp, nil
-}
-
-func (f *NetChannelClient) generateHTTPheaders(URI string, verb string,
+func (f *NetChannelClient) generateHTTPheaders(ctx context.Context, URI string, verb string,
     formMap map[string]string) (*http.Request, error) {
 
     form := url.Values{}
@@ -688,7 +955,14 @@ func (f *NetChannelClient) generateHTTPheaders(URI string, verb string,
         req         *http.Request
         reqStatus   error
     )
-    if req, reqStatus = http.NewRequest(verb /* POST */, URI, strings.NewReader(formEncoded)); reqStatus != nil {
+    /* LocalAddr() and RemoteAddr() follow the connection that carries each request */
+    ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+        GotConn: func(info httptrace.GotConnInfo) {
+            f.addrs.set(info.Conn.LocalAddr(), info.Conn.RemoteAddr())
+        },
+    })
+    if req, reqStatus = http.NewRequestWithContext(ctx, verb /* POST */, URI,
+        strings.NewReader(formEncoded)); reqStatus != nil {
         return nil, reqStatus
     }
 
@@ -698,7 +972,6 @@ func (f *NetChannelClient) generateHTTPheaders(URI string, verb string,
      *  Most common ever Content-Type
      */
     req.Header.Set("Content-Type", f.config.ContentType)
-    req.Header.Set("Connection", "close")
 
     /*
      * "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36
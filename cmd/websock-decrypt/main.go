@@ -0,0 +1,575 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+/*
+ * websock-decrypt reads a pcap capture, reassembles the HTTP exchanges made to a
+ *  websock gate, and prints every record that can be opened using a key log written
+ *  by WithKeyLog() or WithServiceKeyLog():
+ *
+ *  websock-decrypt -pcap capture.pcap -keylog keys.log -gate /gate.php
+ *
+ * Only the classic libpcap format is read (not pcapng), with Ethernet, raw IP, BSD
+ *  loopback or Linux cooked link layers, over IPv4 or IPv6.
+ */
+package main
+
+import (
+    "os"
+    "io"
+    "fmt"
+    "net"
+    "flag"
+    "sort"
+    "time"
+    "bufio"
+    "bytes"
+    "errors"
+    "strings"
+    "net/url"
+    "net/http"
+    "encoding/hex"
+    "encoding/binary"
+    "unicode/utf8"
+
+    websock "github.com/AlexRuzin/netcp"
+)
+
+func main() {
+    os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+/* Returns the exit status */
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+    var flags = flag.NewFlagSet("websock-decrypt", flag.ContinueOnError)
+    flags.SetOutput(stderr)
+    var (
+        pcapPath    = flags.String("pcap", "", "libpcap capture file")
+        keyLogPath  = flags.String("keylog", "", "websock key log file")
+        gatePath    = flags.String("gate", "", "only decode requests to this path, i.e. /gate.php")
+    )
+    if err := flags.Parse(args); err != nil {
+        return 2
+    }
+    if *pcapPath == "" || *keyLogPath == "" {
+        flags.Usage()
+        return 2
+    }
+
+    var fail = func(err error) int {
+        fmt.Fprintln(stderr, "websock-decrypt: " + err.Error())
+        return 1
+    }
+
+    keyLogFile, err := os.Open(*keyLogPath)
+    if err != nil {
+        return fail(err)
+    }
+    keyLog, err := websock.ParseKeyLog(keyLogFile)
+    keyLogFile.Close()
+    if err != nil {
+        return fail(err)
+    }
+
+    pcapFile, err := os.Open(*pcapPath)
+    if err != nil {
+        return fail(err)
+    }
+    flows, err := readPcap(bufio.NewReader(pcapFile))
+    pcapFile.Close()
+    if err != nil {
+        return fail(err)
+    }
+
+    var output = &printer{out: stdout, keyLog: keyLog}
+    for _, conn := range pairConnections(flows) {
+        output.printConnection(conn, *gatePath)
+    }
+    if output.warnings != 0 {
+        fmt.Fprintf(stderr, "websock-decrypt: %d warnings, some traffic was not decoded\n", output.warnings)
+    }
+
+    return 0
+}
+
+/************************************************************
+ * libpcap parsing                                          *
+ ************************************************************/
+
+const (
+    LINKTYPE_NULL               = 0
+    LINKTYPE_ETHERNET           = 1
+    LINKTYPE_RAW                = 101
+    LINKTYPE_LINUX_SLL          = 113
+)
+
+/* Larger records are assumed to be corrupt */
+const maxCaptureRecord          = 1 << 20
+
+var ERROR_PCAP_FORMAT           = errors.New("not a libpcap capture (pcapng is not supported)")
+
+type flowKey struct {
+    src                         string
+    dst                         string
+}
+
+type tcpSegment struct {
+    seq                         uint32
+    captured                    time.Time
+    payload                     []byte
+}
+
+type tcpFlow struct {
+    key                         flowKey
+    isn                         uint32
+    syn                         bool
+    segments                    []tcpSegment
+}
+
+/* Returns every TCP flow in the order it was first seen */
+func readPcap(reader io.Reader) ([]*tcpFlow, error) {
+    var header = make([]byte, 24)
+    if _, err := io.ReadFull(reader, header); err != nil {
+        return nil, ERROR_PCAP_FORMAT
+    }
+
+    var (
+        order       binary.ByteOrder
+        nanosecond  bool
+    )
+    switch binary.LittleEndian.Uint32(header) {
+    case 0xa1b2c3d4:
+        order = binary.LittleEndian
+    case 0xd4c3b2a1:
+        order = binary.BigEndian
+    case 0xa1b23c4d:
+        order, nanosecond = binary.LittleEndian, true
+    case 0x4d3cb2a1:
+        order, nanosecond = binary.BigEndian, true
+    default:
+        return nil, ERROR_PCAP_FORMAT
+    }
+    var linkType = order.Uint32(header[20:])
+
+    var (
+        flows       = make(map[flowKey]*tcpFlow)
+        ordered     []*tcpFlow
+        record      = make([]byte, 16)
+    )
+    for {
+        if _, err := io.ReadFull(reader, record); err == io.EOF {
+            break
+        } else if err != nil {
+            return nil, err
+        }
+
+        var length = order.Uint32(record[8:])
+        if length > maxCaptureRecord {
+            return nil, errors.New("capture record is too large")
+        }
+        var packet = make([]byte, length)
+        if _, err := io.ReadFull(reader, packet); err != nil {
+            return nil, err
+        }
+
+        var subsecond = time.Duration(order.Uint32(record[4:])) * time.Microsecond
+        if nanosecond {
+            subsecond = time.Duration(order.Uint32(record[4:]))
+        }
+        var timestamp = time.Unix(int64(order.Uint32(record)), 0).Add(subsecond)
+
+        key, seq, syn, payload, ok := decodePacket(linkType, packet)
+        if !ok {
+            continue
+        }
+
+        flow := flows[key]
+        if flow == nil {
+            flow = &tcpFlow{key: key}
+            flows[key] = flow
+            ordered = append(ordered, flow)
+        }
+        if syn {
+            flow.syn, flow.isn = true, seq
+        }
+        if len(payload) != 0 {
+            flow.segments = append(flow.segments, tcpSegment{seq: seq, captured: timestamp, payload: payload})
+        }
+    }
+
+    return ordered, nil
+}
+
+func decodePacket(linkType uint32, packet []byte) (key flowKey, seq uint32, syn bool, payload []byte, ok bool) {
+    var network []byte
+    switch linkType {
+    case LINKTYPE_ETHERNET:
+        if len(packet) < 14 {
+            return
+        }
+        var etherType, offset = binary.BigEndian.Uint16(packet[12:]), 14
+        for etherType == 0x8100 && len(packet) >= offset + 4 {
+            etherType, offset = binary.BigEndian.Uint16(packet[offset + 2:]), offset + 4
+        }
+        if etherType != 0x0800 && etherType != 0x86dd {
+            return
+        }
+        network = packet[offset:]
+    case LINKTYPE_NULL:
+        if len(packet) < 4 {
+            return
+        }
+        network = packet[4:]
+    case LINKTYPE_LINUX_SLL:
+        if len(packet) < 16 {
+            return
+        }
+        network = packet[16:]
+    case LINKTYPE_RAW:
+        network = packet
+    default:
+        return
+    }
+
+    var (
+        srcIP, dstIP    net.IP
+        segment         []byte
+    )
+    if len(network) == 0 {
+        return
+    }
+    switch network[0] >> 4 {
+    case 4:
+        var headerLen = int(network[0] & 0x0f) * 4
+        if len(network) < 20 || headerLen < 20 || len(network) < headerLen || network[9] != 6 {
+            return
+        }
+        var totalLen = int(binary.BigEndian.Uint16(network[2:]))
+        if totalLen < headerLen || totalLen > len(network) {
+            totalLen = len(network)
+        }
+        srcIP, dstIP, segment = net.IP(network[12:16]), net.IP(network[16:20]), network[headerLen:totalLen]
+    case 6:
+        if len(network) < 40 || network[6] != 6 {
+            return
+        }
+        var end = 40 + int(binary.BigEndian.Uint16(network[4:]))
+        if end > len(network) {
+            end = len(network)
+        }
+        srcIP, dstIP, segment = net.IP(network[8:24]), net.IP(network[24:40]), network[40:end]
+    default:
+        return
+    }
+
+    if len(segment) < 20 {
+        return
+    }
+    var dataOffset = int(segment[12] >> 4) * 4
+    if dataOffset < 20 || dataOffset > len(segment) {
+        return
+    }
+
+    key = flowKey{
+        src:    net.JoinHostPort(srcIP.String(), fmt.Sprint(binary.BigEndian.Uint16(segment[0:]))),
+        dst:    net.JoinHostPort(dstIP.String(), fmt.Sprint(binary.BigEndian.Uint16(segment[2:]))),
+    }
+    seq = binary.BigEndian.Uint32(segment[4:])
+    syn = (segment[13] & 0x02) != 0
+    payload = append([]byte{}, segment[dataOffset:]...)
+
+    return key, seq, syn, payload, true
+}
+
+/* Sequence number of the first byte of the stream */
+func (f *tcpFlow) base() uint32 {
+    if f.syn {
+        return f.isn + 1
+    }
+
+    var base uint32
+    if len(f.segments) != 0 {
+        base = f.segments[0].seq
+        for _, segment := range f.segments {
+            if int32(segment.seq - base) < 0 {
+                base = segment.seq
+            }
+        }
+    }
+    return base
+}
+
+/* Orders the segments of a flow, dropping retransmissions, and stops at the first gap */
+func (f *tcpFlow) stream() []byte {
+    var base = f.base()
+    sort.SliceStable(f.segments, func(i, j int) bool {
+        return f.segments[i].seq - base < f.segments[j].seq - base
+    })
+
+    var stream []byte
+    for _, segment := range f.segments {
+        var offset = int(segment.seq - base)
+        if offset > len(stream) {
+            break
+        }
+        if end := offset + len(segment.payload); end > len(stream) {
+            stream = append(stream, segment.payload[len(stream) - offset:]...)
+        }
+    }
+
+    return stream
+}
+
+/* When the byte at offset in the stream was first captured, retransmissions aside */
+func (f *tcpFlow) capturedAt(offset int) time.Time {
+    var (
+        base        = f.base()
+        captured    time.Time
+    )
+    for _, segment := range f.segments {
+        var start = int(segment.seq - base)
+        if offset < start || offset >= start + len(segment.payload) {
+            continue
+        }
+        if captured.IsZero() || segment.captured.Before(captured) {
+            captured = segment.captured
+        }
+    }
+
+    return captured
+}
+
+/************************************************************
+ * HTTP reassembly and decryption                           *
+ ************************************************************/
+
+type connection struct {
+    client                      *tcpFlow
+    server                      *tcpFlow
+}
+
+/* Reads the stream of a flow, and tells when the next byte read was captured */
+type streamReader struct {
+    *bufio.Reader
+    flow                        *tcpFlow
+    source                      *bytes.Reader
+    length                      int
+}
+
+func newStreamReader(flow *tcpFlow) *streamReader {
+    var stream = flow.stream()
+    var source = bytes.NewReader(stream)
+
+    return &streamReader{
+        Reader: bufio.NewReader(source),
+        flow:   flow,
+        source: source,
+        length: len(stream),
+    }
+}
+
+func (f *streamReader) captured() time.Time {
+    return f.flow.capturedAt(f.length - f.source.Len() - f.Buffered())
+}
+
+/* The client side of a connection is the flow that starts with an HTTP request */
+func pairConnections(flows []*tcpFlow) []connection {
+    var byKey = make(map[flowKey]*tcpFlow)
+    for _, flow := range flows {
+        byKey[flow.key] = flow
+    }
+
+    var connections []connection
+    for _, flow := range flows {
+        var stream = flow.stream()
+        if len(stream) == 0 {
+            continue
+        }
+        if _, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(stream))); err != nil {
+            continue
+        }
+
+        connections = append(connections, connection{
+            client: flow,
+            server: byKey[flowKey{src: flow.key.dst, dst: flow.key.src}],
+        })
+    }
+
+    return connections
+}
+
+/*
+ * Writes the decoded exchanges. Anything that cannot be decoded, such as the records
+ *  carried over a WebSocket or those of a legacy RC4 circuit, is reported as a warning
+ */
+type printer struct {
+    out                         io.Writer
+    keyLog                      *websock.KeyLog
+    warnings                    int
+}
+
+func (f *printer) warn(format string, args ...any) {
+    f.warnings += 1
+    fmt.Fprintf(f.out, "    warning: " + format + "\n", args...)
+}
+
+func (f *printer) printConnection(conn connection, gatePath string) {
+    var (
+        requests    = newStreamReader(conn.client)
+        responses   *streamReader
+    )
+    if conn.server != nil {
+        responses = newStreamReader(conn.server)
+    }
+
+    /* Each message is stamped with the capture time of its first byte */
+    for {
+        var requestAt = requests.captured()
+        request, err := http.ReadRequest(requests.Reader)
+        if err == io.EOF {
+            return
+        } else if err != nil {
+            f.warn("data sent by %s is not HTTP, and was not decoded", conn.client.key.src)
+            return
+        }
+        requestBody, _ := io.ReadAll(request.Body)
+
+        var (
+            response        *http.Response
+            responseBody    []byte
+            responseAt      time.Time
+        )
+        if responses != nil {
+            responseAt = responses.captured()
+            if response, err = http.ReadResponse(responses.Reader, request); err == nil {
+                responseBody, _ = io.ReadAll(response.Body)
+            }
+        }
+
+        if gatePath != "" && request.URL.Path != gatePath {
+            continue
+        }
+
+        fmt.Fprintf(f.out, "[%s] %s -> %s %s %s\n", requestAt.Format(time.RFC3339Nano),
+            conn.client.key.src, conn.client.key.dst, request.Method, request.URL.Path)
+
+        /* A WebSocket upgrade carries its record in the query, see websocket.go */
+        var parameters = string(requestBody)
+        if len(requestBody) == 0 {
+            parameters = request.URL.RawQuery
+        }
+        var responseLine string
+        if response != nil {
+            responseLine = fmt.Sprintf("[%s] %s -> %s response", responseAt.Format(time.RFC3339Nano),
+                conn.server.key.src, conn.server.key.dst)
+        }
+        f.printExchange(parameters, response, responseBody, responseLine)
+
+        if response != nil && response.StatusCode == http.StatusSwitchingProtocols {
+            f.warn("the circuit moved to a WebSocket, and the records sent over it were not decoded")
+            return
+        }
+    }
+}
+
+/* responseLine stamps the response, and is printed before it */
+func (f *printer) printExchange(parameters string, response *http.Response, responseBody []byte,
+    responseLine string) {
+    form, err := url.ParseQuery(parameters)
+    if err != nil {
+        fmt.Fprintln(f.out, "    request body is not form encoded")
+        return
+    }
+
+    var clientId, record string
+    for parameter, values := range form {
+        if id, ok := f.keyLog.MatchParameter(parameter); ok && len(values) != 0 {
+            clientId, record = id, values[0]
+            break
+        }
+    }
+    if clientId == "" {
+        /* A circuit request carries a single parameter, the key exchange carries several */
+        if len(form) == 1 {
+            fmt.Fprintln(f.out, "    circuit is not in the key log")
+        } else {
+            fmt.Fprintf(f.out, "    key exchange (%d parameters)\n", len(form))
+        }
+        if response != nil {
+            fmt.Fprintln(f.out, responseLine)
+            fmt.Fprintf(f.out, "    response: %s, %d bytes\n", response.Status, len(responseBody))
+        }
+        return
+    }
+
+    fmt.Fprintf(f.out, "    circuit %s\n", clientId)
+    f.printRecord(clientId, record, true)
+
+    if response != nil {
+        fmt.Fprintln(f.out, responseLine)
+    }
+    switch {
+    case response == nil:
+        fmt.Fprintln(f.out, "    no response captured")
+    case response.StatusCode != http.StatusOK:
+        fmt.Fprintf(f.out, "    response: %s %s\n", response.Status, strings.TrimSpace(string(responseBody)))
+    case len(bytes.TrimSpace(responseBody)) == 0:
+        fmt.Fprintf(f.out, "    response: %s, no record\n", response.Status)
+    default:
+        f.printRecord(clientId, string(responseBody), false)
+    }
+}
+
+func (f *printer) printRecord(clientId string, b64Encoded string, toServer bool) {
+    var direction = "server -> client"
+    if toServer {
+        direction = "client -> server"
+    }
+
+    record, err := f.keyLog.DecryptRecord(clientId, b64Encoded, toServer)
+    if err != nil {
+        f.warn("%s  record was not decoded: %s", direction, err.Error())
+        return
+    }
+
+    /* The first byte of a control frame is the control type, see control.go */
+    if record.FrameType == websock.FRAME_CONTROL && len(record.Data) != 0 {
+        fmt.Fprintf(f.out, "    %s  seq %d  epoch %d  control %s\n", direction, record.Sequence, record.Epoch,
+            websock.ControlName(record.Data[0]))
+        if record.Data = record.Data[1:]; len(record.Data) == 0 {
+            return
+        }
+    } else {
+        fmt.Fprintf(f.out, "    %s  seq %d  epoch %d  flags %#04x  %d bytes\n", direction, record.Sequence,
+            record.Epoch, record.Flags, len(record.Data))
+    }
+    if utf8.Valid(record.Data) && !bytes.ContainsFunc(record.Data, func(r rune) bool {
+        return r < 0x20 && r != '\n' && r != '\t'
+    }) {
+        fmt.Fprintf(f.out, "        %q\n", record.Data)
+        return
+    }
+    for _, line := range strings.Split(strings.TrimRight(hex.Dump(record.Data), "\n"), "\n") {
+        fmt.Fprintln(f.out, "        " + line)
+    }
+}
+
+/* EOF */
@@ -0,0 +1,166 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package main
+
+import (
+    "os"
+    "bytes"
+    "strings"
+    "testing"
+    "time"
+    "path/filepath"
+
+    websock "github.com/AlexRuzin/netcp"
+)
+
+/*
+ * testdata/circuits.pcap holds three circuits captured with their key log: one that
+ *  polls, one that moves to a WebSocket, and one that negotiated legacy RC4
+ */
+const (
+    fixturePcap                 = "testdata/circuits.pcap"
+    fixtureKeyLog               = "testdata/circuits.keylog"
+)
+
+func TestDecryptCapture(t *testing.T) {
+    var stdout, stderr bytes.Buffer
+    if status := run([]string{"-pcap", fixturePcap, "-keylog", fixtureKeyLog}, &stdout, &stderr); status != 0 {
+        t.Fatalf("exit status %d: %s", status, stderr.String())
+    }
+
+    var output = stdout.String()
+    for _, expected := range []string{
+        "key exchange",
+        "control poll",
+        "control terminate",
+        "control ack",
+        "control upgrade",
+        "warning: the circuit moved to a WebSocket",
+        "warning: client -> server  record was not decoded: " + websock.ERROR_KEYLOG_SUITE.Error(),
+    } {
+        if !strings.Contains(output, expected) {
+            t.Fatalf("output does not contain %q:\n%s", expected, output)
+        }
+    }
+
+    /* The message of the polling circuit is decoded in both directions */
+    if count := strings.Count(output, `"hello over polling"`); count != 2 {
+        t.Fatalf("expected the message twice, got %d:\n%s", count, output)
+    }
+    if !strings.Contains(stderr.String(), "warnings") {
+        t.Fatalf("warnings were not reported on stderr: %q", stderr.String())
+    }
+
+    /* Each message is stamped with its own capture time, not that of its connection */
+    var stamps = make(map[string]bool)
+    for _, line := range strings.Split(output, "\n") {
+        if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "POST /gate1.php") {
+            stamps[line[:strings.Index(line, "]")]] = true
+        }
+    }
+    if len(stamps) < 4 {
+        t.Fatalf("expected every request to /gate1.php to have its own time stamp:\n%s", output)
+    }
+    if strings.Count(output, " response\n") < 4 {
+        t.Fatalf("responses are not stamped:\n%s", output)
+    }
+
+    /* -gate only decodes requests to the given path */
+    stdout.Reset()
+    run([]string{"-pcap", fixturePcap, "-keylog", fixtureKeyLog, "-gate", "/gate2.php"}, &stdout, &stderr)
+    if strings.Contains(stdout.String(), "/gate1.php") || !strings.Contains(stdout.String(), "/gate2.php") {
+        t.Fatalf("-gate did not filter the requests:\n%s", stdout.String())
+    }
+
+    /* Without the keys, circuits are reported but nothing is decrypted */
+    var emptyKeyLog = filepath.Join(t.TempDir(), "empty.keylog")
+    os.WriteFile(emptyKeyLog, nil, 0600)
+    stdout.Reset()
+    run([]string{"-pcap", fixturePcap, "-keylog", emptyKeyLog}, &stdout, &stderr)
+    if !strings.Contains(stdout.String(), "circuit is not in the key log") || strings.Contains(stdout.String(), "hello") {
+        t.Fatalf("unexpected output without keys:\n%s", stdout.String())
+    }
+
+    if status := run([]string{"-pcap", fixtureKeyLog, "-keylog", fixtureKeyLog}, &stdout, &stderr); status != 1 {
+        t.Fatalf("a key log was read as a capture")
+    }
+    if status := run(nil, &stdout, &stderr); status != 2 {
+        t.Fatalf("expected usage without arguments, got exit status %d", status)
+    }
+}
+
+func TestReadPcap(t *testing.T) {
+    for _, capture := range [][]byte{
+        []byte("not a capture"),
+        {0x0a, 0x0d, 0x0d, 0x0a, 0, 0, 0, 0, 0x4d, 0x3c, 0x2b, 0x1a, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+    } {
+        if _, err := readPcap(bytes.NewReader(capture)); err != ERROR_PCAP_FORMAT {
+            t.Fatalf("expected ERROR_PCAP_FORMAT, got %v", err)
+        }
+    }
+
+    capture, err := os.ReadFile(fixturePcap)
+    if err != nil {
+        t.Fatal(err)
+    }
+    flows, err := readPcap(bytes.NewReader(capture))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if connections := pairConnections(flows); len(connections) == 0 || len(connections) * 2 != len(flows) {
+        t.Fatalf("expected every flow to pair up, got %d connections of %d flows", len(connections), len(flows))
+    }
+
+    /* Segments out of order, retransmitted, and after a gap */
+    var (
+        start       = time.Unix(1000, 0)
+        flow        = &tcpFlow{
+            isn:        99,
+            syn:        true,
+            segments:   []tcpSegment{
+                {seq: 105, captured: start.Add(2 * time.Second), payload: []byte("world")},
+                {seq: 100, captured: start.Add(1 * time.Second), payload: []byte("hello")},
+                {seq: 100, captured: start.Add(3 * time.Second), payload: []byte("hello")},
+                {seq: 120, captured: start.Add(4 * time.Second), payload: []byte("lost")},
+            },
+        }
+    )
+    if stream := string(flow.stream()); stream != "helloworld" {
+        t.Fatalf("unexpected stream %q", stream)
+    }
+
+    /* A byte is stamped with its first capture, not a retransmission */
+    for offset, expected := range map[int]time.Time{
+        0:  start.Add(1 * time.Second),
+        4:  start.Add(1 * time.Second),
+        5:  start.Add(2 * time.Second),
+        9:  start.Add(2 * time.Second),
+    } {
+        if captured := flow.capturedAt(offset); !captured.Equal(expected) {
+            t.Fatalf("offset %d: expected %v, got %v", offset, expected, captured)
+        }
+    }
+}
+
+/* EOF */
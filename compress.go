@@ -0,0 +1,178 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package websock
+
+import (
+    "io"
+    "bytes"
+    "compress/gzip"
+
+    "github.com/AlexRuzin/util"
+    "github.com/golang/snappy"
+    "github.com/klauspost/compress/zstd"
+)
+
+/************************************************************
+ * Payload compression                                      *
+ ************************************************************/
+
+/*
+ * The compression algorithm is negotiated in the key exchange (see negotiate.go), and
+ *  is applied to the payload of each data frame on its own, after fragmentation. The
+ *  sender only keeps the compressed payload if it is smaller, in which case it sets
+ *  FRAME_FLAG_COMPRESSED. The receiver decides by that flag alone: a frame without it
+ *  is never decompressed, and a frame with it is refused on a circuit that negotiated
+ *  COMPRESSION_NONE.
+ *
+ * No frame carries more than MaxFrameSize bytes of a message, so a payload that
+ *  decompresses to more than MaxFrameSize bytes is refused with ERROR_DECOMPRESSION,
+ *  before it is fully inflated.
+ *
+ *  COMPRESSION_GZIP      gzip stream, RFC 1952
+ *  COMPRESSION_ZSTD      Zstandard frame, RFC 8878
+ *  COMPRESSION_SNAPPY    Snappy block format
+ */
+var ERROR_DECOMPRESSION         = util.RetErrStr("compressed payload is invalid")
+
+/* Offered with FLAG_COMPRESS, unless WithCompression or WithServiceCompression is used */
+var defaultCompression          = []CompressionAlgorithm{COMPRESSION_ZSTD, COMPRESSION_SNAPPY, COMPRESSION_GZIP}
+
+/* EncodeAll may be called concurrently, and NewWriter does not fail without options */
+var zstdEncoder, _              = zstd.NewWriter(nil)
+
+var zstdMagic                   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+/* Returns the payload to send, and FLAG_COMPRESS if it was compressed */
+func compressPayload(algorithm CompressionAlgorithm, data []byte) ([]byte, FlagVal, error) {
+    if algorithm == COMPRESSION_NONE {
+        return data, 0, nil
+    }
+
+    compressed, err := compress(algorithm, data)
+    if err != nil {
+        return nil, 0, err
+    }
+    if len(compressed) >= len(data) {
+        /* High-entropy data would only grow */
+        return data, 0, nil
+    }
+
+    return compressed, FLAG_COMPRESS, nil
+}
+
+/* The payload is returned as is, unless decoded was sent with FRAME_FLAG_COMPRESSED */
+func decompressPayload(algorithm CompressionAlgorithm, decoded *frame, payload []byte,
+    maxFrameSize uint32) ([]byte, error) {
+    if !decoded.compressed() {
+        return payload, nil
+    }
+    if algorithm == COMPRESSION_NONE {
+        return nil, ERROR_DECOMPRESSION
+    }
+
+    return decompress(algorithm, payload, int(maxFrameSize))
+}
+
+func compress(algorithm CompressionAlgorithm, data []byte) ([]byte, error) {
+    switch algorithm {
+    case COMPRESSION_GZIP:
+        var output bytes.Buffer
+        writer := gzip.NewWriter(&output)
+        if _, err := writer.Write(data); err != nil {
+            return nil, err
+        }
+        if err := writer.Close(); err != nil {
+            return nil, err
+        }
+        return output.Bytes(), nil
+
+    case COMPRESSION_ZSTD:
+        return zstdEncoder.EncodeAll(data, nil), nil
+
+    case COMPRESSION_SNAPPY:
+        return snappy.Encode(nil, data), nil
+    }
+
+    return nil, ERROR_NO_COMMON_COMPRESSION
+}
+
+/* Fails with ERROR_DECOMPRESSION if the payload is malformed, or inflates beyond limit bytes */
+func decompress(algorithm CompressionAlgorithm, data []byte, limit int) ([]byte, error) {
+    var reader io.Reader
+    switch algorithm {
+    case COMPRESSION_GZIP:
+        gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+        if err != nil {
+            return nil, ERROR_DECOMPRESSION
+        }
+        reader = gzipReader
+
+    case COMPRESSION_ZSTD:
+        zstdReader, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+        if err != nil {
+            return nil, ERROR_DECOMPRESSION
+        }
+        defer zstdReader.Close()
+        reader = zstdReader
+
+    case COMPRESSION_SNAPPY:
+        /* The decoded length leads the block, so nothing is inflated beyond the limit */
+        length, err := snappy.DecodedLen(data)
+        if err != nil || length > limit {
+            return nil, ERROR_DECOMPRESSION
+        }
+        decoded, err := snappy.Decode(nil, data)
+        if err != nil {
+            return nil, ERROR_DECOMPRESSION
+        }
+        return decoded, nil
+
+    default:
+        return nil, ERROR_DECOMPRESSION
+    }
+
+    decompressed, err := io.ReadAll(io.LimitReader(reader, int64(limit) + 1))
+    if err != nil || len(decompressed) > limit {
+        return nil, ERROR_DECOMPRESSION
+    }
+
+    return decompressed, nil
+}
+
+/*
+ * Decompresses a payload without knowing the negotiated algorithm, which the key log
+ *  does not record. gzip and zstd are told apart by their magic numbers, and anything
+ *  else is taken to be a snappy block
+ */
+func decompressAny(data []byte, limit int) ([]byte, error) {
+    switch {
+    case len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b:
+        return decompress(COMPRESSION_GZIP, data, limit)
+    case bytes.HasPrefix(data, zstdMagic):
+        return decompress(COMPRESSION_ZSTD, data, limit)
+    }
+
+    return decompress(COMPRESSION_SNAPPY, data, limit)
+}
+
+/* EOF */
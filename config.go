@@ -104,19 +104,16 @@ type ProtocolConfig struct {
     RandomizeHTTPVerb   bool        `json:"randomize_http_verb"`
 
     /*
-     * The default commands are listed below. The first is used by the
-     *  method testCircuit() to verify the PKE subsystem. base32 encoded
+     * The body of the CONTROL_TEST message, which is used by the method
+     *  testCircuit() to verify the PKE subsystem. base32 encoded
      */
     TestStream          string      `json:"CMD1"`
 
     /*
-     * This command asks the server for any data to be read. B32 encoded
+     * Formerly the commands that polled for data and terminated the connection. Both are
+     *  now control frames (see control.go), and these values are no longer sent
      */
     CheckStream         string      `json:"CMD2"`
-
-    /*
-     * Client/Server terminate the connection. B32 encoded string
-     */
     TermConnect         string      `json:"CMD3"`
 }
 
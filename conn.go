@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package websock
+
+import (
+    "net"
+    "net/http"
+    "net/netip"
+    "sync"
+    "time"
+)
+
+/************************************************************
+ * net.Conn support                                         *
+ ************************************************************/
+
+/*
+ * Both ends of a circuit implement net.Conn, so that a circuit may be handed to code
+ *  that expects a connection (i.e. crypto/tls, bufio based protocols or RPC dialers).
+ *
+ * A Read() that is blocked waiting for data returns os.ErrDeadlineExceeded once the
+ *  read deadline passes. Setting a deadline wakes a blocked Read(), so that the new
+ *  deadline applies to it. On the client, the write deadline bounds the HTTP requests
+ *  that carry a Write(). A NetInstance only queues written data for the next poll, so
+ *  its Write() never blocks, and fails once the write deadline has passed.
+ *
+ * LocalAddr() and RemoteAddr() return the addresses of the HTTP connection that most
+ *  recently carried a request of the circuit. The client keeps more than one connection
+ *  open (see transport.go), so the local port may change throughout the life of a circuit.
+ */
+var (
+    _ net.Conn                  = (*NetChannelClient)(nil)
+    _ net.Conn                  = (*NetInstance)(nil)
+)
+
+type deadlines struct {
+    lock                        sync.Mutex
+    read                        time.Time
+    write                       time.Time
+}
+
+type connAddrs struct {
+    lock                        sync.Mutex
+    local                       net.Addr
+    remote                      net.Addr
+}
+
+func (f *deadlines) setRead(t time.Time) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    f.read = t
+}
+
+func (f *deadlines) setWrite(t time.Time) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    f.write = t
+}
+
+func (f *deadlines) reading() time.Time {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    return f.read
+}
+
+func (f *deadlines) writing() time.Time {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    return f.write
+}
+
+/* A zero deadline never passes */
+func deadlinePassed(deadline time.Time) bool {
+    return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+/* Blocks until signal is notified, returns false if the deadline passes first */
+func (f readSignal) wait(deadline time.Time) bool {
+    if deadline.IsZero() {
+        <-f
+        return true
+    }
+
+    var remaining = time.Until(deadline)
+    if remaining <= 0 {
+        return false
+    }
+
+    timer := time.NewTimer(remaining)
+    defer timer.Stop()
+
+    select {
+    case <-f:
+        return true
+    case <-timer.C:
+        return false
+    }
+}
+
+func (f *connAddrs) set(local net.Addr, remote net.Addr) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    f.local = local
+    f.remote = remote
+}
+
+/* Records the addresses of the connection that carried request, on the server */
+func (f *connAddrs) setFromRequest(request *http.Request) {
+    local, _ := request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+    var remote net.Addr = nil
+    if addrPort, err := netip.ParseAddrPort(request.RemoteAddr); err == nil {
+        remote = net.TCPAddrFromAddrPort(addrPort)
+    }
+
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    if local != nil {
+        f.local = local
+    }
+    if remote != nil {
+        f.remote = remote
+    }
+}
+
+/* An unspecified TCP address is returned until a connection has been made */
+func (f *connAddrs) localAddr() net.Addr {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    if f.local == nil {
+        return &net.TCPAddr{}
+    }
+    return f.local
+}
+
+func (f *connAddrs) remoteAddr() net.Addr {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    if f.remote == nil {
+        return &net.TCPAddr{}
+    }
+    return f.remote
+}
+
+/************************************************************
+ * NetChannelClient                                         *
+ ************************************************************/
+
+func (f *NetChannelClient) LocalAddr() net.Addr {
+    return f.addrs.localAddr()
+}
+
+func (f *NetChannelClient) RemoteAddr() net.Addr {
+    return f.addrs.remoteAddr()
+}
+
+func (f *NetChannelClient) SetDeadline(t time.Time) error {
+    f.SetWriteDeadline(t)
+    return f.SetReadDeadline(t)
+}
+
+func (f *NetChannelClient) SetReadDeadline(t time.Time) error {
+    f.deadlines.setRead(t)
+    f.rxSignal.notify()
+
+    return nil
+}
+
+func (f *NetChannelClient) SetWriteDeadline(t time.Time) error {
+    f.deadlines.setWrite(t)
+
+    return nil
+}
+
+/************************************************************
+ * NetInstance                                              *
+ ************************************************************/
+
+func (f *NetInstance) LocalAddr() net.Addr {
+    return f.addrs.localAddr()
+}
+
+func (f *NetInstance) RemoteAddr() net.Addr {
+    return f.addrs.remoteAddr()
+}
+
+func (f *NetInstance) SetDeadline(t time.Time) error {
+    f.SetWriteDeadline(t)
+    return f.SetReadDeadline(t)
+}
+
+func (f *NetInstance) SetReadDeadline(t time.Time) error {
+    f.deadlines.setRead(t)
+    f.rxSignal.notify()
+
+    return nil
+}
+
+func (f *NetInstance) SetWriteDeadline(t time.Time) error {
+    f.deadlines.setWrite(t)
+
+    return nil
+}
+
+/* EOF */
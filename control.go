@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package websock
+
+import (
+    "github.com/AlexRuzin/util"
+)
+
+/************************************************************
+ * Control frames                                           *
+ ************************************************************/
+
+/*
+ * Control messages are carried in frames of type FRAME_CONTROL, so they can never be
+ *  confused with application data, whatever bytes are written to the circuit. The
+ *  payload of a control frame is [1 byte control type][body], and a control frame is
+ *  never compressed or fragmented:
+ *
+ *  CONTROL_POLL        Client: asks for queued data. The server holds the request until
+ *                       data is queued, answering with a data frame, or with an empty
+ *                       response once C2ResponseTimeout passes. The body may ask for a
+ *                       shorter wait, or for the last answer once more, see proxy.go
+ *  CONTROL_TEST        Client: circuit test, answered with CONTROL_TEST echoing the body
+ *  CONTROL_TERMINATE   Client: closes the circuit, answered with CONTROL_ACK. Server: sent
+ *                       in answer to a pending CONTROL_POLL, or to the next request, once
+ *                       the NetInstance is closed
+ *  CONTROL_PING        Client: liveness check, answered with CONTROL_ACK echoing the body
+ *  CONTROL_REKEY       Client: sent under a new epoch of the client key, asks the server to
+ *                       ratchet its own key, which it does before sealing the CONTROL_ACK
+ *  CONTROL_ACK         Server: acknowledges a control message
+ *  CONTROL_UPGRADE     Client: sent in the query of a WebSocket upgrade request, see
+ *                       websocket.go
+ *
+ * A server answers a control type it does not handle with an HTTP error, and the
+ *  circuit remains up.
+ */
+const (
+    CONTROL_POLL                byte = iota + 1
+    CONTROL_TEST
+    CONTROL_TERMINATE
+    CONTROL_PING
+    CONTROL_REKEY
+    CONTROL_ACK
+    CONTROL_UPGRADE
+)
+
+var (
+    ERROR_CONTROL_UNEXPECTED    = util.RetErrStr("unexpected control message")
+    ERROR_CONTROL_NO_REPLY      = util.RetErrStr("control message was not answered")
+)
+
+type controlMessage struct {
+    controlType                 byte
+    body                        []byte
+}
+
+func encodeControl(message *controlMessage) []byte {
+    return append([]byte{message.controlType}, message.body...)
+}
+
+func decodeControl(payload []byte) (*controlMessage, error) {
+    if len(payload) == 0 || payload[0] < CONTROL_POLL || payload[0] > CONTROL_UPGRADE {
+        return nil, ERROR_CONTROL_UNEXPECTED
+    }
+
+    return &controlMessage{
+        controlType:    payload[0],
+        body:           payload[1:],
+    }, nil
+}
+
+/* The control message that the internal FlagVal commands are sent as, or 0 for data */
+func controlForFlags(flags FlagVal) byte {
+    switch {
+    case (flags & FLAG_CHECK_STREAM_DATA) > 0:
+        return CONTROL_POLL
+    case (flags & FLAG_TEST_CONNECTION) > 0:
+        return CONTROL_TEST
+    case (flags & FLAG_TERMINATE_CONNECTION) > 0:
+        return CONTROL_TERMINATE
+    }
+
+    return 0
+}
+
+func encryptControl(message *controlMessage, key *trafficState, suite CipherSuite,
+    directionFlags FlagVal) ([]byte, error) {
+    return sealFrame(&frame{
+        frameType:  FRAME_CONTROL,
+        flags:      frameFlags(directionFlags, 0),
+        payload:    encodeControl(message),
+    }, key, suite, directionFlags)
+}
+
+/* The name of a control type, i.e. for cmd/websock-decrypt */
+func ControlName(controlType byte) string {
+    switch controlType {
+    case CONTROL_POLL:
+        return "poll"
+    case CONTROL_TEST:
+        return "test"
+    case CONTROL_TERMINATE:
+        return "terminate"
+    case CONTROL_PING:
+        return "ping"
+    case CONTROL_REKEY:
+        return "rekey"
+    case CONTROL_ACK:
+        return "ack"
+    case CONTROL_UPGRADE:
+        return "upgrade"
+    }
+
+    return "unknown"
+}
+
+/* EOF */
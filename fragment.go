@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package websock
+
+import (
+    "sync"
+
+    "github.com/AlexRuzin/util"
+)
+
+/************************************************************
+ * Fragmentation and reassembly                             *
+ ************************************************************/
+
+/*
+ * No frame carries more than the negotiated MaxFrameSize bytes of payload (see
+ *  negotiate.go). A larger message, either a single Write() on the client, or the data
+ *  queued on a NetInstance, is split into fragments of at most MaxFrameSize bytes,
+ *  each sent in its own frame with FRAME_FLAG_FRAGMENT set, and so in its own request
+ *  or response. Every fragment of a message carries the same message ID, its offset
+ *  within the message, and the total length of the message.
+ *
+ * The fragments of a message are sent in order, one request or response at a time, so
+ *  the receiver appends each fragment to the message and refuses a fragment that does
+ *  not start where the previous one ended. The message is delivered once its last byte
+ *  has arrived. At most maxPartialMessages messages may be incomplete at once, and no
+ *  message may exceed MAX_MESSAGE_SIZE.
+ */
+const MAX_MESSAGE_SIZE          uint64 = 1 << 28
+
+const maxPartialMessages        = 16
+
+var (
+    ERROR_FRAME_TOO_LARGE       = util.RetErrStr("frame exceeds the negotiated maximum frame size")
+    ERROR_FRAGMENT_INVALID      = util.RetErrStr("fragment does not continue its message")
+)
+
+type partialMessage struct {
+    length                      uint64
+    data                        []byte
+}
+
+/* The zero value is ready for use */
+type reassembler struct {
+    lock                        sync.Mutex
+    partial                     map[uint32]*partialMessage
+}
+
+/* Splits the next fragment off of message, starting at offset */
+func nextFragment(message []byte, id uint32, offset int, maxFrameSize uint32) (fragment []byte,
+    header *fragmentHeader) {
+    var end = min(len(message), offset + int(maxFrameSize))
+    return message[offset:end], &fragmentHeader{
+        message:    id,
+        offset:     uint64(offset),
+        length:     uint64(len(message)),
+    }
+}
+
+/*
+ * Returns the whole message once the last fragment has arrived, or nil if more are
+ *  expected. data is the payload of the fragment after decompression. Any error
+ *  discards the partial message
+ */
+func (f *reassembler) add(header *fragmentHeader, data []byte) ([]byte, error) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    if f.partial == nil {
+        f.partial = make(map[uint32]*partialMessage)
+    }
+
+    message := f.partial[header.message]
+    if message == nil {
+        if header.offset != 0 || header.length > MAX_MESSAGE_SIZE || len(f.partial) >= maxPartialMessages {
+            return nil, ERROR_FRAGMENT_INVALID
+        }
+
+        message = &partialMessage{length: header.length}
+        f.partial[header.message] = message
+    }
+
+    if header.length != message.length || header.offset != uint64(len(message.data)) ||
+        header.offset + uint64(len(data)) > message.length {
+        delete(f.partial, header.message)
+        return nil, ERROR_FRAGMENT_INVALID
+    }
+
+    message.data = append(message.data, data...)
+    if uint64(len(message.data)) != message.length {
+        return nil, nil
+    }
+
+    delete(f.partial, header.message)
+    return message.data, nil
+}
+
+/* The payload limit applies to the frame as it was sent, before decompression */
+func checkFrameSize(decoded *frame, maxFrameSize uint32) error {
+    if uint64(len(decoded.payload)) > uint64(maxFrameSize) {
+        return ERROR_FRAME_TOO_LARGE
+    }
+
+    return nil
+}
+
+/* EOF */
@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package websock
+
+import (
+    "encoding/binary"
+
+    "github.com/AlexRuzin/util"
+)
+
+/************************************************************
+ * Frame format                                             *
+ ************************************************************/
+
+/*
+ * Every record carries a single frame, which is encoded by hand rather than by
+ *  encoding/gob, so that the wire format does not depend on Go type names:
+ *
+ *  [1 byte version][1 byte frame type][2 byte flags][8 byte sequence][4 byte length]
+ *  [fragment header, if FRAME_FLAG_FRAGMENT is set][payload]
+ *
+ * All integers are big endian. The length must account for every byte that follows
+ *  the header, and a receiver refuses a frame with an unknown version, type or flag.
+ *  FRAME_DATA carries application data, and FRAME_CONTROL a control message, which may
+ *  not be compressed or fragmented (see control.go).
+ *
+ *  FRAME_FLAG_TO_SERVER      Sent by the client. Exactly one direction flag is set
+ *  FRAME_FLAG_TO_CLIENT      Sent by the server
+ *  FRAME_FLAG_COMPRESSED     The payload is compressed
+ *  FRAME_FLAG_FRAGMENT       The payload is part of a larger message, see fragment.go
+ *
+ * The sequence number is that of the sending trafficState (see replayWindow). A
+ *  fragment header is [4 byte message ID][8 byte offset][8 byte message length], where
+ *  the offset and length count the bytes of the message before compression.
+ */
+const FRAME_VERSION             byte = 1
+
+const (
+    FRAME_DATA                  byte = iota + 1
+    FRAME_CONTROL
+)
+
+const (
+    FRAME_FLAG_TO_SERVER        uint16 = 1 << iota
+    FRAME_FLAG_TO_CLIENT
+    FRAME_FLAG_COMPRESSED
+    FRAME_FLAG_FRAGMENT
+)
+
+const (
+    frameHeaderSize             = 16
+    fragmentHeaderSize          = 20
+    frameKnownFlags             = FRAME_FLAG_TO_SERVER | FRAME_FLAG_TO_CLIENT | FRAME_FLAG_COMPRESSED |
+                                  FRAME_FLAG_FRAGMENT
+)
+
+var (
+    ERROR_FRAME_MALFORMED       = util.RetErrStr("frame is malformed")
+    ERROR_FRAME_VERSION         = util.RetErrStr("frame version is not supported")
+)
+
+type frame struct {
+    frameType                   byte
+    flags                       uint16
+    sequence                    uint64
+    fragment                    *fragmentHeader
+    payload                     []byte
+}
+
+type fragmentHeader struct {
+    message                     uint32
+    offset                      uint64
+    length                      uint64
+}
+
+/* FRAME_FLAG_FRAGMENT is set if, and only if, f.fragment is present */
+func encodeFrame(f *frame) ([]byte, error) {
+    var (
+        flags       = f.flags & ^FRAME_FLAG_FRAGMENT
+        length      = uint64(len(f.payload))
+    )
+    if f.fragment != nil {
+        flags |= FRAME_FLAG_FRAGMENT
+        length += fragmentHeaderSize
+    }
+    if length > 0xffffffff {
+        return nil, ERROR_FRAME_MALFORMED
+    }
+
+    var encoded = make([]byte, 0, frameHeaderSize + int(length))
+    encoded = append(encoded, FRAME_VERSION, f.frameType)
+    encoded = binary.BigEndian.AppendUint16(encoded, flags)
+    encoded = binary.BigEndian.AppendUint64(encoded, f.sequence)
+    encoded = binary.BigEndian.AppendUint32(encoded, uint32(length))
+    if f.fragment != nil {
+        encoded = binary.BigEndian.AppendUint32(encoded, f.fragment.message)
+        encoded = binary.BigEndian.AppendUint64(encoded, f.fragment.offset)
+        encoded = binary.BigEndian.AppendUint64(encoded, f.fragment.length)
+    }
+    return append(encoded, f.payload...), nil
+}
+
+/* The payload of the returned frame is a slice of raw */
+func decodeFrame(raw []byte) (*frame, error) {
+    if len(raw) < frameHeaderSize {
+        return nil, ERROR_FRAME_MALFORMED
+    }
+    if raw[0] != FRAME_VERSION {
+        return nil, ERROR_FRAME_VERSION
+    }
+
+    var decoded = &frame{
+        frameType:  raw[1],
+        flags:      binary.BigEndian.Uint16(raw[2:]),
+        sequence:   binary.BigEndian.Uint64(raw[4:]),
+    }
+    if (decoded.frameType != FRAME_DATA && decoded.frameType != FRAME_CONTROL) ||
+        (decoded.flags & ^uint16(frameKnownFlags)) != 0 {
+        return nil, ERROR_FRAME_MALFORMED
+    }
+    if decoded.frameType == FRAME_CONTROL && (decoded.flags & (FRAME_FLAG_COMPRESSED | FRAME_FLAG_FRAGMENT)) != 0 {
+        return nil, ERROR_FRAME_MALFORMED
+    }
+
+    var direction = decoded.flags & (FRAME_FLAG_TO_SERVER | FRAME_FLAG_TO_CLIENT)
+    if direction != FRAME_FLAG_TO_SERVER && direction != FRAME_FLAG_TO_CLIENT {
+        return nil, ERROR_FRAME_MALFORMED
+    }
+
+    if uint64(binary.BigEndian.Uint32(raw[12:])) != uint64(len(raw) - frameHeaderSize) {
+        return nil, ERROR_FRAME_MALFORMED
+    }
+    decoded.payload = raw[frameHeaderSize:]
+
+    if (decoded.flags & FRAME_FLAG_FRAGMENT) > 0 {
+        if len(decoded.payload) < fragmentHeaderSize {
+            return nil, ERROR_FRAME_MALFORMED
+        }
+        decoded.fragment = &fragmentHeader{
+            message:    binary.BigEndian.Uint32(decoded.payload),
+            offset:     binary.BigEndian.Uint64(decoded.payload[4:]),
+            length:     binary.BigEndian.Uint64(decoded.payload[12:]),
+        }
+        decoded.payload = decoded.payload[fragmentHeaderSize:]
+    }
+
+    return decoded, nil
+}
+
+/* Maps the FlagVal direction and compression flags of a transmission onto frame flags */
+func frameFlags(direction FlagVal, otherFlags FlagVal) (flags uint16) {
+    if (direction & FLAG_DIRECTION_TO_SERVER) > 0 {
+        flags |= FRAME_FLAG_TO_SERVER
+    }
+    if (direction & FLAG_DIRECTION_TO_CLIENT) > 0 {
+        flags |= FRAME_FLAG_TO_CLIENT
+    }
+    if (otherFlags & FLAG_COMPRESS) > 0 {
+        flags |= FRAME_FLAG_COMPRESSED
+    }
+
+    return
+}
+
+func (f *frame) compressed() bool {
+    return (f.flags & FRAME_FLAG_COMPRESSED) > 0
+}
+
+/* EOF */
@@ -0,0 +1,195 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package websock
+
+import (
+    "encoding/binary"
+
+    "github.com/AlexRuzin/util"
+)
+
+/************************************************************
+ * Handshake message framing                                *
+ ************************************************************/
+
+/*
+ * Both halves of the key exchange are built from handshake messages:
+ *
+ *  [1 byte version][1 byte message type][2 byte body length][body]
+ *
+ * The body is a sequence of fields, each [1 byte tag][2 byte length][value], and all
+ *  integers are big endian. A tag may appear at most once, and the body length must
+ *  account for every byte of the message. Fields with an unknown tag are skipped, so
+ *  that optional fields may be added without a new HANDSHAKE_VERSION.
+ *
+ *  HS_CLIENT_HELLO       HS_FIELD_CURVE, HS_FIELD_PUBLIC_KEY, [HS_FIELD_CLIENT_AUTH],
+ *                        [HS_FIELD_KEM_KEY], capabilities
+ *  HS_SERVER_HELLO       HS_FIELD_PUBLIC_KEY, HS_FIELD_SESSION_ID, [HS_FIELD_SERVER_IDENTITY],
+ *                        [HS_FIELD_KEM_CIPHERTEXT], capabilities
+ *  HS_SERVER_FINISHED    [HS_FIELD_TICKET], HS_FIELD_KEY_CONFIRMATION
+ *
+ * The capability fields are described in negotiate.go.
+ *
+ * The client sends HS_CLIENT_HELLO, and the server responds with HS_SERVER_HELLO
+ *  followed by HS_SERVER_FINISHED. The handshake transcript is computed over the exact
+ *  bytes of HS_CLIENT_HELLO and HS_SERVER_HELLO (see handshakeTranscript), and the key
+ *  confirmation also covers the ticket, so the client refuses a response in which any
+ *  byte was modified. A modified HS_CLIENT_HELLO leaves the server with different
+ *  traffic keys, so the first record sent by the client fails authentication.
+ */
+const HANDSHAKE_VERSION         byte = 1
+
+const (
+    HS_CLIENT_HELLO             byte = iota + 1
+    HS_SERVER_HELLO
+    HS_SERVER_FINISHED
+)
+
+const (
+    HS_FIELD_CURVE              byte = iota + 1
+    HS_FIELD_PUBLIC_KEY
+    HS_FIELD_CLIENT_AUTH
+    HS_FIELD_SESSION_ID
+    HS_FIELD_SERVER_IDENTITY
+    HS_FIELD_TICKET
+    HS_FIELD_KEY_CONFIRMATION
+    HS_FIELD_KEM_KEY
+    HS_FIELD_KEM_CIPHERTEXT
+    HS_FIELD_VERSIONS
+    HS_FIELD_CIPHER_SUITES
+    HS_FIELD_COMPRESSION
+    HS_FIELD_MAX_FRAME_SIZE
+)
+
+const (
+    handshakeHeaderSize         = 4
+    handshakeFieldHeaderSize    = 3
+    handshakeMaxLength          = 0xffff
+)
+
+var (
+    ERROR_HANDSHAKE_MALFORMED   = util.RetErrStr("handshake message is malformed")
+    ERROR_HANDSHAKE_VERSION     = util.RetErrStr("handshake version is not supported")
+)
+
+type handshakeField struct {
+    tag                         byte
+    value                       []byte
+}
+
+type handshakeMessage struct {
+    msgType                     byte
+    fields                      map[byte][]byte
+}
+
+/* Fields with a nil value are optional fields that are not present, and are omitted */
+func encodeHandshake(msgType byte, fields ...handshakeField) ([]byte, error) {
+    var body = make([]byte, 0, 256)
+    for _, field := range fields {
+        if field.value == nil {
+            continue
+        }
+        if len(field.value) > handshakeMaxLength {
+            return nil, ERROR_HANDSHAKE_MALFORMED
+        }
+
+        body = append(body, field.tag)
+        body = binary.BigEndian.AppendUint16(body, uint16(len(field.value)))
+        body = append(body, field.value...)
+    }
+    if len(body) > handshakeMaxLength {
+        return nil, ERROR_HANDSHAKE_MALFORMED
+    }
+
+    var message = make([]byte, 0, handshakeHeaderSize + len(body))
+    message = append(message, HANDSHAKE_VERSION, msgType)
+    message = binary.BigEndian.AppendUint16(message, uint16(len(body)))
+    return append(message, body...), nil
+}
+
+/*
+ * Parses the message at the start of raw, which must be of type msgType. length is
+ *  the number of bytes of raw consumed by the message
+ */
+func parseHandshake(raw []byte, msgType byte) (message *handshakeMessage, length int, err error) {
+    if len(raw) < handshakeHeaderSize {
+        return nil, 0, ERROR_HANDSHAKE_MALFORMED
+    }
+    if raw[0] != HANDSHAKE_VERSION {
+        return nil, 0, ERROR_HANDSHAKE_VERSION
+    }
+    if raw[1] != msgType {
+        return nil, 0, ERROR_HANDSHAKE_MALFORMED
+    }
+
+    length = handshakeHeaderSize + int(binary.BigEndian.Uint16(raw[2:]))
+    if len(raw) < length {
+        return nil, 0, ERROR_HANDSHAKE_MALFORMED
+    }
+
+    message = &handshakeMessage{
+        msgType:    msgType,
+        fields:     make(map[byte][]byte),
+    }
+    for body := raw[handshakeHeaderSize:length]; len(body) != 0; {
+        if len(body) < handshakeFieldHeaderSize {
+            return nil, 0, ERROR_HANDSHAKE_MALFORMED
+        }
+
+        var (
+            tag         = body[0]
+            fieldLen    = int(binary.BigEndian.Uint16(body[1:]))
+        )
+        if len(body) < handshakeFieldHeaderSize + fieldLen {
+            return nil, 0, ERROR_HANDSHAKE_MALFORMED
+        }
+        if _, exists := message.fields[tag]; exists {
+            return nil, 0, ERROR_HANDSHAKE_MALFORMED
+        }
+
+        var value = make([]byte, fieldLen)
+        copy(value, body[handshakeFieldHeaderSize:])
+        message.fields[tag] = value
+
+        body = body[handshakeFieldHeaderSize + fieldLen:]
+    }
+
+    return message, length, nil
+}
+
+/* A required field, of exactly size bytes. A size of -1 accepts any non-empty value */
+func (f *handshakeMessage) field(tag byte, size int) ([]byte, error) {
+    value, exists := f.fields[tag]
+    if !exists || len(value) == 0 || (size != -1 && len(value) != size) {
+        return nil, ERROR_HANDSHAKE_MALFORMED
+    }
+
+    return value, nil
+}
+
+/* An optional field, nil if it is not present */
+func (f *handshakeMessage) optional(tag byte) []byte {
+    return f.fields[tag]
+}
+
+/* EOF */
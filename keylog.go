@@ -0,0 +1,261 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package websock
+
+import (
+    "io"
+    "sort"
+    "sync"
+    "bufio"
+    "strings"
+    "encoding/hex"
+
+    "github.com/AlexRuzin/util"
+)
+
+/************************************************************
+ * Key log export and offline decryption                    *
+ ************************************************************/
+
+/*
+ * When a key log is configured (WithKeyLog or WithServiceKeyLog), the traffic keys of
+ *  every key exchange are appended to it as a single line, in the style of the NSS
+ *  key log format used by SSLKEYLOGFILE:
+ *
+ *  WEBSOCK_TRAFFIC_KEYS <ClientIdString> <hex c2s traffic key> <hex s2c traffic key>
+ *
+ * Keys of later epochs are derived from the logged keys (see nextTrafficKey), so one
+ *  line covers a circuit across every rekey. A resumed circuit logs another line under
+ *  the same ClientIdString. Anyone holding the key log can decrypt every record of the
+ *  logged circuits, so it must only be enabled for debugging.
+ */
+const KEYLOG_LABEL              = "WEBSOCK_TRAFFIC_KEYS"
+
+var (
+    ERROR_KEYLOG_MALFORMED      = util.RetErrStr("key log line is malformed")
+    ERROR_KEYLOG_NO_KEY         = util.RetErrStr("no key in the key log opens this record")
+    ERROR_KEYLOG_SUITE          = util.RetErrStr("record is not sealed with an AEAD suite, i.e. on a legacy RC4 circuit")
+)
+
+type keyLogWriter struct {
+    lock                        sync.Mutex
+    writer                      io.Writer
+}
+
+/* A nil keyLogWriter logs nothing */
+func (f *keyLogWriter) log(clientId string, keys *sessionKeys) {
+    if f == nil {
+        return
+    }
+
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    io.WriteString(f.writer, KEYLOG_LABEL + " " + clientId + " " + hex.EncodeToString(keys.clientToServer) +
+        " " + hex.EncodeToString(keys.serverToClient) + "\n")
+}
+
+/*
+ * The contents of a key log, used to decrypt captured records offline
+ *  (see cmd/websock-decrypt)
+ */
+type KeyLog struct {
+    lock                        sync.Mutex
+    sessions                    map[string][]*loggedKeys
+}
+
+/* The keys of one line of the key log */
+type loggedKeys struct {
+    keys                        *sessionKeys
+
+    /* Highest epoch a record was opened under, in each direction */
+    clientToServerEpoch         uint32
+    serverToClientEpoch         uint32
+}
+
+/* A decrypted frame */
+type DecryptedRecord struct {
+    ClientID                    string
+    FrameType                   byte
+    Flags                       uint16
+    Sequence                    uint64
+    Epoch                       uint32
+
+    /* Decompressed, if the frame was sent with FRAME_FLAG_COMPRESSED */
+    Data                        []byte
+}
+
+/* Blank lines, comments starting with '#' and lines with any other label are skipped */
+func ParseKeyLog(reader io.Reader) (*KeyLog, error) {
+    var keyLog = &KeyLog{
+        sessions:   make(map[string][]*loggedKeys),
+    }
+
+    scanner := bufio.NewScanner(reader)
+    for scanner.Scan() {
+        var fields = strings.Fields(scanner.Text())
+        if len(fields) == 0 || fields[0] != KEYLOG_LABEL {
+            continue
+        }
+        if len(fields) != 4 {
+            return nil, ERROR_KEYLOG_MALFORMED
+        }
+
+        clientToServer, err := hex.DecodeString(fields[2])
+        if err != nil || len(clientToServer) != trafficKeySize {
+            return nil, ERROR_KEYLOG_MALFORMED
+        }
+        serverToClient, err := hex.DecodeString(fields[3])
+        if err != nil || len(serverToClient) != trafficKeySize {
+            return nil, ERROR_KEYLOG_MALFORMED
+        }
+
+        keyLog.sessions[fields[1]] = append(keyLog.sessions[fields[1]], &loggedKeys{
+            keys:   &sessionKeys{
+                clientToServer: clientToServer,
+                serverToClient: serverToClient,
+            },
+        })
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+
+    return keyLog, nil
+}
+
+/* The ClientIdString of every logged circuit */
+func (f *KeyLog) Sessions() []string {
+    var sessions = make([]string, 0, len(f.sessions))
+    for clientId := range f.sessions {
+        sessions = append(sessions, clientId)
+    }
+    sort.Strings(sessions)
+
+    return sessions
+}
+
+/*
+ * Every request of a circuit carries b64(ClientIdString) as a POST parameter name.
+ *  Returns the ClientIdString if parameter names a logged circuit
+ */
+func (f *KeyLog) MatchParameter(parameter string) (clientId string, ok bool) {
+    decoded, err := util.B64D(parameter)
+    if err != nil {
+        return "", false
+    }
+
+    _, ok = f.sessions[string(decoded)]
+    return string(decoded), ok
+}
+
+/*
+ * Decrypts a b64 encoded record sent on circuit clientId, either in the POST body of a
+ *  request (toServer), or as the body of a response. Records of legacy RC4 circuits
+ *  carry no header, and are refused with ERROR_KEYLOG_SUITE.
+ *
+ * Like the receiver, the epoch in the record header is only trusted up to maxEpochSkip
+ *  epochs past the highest epoch a record of that direction was opened under, so
+ *  records must be decrypted in about the order they were captured. Records past it
+ *  are refused with ERROR_RECORD_EPOCH
+ */
+func (f *KeyLog) DecryptRecord(clientId string, b64Encoded string, toServer bool) (*DecryptedRecord, error) {
+    record, err := util.B64D(strings.TrimSpace(b64Encoded))
+    if err != nil {
+        return nil, err
+    }
+    epoch, err := recordEpoch(record)
+    if err != nil {
+        return nil, err
+    }
+    var suite = CipherSuite(record[0])
+    if suite != CIPHER_AES256_GCM && suite != CIPHER_CHACHA20_POLY1305 {
+        return nil, ERROR_KEYLOG_SUITE
+    }
+
+    var direction = FLAG_DIRECTION_TO_CLIENT
+    if toServer {
+        direction = FLAG_DIRECTION_TO_SERVER
+    }
+
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    var outOfRange = false
+    for _, logged := range f.sessions[clientId] {
+        var (
+            key         = logged.keys.serverToClient
+            highest     = &logged.serverToClientEpoch
+        )
+        if toServer {
+            key         = logged.keys.clientToServer
+            highest     = &logged.clientToServerEpoch
+        }
+        if epoch > *highest && epoch - *highest > maxEpochSkip {
+            outOfRange = true
+            continue
+        }
+
+        for i := uint32(0); i != epoch; i += 1 {
+            if key, err = nextTrafficKey(key); err != nil {
+                return nil, err
+            }
+        }
+
+        /* The key log does not record the negotiated suite, so the header is trusted */
+        plaintext, err := openRecord(record, key, suite, direction)
+        if err != nil {
+            continue
+        }
+        if epoch > *highest {
+            *highest = epoch
+        }
+
+        decoded, err := decodeFrame(plaintext)
+        if err != nil {
+            return nil, err
+        }
+        var data = decoded.payload
+        if decoded.compressed() {
+            if data, err = decompressAny(data, int(DEFAULT_MAX_FRAME_SIZE)); err != nil {
+                return nil, err
+            }
+        }
+
+        return &DecryptedRecord{
+            ClientID:   clientId,
+            FrameType:  decoded.frameType,
+            Flags:      decoded.flags,
+            Sequence:   decoded.sequence,
+            Epoch:      epoch,
+            Data:       data,
+        }, nil
+    }
+
+    if outOfRange {
+        return nil, ERROR_RECORD_EPOCH
+    }
+    return nil, ERROR_KEYLOG_NO_KEY
+}
+
+/* EOF */
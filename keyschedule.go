@@ -0,0 +1,307 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package websock
+
+import (
+    "sync"
+    "time"
+    "crypto/hkdf"
+    "crypto/hmac"
+    "crypto/sha256"
+
+    "github.com/AlexRuzin/util"
+)
+
+/*
+ * Key schedule. The ECDH shared secret is never used as a key directly:
+ *
+ *  transcript  = SHA-256(client hello || server hello)
+ *  PRK         = HKDF-Extract(SHA-256, salt = transcript, IKM = shared secret)
+ *  c2s         = HKDF-Expand(PRK, "websock c2s traffic", 32)
+ *  s2c         = HKDF-Expand(PRK, "websock s2c traffic", 32)
+ *  confirm     = HKDF-Expand(PRK, "websock key confirmation", 32)
+ *  resumption  = HKDF-Expand(PRK, "websock resumption", 32)
+ *
+ * The hellos are the exact HS_CLIENT_HELLO and HS_SERVER_HELLO messages sent on the
+ *  wire (prior to base64). The server follows its hello with HS_SERVER_FINISHED, which
+ *  carries HMAC-SHA256(confirm, transcript || ticket), and the client refuses the
+ *  circuit unless it derives the same tag. Since each direction has its own key, a
+ *  keystream or nonce is never shared between the client and the server. In hybrid
+ *  mode, the shared secret is the ECDH secret followed by the ML-KEM secret (see
+ *  clientKeyShare).
+ */
+const (
+    trafficKeySize              = 32
+    keyConfirmationSize         = sha256.Size
+)
+
+var ERROR_KEY_CONFIRMATION      = util.RetErrStr("key confirmation failed")
+
+type sessionKeys struct {
+    clientToServer              []byte
+    serverToClient              []byte
+    confirm                     []byte
+    resumption                  []byte
+}
+
+func handshakeTranscript(clientPool []byte, serverResponse []byte) []byte {
+    h := sha256.New()
+    h.Write(clientPool)
+    h.Write(serverResponse)
+    return h.Sum(nil)
+}
+
+func deriveSessionKeys(secret []byte, transcript []byte) (*sessionKeys, error) {
+    prk, err := hkdf.Extract(sha256.New, secret, transcript)
+    if err != nil {
+        return nil, err
+    }
+
+    var keys = &sessionKeys{}
+    for _, k := range []struct {
+        label       string
+        out         *[]byte
+    }{
+        {"websock c2s traffic",         &keys.clientToServer},
+        {"websock s2c traffic",         &keys.serverToClient},
+        {"websock key confirmation",    &keys.confirm},
+        {"websock resumption",          &keys.resumption},
+    } {
+        if *k.out, err = hkdf.Expand(sha256.New, prk, k.label, trafficKeySize); err != nil {
+            return nil, err
+        }
+    }
+
+    return keys, nil
+}
+
+/* The ticket is covered as well, since it is sent after the transcript, see handshake.go */
+func (f *sessionKeys) confirmation(transcript []byte, ticket []byte) []byte {
+    mac := hmac.New(sha256.New, f.confirm)
+    mac.Write(transcript)
+    mac.Write(ticket)
+    return mac.Sum(nil)
+}
+
+/*
+ * Rekeying. Each direction of a circuit has its own trafficState, whose key is ratcheted
+ *  forward by its sender once either limit in rekeyLimits is reached:
+ *
+ *  key[n+1]    = HKDF-Expand(key[n], "websock traffic update", 32)
+ *
+ * The epoch n is carried in the header of every record, so the first record sealed
+ *  under a new epoch is the in-band rekey message. The receiver ratchets when it opens
+ *  a record from a later epoch, and keeps the key of the previous epoch so that records
+ *  which were already in flight when the sender switched are not lost. Keys of older
+ *  epochs are discarded, which gives forward secrecy within a long-lived circuit.
+ *  NetChannelClient.Rekey() ratchets both directions at once, see CONTROL_REKEY.
+ */
+const (
+    DEFAULT_REKEY_BYTES         uint64 = 256 << 20
+    DEFAULT_REKEY_INTERVAL      = 1 * time.Hour
+
+    /* Number of epochs a receiver will ratchet forward in a single step */
+    maxEpochSkip                = 4
+)
+
+var ERROR_RECORD_EPOCH          = util.RetErrStr("record key epoch is out of range")
+
+type rekeyLimits struct {
+    bytes                       uint64
+    interval                    time.Duration
+}
+
+func defaultRekeyLimits() rekeyLimits {
+    return rekeyLimits{
+        bytes:      DEFAULT_REKEY_BYTES,
+        interval:   DEFAULT_REKEY_INTERVAL,
+    }
+}
+
+type trafficState struct {
+    lock                        sync.Mutex
+
+    key                         []byte
+    previous                    []byte
+    epoch                       uint32
+
+    /* Usage of the current key, only tracked by the sender */
+    sealed                      uint64
+    updated                     time.Time
+    limits                      rekeyLimits
+    rekeyPending                bool        /* Set by CONTROL_REKEY, see control.go */
+
+    /* The sender numbers each record, and the receiver rejects numbers it has already seen */
+    sequence                    uint64
+    window                      replayWindow
+
+    /* Counters for SessionStats */
+    records                     uint64
+    bytes                       uint64
+    replays                     uint64
+    rejected                    uint64
+}
+
+func newTrafficState(key []byte, limits rekeyLimits) *trafficState {
+    return &trafficState{
+        key:        key,
+        previous:   nil,
+        epoch:      0,
+        updated:    time.Now(),
+        limits:     limits,
+    }
+}
+
+func nextTrafficKey(key []byte) ([]byte, error) {
+    return hkdf.Expand(sha256.New, key, "websock traffic update", trafficKeySize)
+}
+
+/* Seals a record, ratcheting the key first if it has reached either rekey limit, or a rekey was requested */
+func (f *trafficState) seal(plaintext []byte, suite CipherSuite, direction FlagVal) ([]byte, error) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    if suite != CIPHER_LEGACY_RC4 && (f.rekeyPending || (f.limits.bytes != 0 && f.sealed >= f.limits.bytes) ||
+        (f.limits.interval != 0 && time.Since(f.updated) >= f.limits.interval)) {
+        next, err := nextTrafficKey(f.key)
+        if err != nil {
+            return nil, err
+        }
+
+        f.previous  = f.key
+        f.key       = next
+        f.epoch     += 1
+        f.sealed    = 0
+        f.updated   = time.Now()
+        f.rekeyPending = false
+    }
+
+    record, err := sealRecord(plaintext, f.key, f.epoch, suite, direction)
+    if err != nil {
+        return nil, err
+    }
+    f.sealed += uint64(len(plaintext))
+
+    return record, nil
+}
+
+/* The next record is sealed under a new epoch, regardless of the rekey limits */
+func (f *trafficState) requestRekey() {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    f.rekeyPending = true
+}
+
+/* Sequence number for the next frame, the first is 1 */
+func (f *trafficState) nextSequence() uint64 {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    f.sequence += 1
+    return f.sequence
+}
+
+/* Called once a record carrying length bytes of data has been sealed */
+func (f *trafficState) sent(length int) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    f.records += 1
+    f.bytes += uint64(length)
+}
+
+/* Called once a record has been opened and decoded, see replayWindow */
+func (f *trafficState) accept(sequence uint64, length int) error {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    if err := f.window.accept(sequence); err != nil {
+        f.replays += 1
+        return err
+    }
+    f.records += 1
+    f.bytes += uint64(length)
+
+    return nil
+}
+
+/* A record that could not be opened or decoded */
+func (f *trafficState) reject() {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    f.rejected += 1
+}
+
+/*
+ * Opens a record sealed under the current, previous or a later epoch. The switch to a
+ *  later epoch is only committed once a record from that epoch has authenticated
+ */
+func (f *trafficState) open(record []byte, suite CipherSuite, direction FlagVal) ([]byte, error) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+
+    if suite == CIPHER_LEGACY_RC4 {
+        return openRecord(record, f.key, suite, direction)
+    }
+
+    epoch, err := recordEpoch(record)
+    if err != nil {
+        return nil, err
+    }
+
+    switch {
+    case epoch == f.epoch:
+        return openRecord(record, f.key, suite, direction)
+
+    case epoch + 1 == f.epoch && f.previous != nil:
+        return openRecord(record, f.previous, suite, direction)
+
+    case epoch > f.epoch && epoch - f.epoch <= maxEpochSkip:
+        var (
+            previous    = f.key
+            next        = f.key
+        )
+        for i := f.epoch; i != epoch; i += 1 {
+            previous = next
+            if next, err = nextTrafficKey(next); err != nil {
+                return nil, err
+            }
+        }
+
+        plaintext, err := openRecord(record, next, suite, direction)
+        if err != nil {
+            return nil, err
+        }
+
+        f.previous  = previous
+        f.key       = next
+        f.epoch     = epoch
+        return plaintext, nil
+    }
+
+    return nil, ERROR_RECORD_EPOCH
+}
+
+/* EOF */
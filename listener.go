@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package websock
+
+import (
+    "net"
+
+    "github.com/AlexRuzin/util"
+)
+
+/************************************************************
+ * net.Listener support                                     *
+ ************************************************************/
+
+/*
+ * NetChannelService implements net.Listener. Every client that completes a full key
+ *  exchange is registered, and then queued until Accept() returns its NetInstance. A
+ *  resumed circuit reattaches to its existing NetInstance, and is not returned again.
+ *
+ * At most ACCEPT_BACKLOG clients wait for Accept(), beyond which the key exchange of a
+ *  new client is held until there is room in the queue. Close() shuts down the HTTP
+ *  server, and closes every client still waiting for Accept(). The NetInstances that
+ *  were already accepted belong to the caller, and are left for it to close.
+ *
+ * If IncomingHandler is set when the service is created, it is invoked for each
+ *  accepted client in turn, from a goroutine that calls Accept(). Otherwise it is up
+ *  to the caller to Accept() clients, i.e. by passing the service to code that serves
+ *  on a net.Listener.
+ */
+const ACCEPT_BACKLOG            = 16
+
+var ERROR_SERVICE_CLOSED        = util.RetErrStr("service is not accepting new clients")
+
+var _ net.Listener              = (*NetChannelService)(nil)
+
+/* Blocks until a new client has completed the key exchange. The net.Conn is a *NetInstance */
+func (f *NetChannelService) Accept() (net.Conn, error) {
+    if f.isClosed() {
+        return nil, net.ErrClosed
+    }
+
+    select {
+    case client := <-f.accepted:
+        client.connected.Store(true)
+        return client, nil
+    case <-f.done:
+        return nil, net.ErrClosed
+    }
+}
+
+/* Stops accepting new clients and the HTTP server. Returns net.ErrClosed if the service is already closed */
+func (f *NetChannelService) Close() error {
+    var err error = net.ErrClosed
+    f.closeOnce.Do(func() {
+        close(f.done)
+        f.drainAccepted()
+
+        /* Also closes the listener, and every connection that is not a WebSocket */
+        if f.httpServer != nil {
+            f.httpServer.Close()
+        }
+        err = nil
+    })
+
+    return err
+}
+
+/* The address the HTTP server is listening on */
+func (f *NetChannelService) Addr() net.Addr {
+    if f.listener == nil {
+        return &net.TCPAddr{}
+    }
+
+    return f.listener.Addr()
+}
+
+func (f *NetChannelService) isClosed() bool {
+    select {
+    case <-f.done:
+        return true
+    default:
+        return false
+    }
+}
+
+/* Queues a registered client for Accept(), the client is closed if the service closes first */
+func (f *NetChannelService) enqueueAccept(client *NetInstance) error {
+    if f.isClosed() {
+        f.closeClient(client)
+        return ERROR_SERVICE_CLOSED
+    }
+
+    select {
+    case f.accepted <- client:
+        /* Close() may have drained the queue just before the client was added */
+        if f.isClosed() {
+            f.drainAccepted()
+        }
+        return nil
+    case <-f.done:
+        f.closeClient(client)
+        return ERROR_SERVICE_CLOSED
+    }
+}
+
+/* Closes the clients that were queued, but never returned by Accept() */
+func (f *NetChannelService) drainAccepted() {
+    for {
+        select {
+        case client := <-f.accepted:
+            f.closeClient(client)
+        default:
+            return
+        }
+    }
+}
+
+/* A client is closed if IncomingHandler returns an error */
+func (f *NetChannelService) serveIncoming() {
+    for {
+        conn, err := f.Accept()
+        if err != nil {
+            return
+        }
+
+        client := conn.(*NetInstance)
+        if err := f.IncomingHandler(client, f); err != nil {
+            f.closeClient(client)
+        }
+    }
+}
+
+/* EOF */
@@ -0,0 +1,280 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package websock
+
+import (
+    "bytes"
+    "encoding/binary"
+
+    "github.com/AlexRuzin/util"
+)
+
+/************************************************************
+ * Protocol version and capability negotiation              *
+ ************************************************************/
+
+/*
+ * The client offers every protocol version, cipher suite and compression algorithm
+ *  it supports in HS_CLIENT_HELLO, each as a list of single byte identifiers in order
+ *  of preference, along with the largest frame it is willing to receive:
+ *
+ *  HS_FIELD_VERSIONS         [version]...
+ *  HS_FIELD_CIPHER_SUITES    [CipherSuite]...
+ *  HS_FIELD_COMPRESSION      [CompressionAlgorithm]...
+ *  HS_FIELD_MAX_FRAME_SIZE   [4 byte size]
+ *
+ * The server selects the highest version both sides support. Cipher suites and
+ *  compression algorithms have no order of their own, so the server's preference
+ *  decides: it selects the first one in its own list that the client offered, even
+ *  if the client listed another one first. The maximum frame size is the smaller of
+ *  both limits. The selection is returned in the same fields of HS_SERVER_HELLO, each
+ *  holding a single value, and the client refuses a selection that it did not offer.
+ *  Both hello messages are covered by the key confirmation, so an attacker cannot
+ *  downgrade the selection.
+ */
+const PROTOCOL_VERSION          byte = 1
+
+type CompressionAlgorithm uint8
+const (
+    COMPRESSION_NONE            CompressionAlgorithm = iota
+    COMPRESSION_GZIP
+    COMPRESSION_ZSTD
+    COMPRESSION_SNAPPY
+)
+
+const (
+    DEFAULT_MAX_FRAME_SIZE      uint32 = 1 << 20
+    MIN_FRAME_SIZE              uint32 = 1 << 10
+)
+
+var (
+    ERROR_NO_COMMON_VERSION     = util.RetErrStr("no mutually supported protocol version")
+    ERROR_NO_COMMON_SUITE       = util.RetErrStr("no mutually supported cipher suite")
+    ERROR_NO_COMMON_COMPRESSION = util.RetErrStr("no mutually supported compression algorithm")
+    ERROR_NEGOTIATION           = util.RetErrStr("server selected an option that was not offered")
+)
+
+/* The options negotiated for a circuit, see NetInstance.Negotiated and NetChannelClient.Negotiated */
+type Capabilities struct {
+    Version                     byte
+    CipherSuite                 CipherSuite
+    Compression                 CompressionAlgorithm
+    MaxFrameSize                uint32
+}
+
+/* The options supported by one side, in order of preference */
+type capabilitySet struct {
+    versions                    []byte
+    suites                      []byte
+    compression                 []byte
+    maxFrameSize                uint32
+}
+
+func (f CompressionAlgorithm) String() string {
+    switch f {
+    case COMPRESSION_NONE:
+        return "none"
+    case COMPRESSION_GZIP:
+        return "gzip"
+    case COMPRESSION_ZSTD:
+        return "zstd"
+    case COMPRESSION_SNAPPY:
+        return "snappy"
+    }
+
+    return "unknown"
+}
+
+/* The AEAD suites in order of preference, FLAG_CHACHA20_POLY1305 moves ChaCha20-Poly1305 first */
+func aeadSuites(flags FlagVal) []byte {
+    if (flags & FLAG_CHACHA20_POLY1305) > 0 {
+        return []byte{byte(CIPHER_CHACHA20_POLY1305), byte(CIPHER_AES256_GCM)}
+    }
+
+    return []byte{byte(CIPHER_AES256_GCM), byte(CIPHER_CHACHA20_POLY1305)}
+}
+
+/*
+ * The compression algorithms in order of preference, see compress.go. An explicit list
+ *  takes precedence over FLAG_COMPRESS, and COMPRESSION_NONE is offered last unless the
+ *  list already holds it, so that compression never prevents a circuit
+ */
+func compressionAlgorithms(flags FlagVal, preferred []CompressionAlgorithm) []byte {
+    if len(preferred) == 0 && (flags & FLAG_COMPRESS) > 0 {
+        preferred = defaultCompression
+    }
+
+    var algorithms = make([]byte, 0, len(preferred) + 1)
+    for _, algorithm := range preferred {
+        algorithms = append(algorithms, byte(algorithm))
+    }
+    if bytes.IndexByte(algorithms, byte(COMPRESSION_NONE)) == -1 {
+        algorithms = append(algorithms, byte(COMPRESSION_NONE))
+    }
+
+    return algorithms
+}
+
+/* A client with FLAG_LEGACY_RC4 offers nothing but the legacy suite */
+func clientCapabilities(flags FlagVal, maxFrameSize uint32, compression []CompressionAlgorithm) *capabilitySet {
+    var suites = aeadSuites(flags)
+    if (flags & FLAG_LEGACY_RC4) > 0 {
+        suites = []byte{byte(CIPHER_LEGACY_RC4)}
+    }
+
+    return &capabilitySet{
+        versions:       []byte{PROTOCOL_VERSION},
+        suites:         suites,
+        compression:    compressionAlgorithms(flags, compression),
+        maxFrameSize:   maxFrameSize,
+    }
+}
+
+/* A server with FLAG_LEGACY_RC4 accepts the legacy suite from clients that offer nothing else */
+func serviceCapabilities(flags FlagVal, maxFrameSize uint32, compression []CompressionAlgorithm) *capabilitySet {
+    var suites = aeadSuites(flags)
+    if (flags & FLAG_LEGACY_RC4) > 0 {
+        suites = append(suites, byte(CIPHER_LEGACY_RC4))
+    }
+
+    return &capabilitySet{
+        versions:       []byte{PROTOCOL_VERSION},
+        suites:         suites,
+        compression:    compressionAlgorithms(flags, compression),
+        maxFrameSize:   maxFrameSize,
+    }
+}
+
+func (f *capabilitySet) fields() []handshakeField {
+    return []handshakeField{
+        {HS_FIELD_VERSIONS, f.versions},
+        {HS_FIELD_CIPHER_SUITES, f.suites},
+        {HS_FIELD_COMPRESSION, f.compression},
+        {HS_FIELD_MAX_FRAME_SIZE, binary.BigEndian.AppendUint32(nil, f.maxFrameSize)},
+    }
+}
+
+/* Reads the capabilities offered in HS_CLIENT_HELLO */
+func parseCapabilities(hello *handshakeMessage) (*capabilitySet, error) {
+    var offered = &capabilitySet{}
+    var err error
+    if offered.versions, err = hello.field(HS_FIELD_VERSIONS, -1); err != nil {
+        return nil, err
+    }
+    if offered.suites, err = hello.field(HS_FIELD_CIPHER_SUITES, -1); err != nil {
+        return nil, err
+    }
+    if offered.compression, err = hello.field(HS_FIELD_COMPRESSION, -1); err != nil {
+        return nil, err
+    }
+    maxFrameSize, err := hello.field(HS_FIELD_MAX_FRAME_SIZE, 4)
+    if err != nil {
+        return nil, err
+    }
+    if offered.maxFrameSize = binary.BigEndian.Uint32(maxFrameSize); offered.maxFrameSize < MIN_FRAME_SIZE {
+        return nil, ERROR_HANDSHAKE_MALFORMED
+    }
+
+    return offered, nil
+}
+
+/* Called on the server, f holds its own capabilities */
+func (f *capabilitySet) negotiate(offered *capabilitySet) (*Capabilities, error) {
+    var selected = &Capabilities{
+        MaxFrameSize:   min(f.maxFrameSize, offered.maxFrameSize),
+    }
+
+    var found = false
+    for _, version := range f.versions {
+        if bytes.IndexByte(offered.versions, version) != -1 && (!found || version > selected.Version) {
+            selected.Version, found = version, true
+        }
+    }
+    if !found {
+        return nil, ERROR_NO_COMMON_VERSION
+    }
+
+    suite, found := firstCommon(f.suites, offered.suites)
+    if !found {
+        return nil, ERROR_NO_COMMON_SUITE
+    }
+    selected.CipherSuite = CipherSuite(suite)
+
+    compression, found := firstCommon(f.compression, offered.compression)
+    if !found {
+        return nil, ERROR_NO_COMMON_COMPRESSION
+    }
+    selected.Compression = CompressionAlgorithm(compression)
+
+    return selected, nil
+}
+
+func firstCommon(preferred []byte, offered []byte) (byte, bool) {
+    for _, value := range preferred {
+        if bytes.IndexByte(offered, value) != -1 {
+            return value, true
+        }
+    }
+
+    return 0, false
+}
+
+/* The fields of HS_SERVER_HELLO that carry the selection */
+func (f *Capabilities) fields() []handshakeField {
+    var selected = &capabilitySet{
+        versions:       []byte{f.Version},
+        suites:         []byte{byte(f.CipherSuite)},
+        compression:    []byte{byte(f.Compression)},
+        maxFrameSize:   f.MaxFrameSize,
+    }
+
+    return selected.fields()
+}
+
+/* Called on the client, f holds the capabilities that were offered */
+func (f *capabilitySet) accept(hello *handshakeMessage) (*Capabilities, error) {
+    selection, err := parseCapabilities(hello)
+    if err != nil {
+        return nil, err
+    }
+    if len(selection.versions) != 1 || len(selection.suites) != 1 || len(selection.compression) != 1 {
+        return nil, ERROR_NEGOTIATION
+    }
+
+    var selected = &Capabilities{
+        Version:        selection.versions[0],
+        CipherSuite:    CipherSuite(selection.suites[0]),
+        Compression:    CompressionAlgorithm(selection.compression[0]),
+        MaxFrameSize:   selection.maxFrameSize,
+    }
+    if bytes.IndexByte(f.versions, selected.Version) == -1 ||
+        bytes.IndexByte(f.suites, byte(selected.CipherSuite)) == -1 ||
+        bytes.IndexByte(f.compression, byte(selected.Compression)) == -1 ||
+        selected.MaxFrameSize > f.maxFrameSize {
+        return nil, ERROR_NEGOTIATION
+    }
+
+    return selected, nil
+}
+
+/* EOF */
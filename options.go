@@ -0,0 +1,422 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package websock
+
+import (
+    "io"
+    "time"
+    "strings"
+    "net/url"
+    "crypto/tls"
+    "crypto/sha256"
+    "crypto/ed25519"
+    "encoding/hex"
+
+    "github.com/AlexRuzin/util"
+)
+
+/************************************************************
+ * Optional settings for BuildChannel() and CreateServer()  *
+ ************************************************************/
+
+/*
+ * Options are passed as trailing arguments to BuildChannel() and CreateServer(),
+ *  and are applied before any connection is made. Settings that are a simple
+ *  switch remain in FlagVal
+ */
+type ChannelOption func(client *NetChannelClient) error
+type ServiceOption func(server *NetChannelService) error
+
+/* The curve used by the client for the ECDH exchange. CURVE_P384 is the default */
+func WithCurve(curve CurveID) ChannelOption {
+    return func(client *NetChannelClient) error {
+        if curve.ecdhCurve() == nil {
+            return util.RetErrStr("WithCurve: unsupported curve")
+        }
+
+        client.curve = curve
+        return nil
+    }
+}
+
+/*
+ * The curves the server will negotiate with. A client advertising any other curve
+ *  is refused with ERROR_CURVE_NOT_ALLOWED. All supported curves are permitted by
+ *  default
+ */
+func WithAllowedCurves(curves ...CurveID) ServiceOption {
+    return func(server *NetChannelService) error {
+        if len(curves) == 0 {
+            return util.RetErrStr("WithAllowedCurves: at least one curve is required")
+        }
+
+        server.allowedCurves = make(map[CurveID]bool)
+        for _, curve := range curves {
+            if curve.ecdhCurve() == nil {
+                return util.RetErrStr("WithAllowedCurves: unsupported curve")
+            }
+            server.allowedCurves[curve] = true
+        }
+
+        return nil
+    }
+}
+
+/*
+ * Pins the long-term key of the server. InitializeCircuit() fails with
+ *  ERROR_SERVER_AUTH unless the key exchange is signed by this key
+ */
+func WithPinnedServerKey(key ed25519.PublicKey) ChannelOption {
+    return func(client *NetChannelClient) error {
+        if len(key) != ed25519.PublicKeySize {
+            return util.RetErrStr("WithPinnedServerKey: invalid ed25519 public key")
+        }
+
+        client.serverKey = key
+        return nil
+    }
+}
+
+/* As WithPinnedServerKey, but pins the KeyFingerprint() of the server key */
+func WithServerFingerprint(fingerprint string) ChannelOption {
+    return func(client *NetChannelClient) error {
+        if decoded, err := hex.DecodeString(fingerprint); err != nil || len(decoded) != sha256.Size {
+            return util.RetErrStr("WithServerFingerprint: fingerprint must be a hex encoded SHA-256 sum")
+        }
+
+        client.serverFingerprint = fingerprint
+        return nil
+    }
+}
+
+/*
+ * The TLS settings used for an https gate URI, i.e. RootCAs for a private CA, or a
+ *  client certificate. The config is cloned, see tls.go
+ */
+func WithTLSConfig(config *tls.Config) ChannelOption {
+    return func(client *NetChannelClient) error {
+        if config == nil {
+            return util.RetErrStr("WithTLSConfig: config is nil")
+        }
+
+        client.tlsConfig = config.Clone()
+        return nil
+    }
+}
+
+/*
+ * Requires the TLS certificate chain of the server to carry one of the public keys with
+ *  the given SPKIFingerprint(). The connection fails with ERROR_SPKI_MISMATCH otherwise
+ */
+func WithPinnedSPKI(fingerprints ...string) ChannelOption {
+    return func(client *NetChannelClient) error {
+        if len(fingerprints) == 0 {
+            return util.RetErrStr("WithPinnedSPKI: no fingerprint given")
+        }
+        for _, fingerprint := range fingerprints {
+            if decoded, err := hex.DecodeString(fingerprint); err != nil || len(decoded) != sha256.Size {
+                return util.RetErrStr("WithPinnedSPKI: fingerprint must be a hex encoded SHA-256 sum")
+            }
+            client.pinnedSPKI = append(client.pinnedSPKI, strings.ToLower(fingerprint))
+        }
+
+        return nil
+    }
+}
+
+/*
+ * Reaches the gate through the given proxy, rather than the one named by the environment.
+ *  The URI uses the http, https or socks5 scheme, and may carry credentials, see proxy.go
+ */
+func WithProxy(proxyURI string) ChannelOption {
+    return func(client *NetChannelClient) error {
+        proxyURL, err := url.Parse(proxyURI)
+        if err != nil || proxyURL.Host == "" {
+            return util.RetErrStr("WithProxy: invalid proxy URI")
+        }
+        if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" && proxyURL.Scheme != "socks5" {
+            return util.RetErrStr("WithProxy: proxy URI must use the http, https or socks5 scheme")
+        }
+
+        client.proxyURL = proxyURL
+        return nil
+    }
+}
+
+/* The Basic credentials sent to the proxy, whether it is named by WithProxy or the environment */
+func WithProxyAuth(username string, password string) ChannelOption {
+    return func(client *NetChannelClient) error {
+        if username == "" {
+            return util.RetErrStr("WithProxyAuth: username is empty")
+        }
+
+        client.proxyAuth = url.UserPassword(username, password)
+        return nil
+    }
+}
+
+/*
+ * The longest the server may hold a poll before answering it, so that a proxy does not
+ *  time it out. PROXY_POLL_TIMEOUT by default if the gate is reached through a proxy
+ */
+func WithPollTimeout(timeout time.Duration) ChannelOption {
+    return func(client *NetChannelClient) error {
+        if timeout < time.Second {
+            return util.RetErrStr("WithPollTimeout: timeout must be at least one second")
+        }
+
+        client.pollTimeout = timeout
+        return nil
+    }
+}
+
+/* The long-term key the server uses to sign each key exchange */
+func WithSigningKey(key ed25519.PrivateKey) ServiceOption {
+    return func(server *NetChannelService) error {
+        if len(key) != ed25519.PrivateKeySize {
+            return util.RetErrStr("WithSigningKey: invalid ed25519 private key")
+        }
+
+        server.signingKey = key
+        return nil
+    }
+}
+
+/* Authenticate the client with a long-term key, see ClientIdentity.PublicKey */
+func WithClientKey(key ed25519.PrivateKey) ChannelOption {
+    return func(client *NetChannelClient) error {
+        if len(key) != ed25519.PrivateKeySize {
+            return util.RetErrStr("WithClientKey: invalid ed25519 private key")
+        }
+
+        client.clientKey = key
+        return nil
+    }
+}
+
+/* Authenticate the client with a pre-shared key, see ClientIdentity.KeyID */
+func WithPreSharedKey(id string, key []byte) ChannelOption {
+    return func(client *NetChannelClient) error {
+        if len(id) == 0 || len(id) > 255 || len(key) == 0 {
+            return util.RetErrStr("WithPreSharedKey: invalid key ID or key")
+        }
+
+        client.pskId = id
+        client.psk = key
+        return nil
+    }
+}
+
+/*
+ * Every new client is passed to the authorizer before a NetInstance is created.
+ *  Without an authorizer, any client is accepted, although credentials that are
+ *  presented must still verify
+ */
+func WithAuthorizer(authorizer ClientAuthorizer) ServiceOption {
+    return func(server *NetChannelService) error {
+        server.authorizer = authorizer
+        return nil
+    }
+}
+
+/* The pre-shared keys accepted by the server, indexed by key ID */
+func WithPreSharedKeys(keys map[string][]byte) ServiceOption {
+    return func(server *NetChannelService) error {
+        server.preSharedKeys = make(map[string][]byte)
+        for id, key := range keys {
+            if len(id) == 0 || len(id) > 255 || len(key) == 0 {
+                return util.RetErrStr("WithPreSharedKeys: invalid key ID or key")
+            }
+            server.preSharedKeys[id] = key
+        }
+
+        return nil
+    }
+}
+
+/*
+ * Ratchet the client to server traffic key once it has sealed maxBytes, or once
+ *  interval has passed. A zero value disables that limit. The defaults are
+ *  DEFAULT_REKEY_BYTES and DEFAULT_REKEY_INTERVAL
+ */
+func WithRekeyLimits(maxBytes uint64, interval time.Duration) ChannelOption {
+    return func(client *NetChannelClient) error {
+        client.rekeyLimits = rekeyLimits{
+            bytes:      maxBytes,
+            interval:   interval,
+        }
+        return nil
+    }
+}
+
+/* As WithRekeyLimits, for the server to client traffic key of every NetInstance */
+func WithInstanceRekeyLimits(maxBytes uint64, interval time.Duration) ServiceOption {
+    return func(server *NetChannelService) error {
+        server.rekeyLimits = rekeyLimits{
+            bytes:      maxBytes,
+            interval:   interval,
+        }
+        return nil
+    }
+}
+
+/*
+ * The largest frame the client is willing to receive, offered in the key exchange.
+ *  DEFAULT_MAX_FRAME_SIZE by default, and at least MIN_FRAME_SIZE
+ */
+func WithMaxFrameSize(size uint32) ChannelOption {
+    return func(client *NetChannelClient) error {
+        if size < MIN_FRAME_SIZE {
+            return util.RetErrStr("WithMaxFrameSize: size is below MIN_FRAME_SIZE")
+        }
+
+        client.maxFrameSize = size
+        return nil
+    }
+}
+
+/* As WithMaxFrameSize, for every NetInstance created by the server */
+func WithInstanceMaxFrameSize(size uint32) ServiceOption {
+    return func(server *NetChannelService) error {
+        if size < MIN_FRAME_SIZE {
+            return util.RetErrStr("WithInstanceMaxFrameSize: size is below MIN_FRAME_SIZE")
+        }
+
+        server.maxFrameSize = size
+        return nil
+    }
+}
+
+/*
+ * The compression algorithms offered by the client, in order of preference. This
+ *  takes precedence over FLAG_COMPRESS, which offers zstd, snappy and gzip. The
+ *  server may always select COMPRESSION_NONE
+ */
+func WithCompression(algorithms ...CompressionAlgorithm) ChannelOption {
+    return func(client *NetChannelClient) error {
+        if err := checkCompression(algorithms); err != nil {
+            return util.RetErrStr("WithCompression: " + err.Error())
+        }
+
+        client.compression = algorithms
+        return nil
+    }
+}
+
+/* As WithCompression, the server selects the first algorithm in this list that the client offers */
+func WithServiceCompression(algorithms ...CompressionAlgorithm) ServiceOption {
+    return func(server *NetChannelService) error {
+        if err := checkCompression(algorithms); err != nil {
+            return util.RetErrStr("WithServiceCompression: " + err.Error())
+        }
+
+        server.compression = algorithms
+        return nil
+    }
+}
+
+func checkCompression(algorithms []CompressionAlgorithm) error {
+    if len(algorithms) == 0 {
+        return util.RetErrStr("no algorithm given")
+    }
+    for _, algorithm := range algorithms {
+        if algorithm > COMPRESSION_SNAPPY {
+            return util.RetErrStr("unsupported algorithm")
+        }
+    }
+
+    return nil
+}
+
+/* Serves TLS with the certificate and key in the given PEM files, as http.ListenAndServeTLS */
+func WithServiceTLS(certFile string, keyFile string) ServiceOption {
+    return func(server *NetChannelService) error {
+        cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+        if err != nil {
+            return util.RetErrStr("WithServiceTLS: " + err.Error())
+        }
+
+        if server.tlsConfig == nil {
+            server.tlsConfig = &tls.Config{}
+        }
+        server.tlsConfig.Certificates = append(server.tlsConfig.Certificates, cert)
+        return nil
+    }
+}
+
+/* Serves TLS with the given config, which must hold a certificate. The config is cloned */
+func WithServiceTLSConfig(config *tls.Config) ServiceOption {
+    return func(server *NetChannelService) error {
+        if config == nil || (len(config.Certificates) == 0 && config.GetCertificate == nil) {
+            return util.RetErrStr("WithServiceTLSConfig: config holds no certificate")
+        }
+
+        var certificates []tls.Certificate
+        if server.tlsConfig != nil {
+            certificates = server.tlsConfig.Certificates
+        }
+        server.tlsConfig = config.Clone()
+        server.tlsConfig.Certificates = append(server.tlsConfig.Certificates, certificates...)
+        return nil
+    }
+}
+
+/*
+ * How long a resumption ticket remains valid, DEFAULT_TICKET_LIFETIME by default.
+ *  A zero lifetime disables resumption, so that every reconnect creates a new NetInstance
+ */
+func WithTicketLifetime(lifetime time.Duration) ServiceOption {
+    return func(server *NetChannelService) error {
+        server.ticketLifetime = lifetime
+        return nil
+    }
+}
+
+/*
+ * Appends the traffic keys of every key exchange made by the client to writer,
+ *  see KEYLOG_LABEL. For debugging only
+ */
+func WithKeyLog(writer io.Writer) ChannelOption {
+    return func(client *NetChannelClient) error {
+        if writer == nil {
+            return util.RetErrStr("WithKeyLog: writer is nil")
+        }
+
+        client.keyLog = &keyLogWriter{writer: writer}
+        return nil
+    }
+}
+
+/* As WithKeyLog, for every NetInstance created by the server */
+func WithServiceKeyLog(writer io.Writer) ServiceOption {
+    return func(server *NetChannelService) error {
+        if writer == nil {
+            return util.RetErrStr("WithServiceKeyLog: writer is nil")
+        }
+
+        server.keyLog = &keyLogWriter{writer: writer}
+        return nil
+    }
+}
+
+/* EOF */
@@ -23,95 +23,231 @@
 package websock
 
 import (
-    "time"
     "bytes"
     "strings"
-    "crypto"
     "crypto/md5"
+    "crypto/hmac"
     "crypto/rand"
-    "crypto/elliptic"
+    "crypto/ecdh"
+    "crypto/mlkem"
+    "crypto/sha256"
+    "crypto/ed25519"
     "encoding/hex"
-    "encoding/gob"
-    "hash/crc64"
-    "net/http"
 
-    "github.com/wsddn/go-ecdh"
-
-    "github.com/AlexRuzin/cryptog"
     "github.com/AlexRuzin/util"
 )
 
-func encryptData(data []byte, secret []byte, directionFlags FlagVal, otherFlags FlagVal,
-    clientId string) (encrypted []byte, err error) {
+/*
+ * Curves available for the key exchange. The client advertises its curve in the
+ *  HS_FIELD_CURVE field of its hello, and the server only accepts curves that are
+ *  part of its allow-list (see WithAllowedCurves)
+ */
+type CurveID uint8
+const (
+    CURVE_P256                  CurveID = iota + 1
+    CURVE_P384
+    CURVE_P521
+    CURVE_X25519
+)
 
-    if len(data) == 0 {
-        return nil, util.RetErrStr("Invalid parameters for encryptData")
+var ERROR_CURVE_NOT_ALLOWED     = util.RetErrStr("curve is not permitted by the server policy")
+
+func (f CurveID) ecdhCurve() ecdh.Curve {
+    switch f {
+    case CURVE_P256:
+        return ecdh.P256()
+    case CURVE_P384:
+        return ecdh.P384()
+    case CURVE_P521:
+        return ecdh.P521()
+    case CURVE_X25519:
+        return ecdh.X25519()
     }
-    err = util.RetErrStr("encryptData: Unknown error")
-
-    /* Transmission object */
-    tx := &transferUnit{
-        ClientID:           clientId,
-        TimeStamp: func () string {
-            return time.Now().String()
-        } (),
-        Data: make([]byte, len(data)),
-        DecryptedSum: func (p []byte) string {
-            dataSum := md5.Sum(data)
-            return hex.EncodeToString(dataSum[:])
-        } (data),
-        Direction:          directionFlags,
-        Flags:              otherFlags,
-    }
-    copy(tx.Data, data)
-
-    txStream, err := func(tx transferUnit) ([]byte, error) {
-        b := new(bytes.Buffer)
-        e := gob.NewEncoder(b)
-        if err := e.Encode(tx); err != nil {
-            return nil, err
-        }
-        return b.Bytes(), nil
-    } (*tx)
+
+    return nil
+}
+
+/* Length of an encoded public key on this curve, 0 if unknown */
+func (f CurveID) publicKeySize() int {
+    switch f {
+    case CURVE_P256:
+        return 65
+    case CURVE_P384:
+        return 97
+    case CURVE_P521:
+        return 133
+    case CURVE_X25519:
+        return 32
+    }
+
+    return 0
+}
+
+func (f CurveID) String() string {
+    switch f {
+    case CURVE_P256:
+        return "P-256"
+    case CURVE_P384:
+        return "P-384"
+    case CURVE_P521:
+        return "P-521"
+    case CURVE_X25519:
+        return "X25519"
+    }
+
+    return "unknown"
+}
+
+/* Default server policy -- every supported curve */
+func defaultAllowedCurves() map[CurveID]bool {
+    return map[CurveID]bool{
+        CURVE_P256:     true,
+        CURVE_P384:     true,
+        CURVE_P521:     true,
+        CURVE_X25519:   true,
+    }
+}
+
+/*
+ * Hybrid key exchange. A client with FLAG_HYBRID_MLKEM sends an ML-KEM-768
+ *  encapsulation key in HS_FIELD_KEM_KEY, next to its ECDH public key. A server with
+ *  FLAG_HYBRID_MLKEM encapsulates to it and returns the ciphertext in
+ *  HS_FIELD_KEM_CIPHERTEXT, and both sides then derive the session keys from
+ *
+ *  secret      = ECDH shared secret || ML-KEM shared secret
+ *
+ * so the session keys remain confidential unless both ECDH and ML-KEM are broken.
+ *  A server without the flag ignores the encapsulation key and completes a classical
+ *  exchange, which the client accepts. Stripping either KEM field in transit alters
+ *  the handshake transcript, and so fails the key confirmation.
+ */
+type clientKeyShare struct {
+    ecdh                        *ecdh.PrivateKey
+
+    /* nil unless FLAG_HYBRID_MLKEM is set */
+    kem                         *mlkem.DecapsulationKey768
+}
+
+var ERROR_KEM_UNEXPECTED        = util.RetErrStr("server returned an ML-KEM ciphertext that was not requested")
+
+/* Returns the ML-KEM shared secret, and the ciphertext for the client */
+func encapsulateKEM(encapsulationKey []byte) (secret []byte, ciphertext []byte, err error) {
+    key, err := mlkem.NewEncapsulationKey768(encapsulationKey)
     if err != nil {
-        return nil, err
+        return nil, nil, err
     }
 
-    output, err := cryptog.RC4_Encrypt(txStream, cryptog.RC4_PrepareKey(secret))
+    secret, ciphertext = key.Encapsulate()
+    return secret, ciphertext, nil
+}
+
+/*
+ * Server identity. A server configured with WithSigningKey sends an identity block
+ *  in the HS_FIELD_SERVER_IDENTITY field of its hello:
+ *
+ *  [32 byte ed25519 public key][64 byte signature over serverSignatureTranscript()]
+ *
+ * The signature covers both ephemeral public keys and the client ID, so the response
+ *  cannot be replayed into, or spliced across, another key exchange. Clients that
+ *  pin the server key (WithPinnedServerKey or WithServerFingerprint) refuse any
+ *  response without a valid signature from the pinned key
+ */
+const serverIdentitySize        = ed25519.PublicKeySize + ed25519.SignatureSize
+
+var ERROR_SERVER_AUTH           = util.RetErrStr("server identity could not be verified")
+
+/* Hex encoded SHA-256 of a long-term public key, suitable for pinning */
+func KeyFingerprint(key ed25519.PublicKey) string {
+    sum := sha256.Sum256(key)
+    return hex.EncodeToString(sum[:])
+}
+
+func serverSignatureTranscript(curve CurveID, clientPublic []byte, serverPublic []byte, clientId []byte) []byte {
+    var transcript = bytes.Buffer{}
+    transcript.WriteString("websock server signature")
+    transcript.WriteByte(byte(curve))
+    transcript.Write(clientPublic)
+    transcript.Write(serverPublic)
+    transcript.Write(clientId)
+    return transcript.Bytes()
+}
+
+func signServerIdentity(key ed25519.PrivateKey, transcript []byte) []byte {
+    var identity = make([]byte, 0, serverIdentitySize)
+    identity = append(identity, key.Public().(ed25519.PublicKey)...)
+    return append(identity, ed25519.Sign(key, transcript)...)
+}
+
+func (f *NetChannelClient) verifyServerIdentity(identity []byte, transcript []byte) error {
+    if f.serverKey == nil && f.serverFingerprint == "" {
+        /* No pin configured -- the identity block, if any, is ignored */
+        return nil
+    }
+
+    if len(identity) != serverIdentitySize {
+        return ERROR_SERVER_AUTH
+    }
+    var (
+        serverKey = ed25519.PublicKey(identity[:ed25519.PublicKeySize])
+        signature = identity[ed25519.PublicKeySize:]
+    )
+
+    if f.serverKey != nil && !bytes.Equal(serverKey, f.serverKey) {
+        return ERROR_SERVER_AUTH
+    }
+    if f.serverFingerprint != "" && !strings.EqualFold(KeyFingerprint(serverKey), f.serverFingerprint) {
+        return ERROR_SERVER_AUTH
+    }
+
+    if !ed25519.Verify(serverKey, transcript, signature) {
+        return ERROR_SERVER_AUTH
+    }
+
+    return nil
+}
+
+func encryptData(data []byte, key *trafficState, suite CipherSuite, directionFlags FlagVal,
+    otherFlags FlagVal) (encrypted []byte, err error) {
+    return encryptFragment(data, nil, key, suite, directionFlags, otherFlags)
+}
+
+/* As encryptData, for one fragment of a larger message if fragment is not nil */
+func encryptFragment(data []byte, fragment *fragmentHeader, key *trafficState, suite CipherSuite,
+    directionFlags FlagVal, otherFlags FlagVal) (encrypted []byte, err error) {
+
+    if len(data) == 0 {
+        return nil, util.RetErrStr("Invalid parameters for encryptData")
+    }
+
+    return sealFrame(&frame{
+        frameType:  FRAME_DATA,
+        flags:      frameFlags(directionFlags, otherFlags),
+        fragment:   fragment,
+        payload:    data,
+    }, key, suite, directionFlags)
+}
+
+/* Numbers, encodes and seals a frame of any type */
+func sealFrame(f *frame, key *trafficState, suite CipherSuite, directionFlags FlagVal) ([]byte, error) {
+    f.sequence = key.nextSequence()
+    encoded, err := encodeFrame(f)
     if err != nil {
         return nil, err
     }
-    encrypted = output
-    err = nil
 
-    return
-}
+    /* Legacy RC4 records carry no authentication tag, so the MD5 sum of the frame is appended */
+    if suite == CIPHER_LEGACY_RC4 {
+        frameSum := md5.Sum(encoded)
+        encoded = append(encoded, frameSum[:]...)
+    }
 
-func (f *NetChannelClient) genTxPool(pubKeyMarshalled []byte) ([]byte, error) {
-    /***********************************************************************************************
-     * Transmits the public key ECDH key to server. The transmission buffer contains:              *
-     *  b64([8 bytes XOR key][XOR-SHIFT encrypted marshalled public ECDH key][md5sum of first 2])  *
-     ***********************************************************************************************/
-    var pool = bytes.Buffer{}
-    xorKey := make([]byte, crc64.Size)
-    rand.Read(xorKey)
-    pool.Write(xorKey)
-    marshalEncrypted := make([]byte, len(pubKeyMarshalled))
-    copy(marshalEncrypted, pubKeyMarshalled)
-    counter := 0
-    for k := range marshalEncrypted {
-        if counter == len(xorKey) {
-            counter = 0
-        }
-        marshalEncrypted[k] ^= xorKey[counter]
-        counter += 1
+    output, err := key.seal(encoded, suite, directionFlags)
+    if err != nil {
+        return nil, err
     }
-    pool.Write(marshalEncrypted)
-    poolSum := md5.Sum(pool.Bytes())
-    pool.Write(poolSum[:])
+    key.sent(len(f.payload))
 
-    b64Buf := util.B64E(pool.Bytes())
-    return []byte(b64Buf), nil
+    return output, nil
 }
 
 func encodeKeyValue (high int) string {
@@ -138,128 +274,158 @@ func (f *NetChannelClient) checkForKeyCollision(key string, charSet string) (out
     return
 }
 
-func getClientPublicKey(buffer string) (marshalledPublicKey []byte, err error) {
-    /*
-     * Read in an HTTP request in the following format:
-     *  b64([8 bytes XOR key][XOR-SHIFT encrypted marshalled public ECDH key][md5sum of first 2])
-     */
-    b64Decoded, err := util.B64D(buffer)
+/* Decodes the b64(HS_CLIENT_HELLO) parameter, raw is part of the handshake transcript */
+func parseClientHello(buffer string) (hello *handshakeMessage, raw []byte, err error) {
+    raw, err = util.B64D(buffer)
     if err != nil {
-        return nil, err
+        return nil, nil, err
     }
-    var xorKey = make([]byte, crc64.Size)
-    copy(xorKey, b64Decoded[:crc64.Size])
-    var marshalXor = make([]byte, len(b64Decoded) - crc64.Size - md5.Size)
-    var sum = make([]byte, md5.Size)
-    copy(sum, b64Decoded[len(xorKey) + len(marshalXor):])
 
-    sumBuffer := make([]byte, len(b64Decoded) - md5.Size)
-    copy(sumBuffer, b64Decoded[:len(b64Decoded) - md5.Size])
-    newSum := md5.Sum(sumBuffer)
-    if !bytes.Equal(newSum[:], sum) {
-        return nil, util.RetErrStr("Data integrity mismatch")
+    hello, length, err := parseHandshake(raw, HS_CLIENT_HELLO)
+    if err != nil {
+        return nil, nil, err
+    }
+    if length != len(raw) {
+        return nil, nil, ERROR_HANDSHAKE_MALFORMED
     }
 
-    copy(marshalXor, b64Decoded[crc64.Size:len(b64Decoded) - md5.Size])
-    marshalled := func (key []byte, pool []byte) []byte {
-        var output = make([]byte, len(pool))
-        copy(output, pool)
+    return hello, raw, nil
+}
 
-        counter := 0
-        for k := range pool {
-            if counter == 8 {
-                counter = 0
-            }
-            output[k] = output[k] ^ key[counter]
-            counter += 1
-        }
+func (f *NetChannelClient) decodeServerPubkeyGenSecret(publicKeyRaw []byte, keyShare *clientKeyShare,
+    clientPool []byte) (keys *sessionKeys, secret []byte, err error) {
 
-        return output
-    } (xorKey, marshalXor)
+    decoded, err := util.B64D(string(publicKeyRaw))
+    if err != nil {
+        return nil, nil, err
+    }
 
-    return marshalled, nil
-}
+    /* b64([HS_SERVER_HELLO][HS_SERVER_FINISHED]), see handshake.go */
+    hello, helloLen, err := parseHandshake(decoded, HS_SERVER_HELLO)
+    if err != nil {
+        return nil, nil, err
+    }
+    finished, finishedLen, err := parseHandshake(decoded[helloLen:], HS_SERVER_FINISHED)
+    if err != nil {
+        return nil, nil, err
+    }
+    if helloLen + finishedLen != len(decoded) {
+        return nil, nil, ERROR_HANDSHAKE_MALFORMED
+    }
 
-func (f *NetChannelClient) decodeServerPubkeyGenSecret(publicKeyRaw []byte, privateKey crypto.PrivateKey, curve ecdh.ECDH) (
-    secret []byte, err error) {
+    /* The server key is on the same curve as ours, so it is the same length */
+    var (
+        privateKey      = keyShare.ecdh
+        clientPublic    = privateKey.PublicKey().Bytes()
+    )
+    serverPublic, err := hello.field(HS_FIELD_PUBLIC_KEY, len(clientPublic))
+    if err != nil {
+        return nil, nil, err
+    }
+    clientId, err := hello.field(HS_FIELD_SESSION_ID, SESSION_ID_SIZE)
+    if err != nil {
+        return nil, nil, err
+    }
+    confirmation, err := finished.field(HS_FIELD_KEY_CONFIRMATION, keyConfirmationSize)
+    if err != nil {
+        return nil, nil, err
+    }
+    var ticket = finished.optional(HS_FIELD_TICKET)
 
-    decoded, err := util.B64D(string(publicKeyRaw))
+    negotiated, err := clientCapabilities(f.flags, f.maxFrameSize, f.compression).accept(hello)
     if err != nil {
-        return nil, err
+        return nil, nil, err
     }
 
-    var responsePool = bytes.Buffer{}
-    responsePool.Write(decoded)
+    if err := f.verifyServerIdentity(hello.optional(HS_FIELD_SERVER_IDENTITY),
+        serverSignatureTranscript(f.curve, clientPublic, serverPublic, clientId)); err != nil {
+        return nil, nil, err
+    }
 
-    var xorKey = make([]byte, crc64.Size)
-    var xordMarshaled = make([]byte, len(decoded) - crc64.Size - md5.Size)
-    var clientId = make([]byte, md5.Size)
+    serverPubKey, err := privateKey.Curve().NewPublicKey(serverPublic)
+    if err != nil {
+        return nil, nil, util.RetErrStr("Failed to unmarshal server-side public key")
+    }
 
-    responsePool.Read(xorKey)
-    responsePool.Read(xordMarshaled)
-    marshalled := func (xorKey []byte, encoded []byte) []byte {
-        output := make([]byte, len(encoded))
-        copy(output, encoded)
-        counter := 0
-        for k := range output {
-            if counter == len(xorKey) {
-                counter = 0
-            }
+    /* Generate the secret, and derive the session keys from it */
+    secret, err = privateKey.ECDH(serverPubKey)
+    if err != nil || len(secret) == 0 {
+        return nil, nil, err
+    }
 
-            output[k] ^= xorKey[counter]
-            counter += 1
+    /* A server that does not support the hybrid mode omits the ciphertext */
+    if ciphertext := hello.optional(HS_FIELD_KEM_CIPHERTEXT); ciphertext != nil {
+        if keyShare.kem == nil {
+            return nil, nil, ERROR_KEM_UNEXPECTED
         }
-        return output
-    } (xorKey, xordMarshaled)
-    responsePool.Read(clientId)
 
-    f.clientId = clientId
-    f.clientIdString = hex.EncodeToString(f.clientId)
-
-    serverPubKey, ok := curve.Unmarshal(marshalled)
-    if !ok {
-        return nil, util.RetErrStr("Failed to unmarshal server-side public key")
+        kemSecret, err := keyShare.kem.Decapsulate(ciphertext)
+        if err != nil {
+            return nil, nil, err
+        }
+        secret = append(secret, kemSecret...)
+        f.postQuantum = true
     }
 
-    /* Generate the secret finally */
-    var secretGenStatus error = nil
-    secret, secretGenStatus = curve.GenerateSharedSecret(privateKey, serverPubKey)
-    if err != secretGenStatus || len(secret) == 0 {
-        return nil, secretGenStatus
+    var transcript = handshakeTranscript(clientPool, decoded[:helloLen])
+    if keys, err = deriveSessionKeys(secret, transcript); err != nil {
+        return nil, nil, err
+    }
+    if !hmac.Equal(keys.confirmation(transcript, ticket), confirmation) {
+        return nil, nil, ERROR_KEY_CONFIRMATION
     }
 
-    return secret, nil
+    f.clientId = clientId
+    f.clientIdString = hex.EncodeToString(f.clientId)
+    f.rxLock.Lock()
+    f.ticket = ticket
+    f.resumptionSecret = keys.resumption
+    f.rxLock.Unlock()
+    f.negotiated = *negotiated
+
+    return keys, secret, nil
 }
 
 func (f *NetChannelClient) generateCurvePostRequest() (
-    ec ecdh.ECDH,
     req map[string]string,
-    privateKey crypto.PrivateKey,
+    keyShare *clientKeyShare,
+    rawPool []byte,
     genStatus error) {
 
     genStatus = nil
 
     /*
-     * Generate the ECDH keys based on the EllipticP384 Curve/create keypair
+     * Generate the ECDH keypair based on the configured curve (P-384 by default)
      */
-    var (
-        publicKey crypto.PublicKey
-        keypairStatus error = nil
-    )
-    curve := ecdh.NewEllipticECDH(elliptic.P384())
-    privateKey, publicKey, keypairStatus = curve.GenerateKey(rand.Reader)
+    keyShare = &clientKeyShare{}
+    var keypairStatus error = nil
+    keyShare.ecdh, keypairStatus = f.curve.ecdhCurve().GenerateKey(rand.Reader)
     if keypairStatus != nil {
         return nil, nil, nil, keypairStatus
     }
-    var pubKeyMarshalled = curve.Marshal(publicKey)
 
-    /*
-     * Generate the b64([xor][marshalled][md5sum]) buffer
-     */
-    postPool, err := f.genTxPool(pubKeyMarshalled)
-    if err != nil || len(postPool) < 1 {
+    var kemKey []byte = nil
+    if (f.flags & FLAG_HYBRID_MLKEM) > 0 {
+        if keyShare.kem, keypairStatus = mlkem.GenerateKey768(); keypairStatus != nil {
+            return nil, nil, nil, keypairStatus
+        }
+        kemKey = keyShare.kem.EncapsulationKey().Bytes()
+    }
+
+    /* The curve and public key are followed by the client credentials, if any */
+    var clientPublic = keyShare.ecdh.PublicKey().Bytes()
+    var fields = []handshakeField{
+        {HS_FIELD_CURVE, []byte{byte(f.curve)}},
+        {HS_FIELD_PUBLIC_KEY, clientPublic},
+        {HS_FIELD_CLIENT_AUTH, f.genClientAuth(clientAuthTranscript(f.curve, clientPublic))},
+        {HS_FIELD_KEM_KEY, kemKey},
+    }
+    fields = append(fields, clientCapabilities(f.flags, f.maxFrameSize, f.compression).fields()...)
+    rawPool, err := encodeHandshake(HS_CLIENT_HELLO, fields...)
+    if err != nil {
         return nil, nil, nil, err
     }
+    var postPool = util.B64E(rawPool)
 
     /* generate fake key/value pools */
     outMap := make(map[string]string)
@@ -294,88 +460,88 @@ func (f *NetChannelClient) generateCurvePostRequest() (
         outMap[key] = pool
     }
 
-    ec          = curve
     req         = outMap
     genStatus   = nil
     return
 }
 
-func decryptData(b64Encoded string, secret []byte) (clientId string, rawData []byte, txUnit *transferUnit, status error) {
-    status      = util.RetErrStr("decryptData: Unknown error")
-    clientId    = ""
-    rawData     = nil
-    txUnit      = nil
-
+/*
+ * Opens and decodes a record. The direction is the expected direction of travel
+ *  for the record, and suite is the negotiated cipher suite
+ */
+func decryptData(b64Encoded string, key *trafficState, suite CipherSuite, direction FlagVal) (rawData []byte,
+    decoded *frame, status error) {
     b64Decoded, err := util.B64D(b64Encoded)
     if err != nil {
-        status = err
-        return
+        return nil, nil, err
     }
 
-    decrypted, err := cryptog.RC4_Decrypt(b64Decoded, cryptog.RC4_PrepareKey(secret))
+    return decryptRecord(b64Decoded, key, suite, direction)
+}
+
+/* As decryptData, for a record that is not base64 encoded, i.e. a WebSocket message */
+func decryptRecord(record []byte, key *trafficState, suite CipherSuite, direction FlagVal) (rawData []byte,
+    decoded *frame, status error) {
+    /* Authentication failures are caught here, prior to the frame decoder */
+    decrypted, err := key.open(record, suite, direction)
     if err != nil {
-        status = err
-        return
+        key.reject()
+        return nil, nil, err
     }
 
-    var decodeStatus error = nil
-    txUnit, decodeStatus = func(raw []byte) (*transferUnit, error) {
-        output := new(transferUnit)
-
-        p := &bytes.Buffer{}
-        p.Write(raw)
-        d := gob.NewDecoder(p)
-        if err := d.Decode(output); err != nil {
-            return nil, err
+    if suite == CIPHER_LEGACY_RC4 {
+        if len(decrypted) < md5.Size {
+            key.reject()
+            return nil, nil, ERROR_FRAME_MALFORMED
+        }
+        var frameLen = len(decrypted) - md5.Size
+        if frameSum := md5.Sum(decrypted[:frameLen]); !bytes.Equal(frameSum[:], decrypted[frameLen:]) {
+            key.reject()
+            return nil, nil, util.RetErrStr("decryptData: Data corruption")
         }
+        decrypted = decrypted[:frameLen]
+    }
 
-        return output, nil
-    } (decrypted)
-    if decodeStatus != nil || txUnit == nil {
-        status = decodeStatus
-        return
+    decoded, err = decodeFrame(decrypted)
+    if err != nil {
+        key.reject()
+        return nil, nil, err
     }
 
-    newSum := func (p []byte) string {
-        dataSum := md5.Sum(p)
-        return hex.EncodeToString(dataSum[:])
-    } (txUnit.Data)
-    if strings.Compare(newSum, txUnit.DecryptedSum) != 0 {
-        status = util.RetErrStr("decryptData: Data corruption")
-        return
+    if decoded.flags & frameFlags(direction, 0) == 0 {
+        key.reject()
+        return nil, nil, util.RetErrStr("decryptData: Unexpected direction")
     }
 
-    rawData     = txUnit.Data
-    clientId    = txUnit.ClientID
-    status      = nil
-    return
-}
+    /* Only authenticated records are checked against the replay window */
+    if err := key.accept(decoded.sequence, len(decoded.payload)); err != nil {
+        return nil, nil, err
+    }
 
-/* Send back server pub key */
-func sendPubKey(writer http.ResponseWriter, marshalled []byte, clientId []byte) error {
-    var pool = bytes.Buffer{}
-    var xorKey = make([]byte, crc64.Size)
-    rand.Read(xorKey)
-    pool.Write(xorKey)
-    marshaledXor := make([]byte, len(marshalled))
-    copy(marshaledXor, marshalled)
-    counter := 0
-    for k := range marshaledXor {
-        if counter == len(xorKey) {
-            counter = 0
-        }
+    return decoded.payload, decoded, nil
+}
 
-        marshaledXor[k] ^= xorKey[counter]
-        counter += 1
+/*
+ * Generate the HS_SERVER_HELLO message, including the server identity if one is
+ *  configured. The key confirmation is sent in HS_SERVER_FINISHED, once the session
+ *  keys are derived
+ */
+func genPubKeyResponse(marshalled []byte, clientId []byte, identity []byte, kemCiphertext []byte,
+    negotiated *Capabilities) ([]byte, error) {
+    var fields = []handshakeField{
+        {HS_FIELD_PUBLIC_KEY, marshalled},
+        {HS_FIELD_SESSION_ID, clientId},
+        {HS_FIELD_SERVER_IDENTITY, identity},
+        {HS_FIELD_KEM_CIPHERTEXT, kemCiphertext},
     }
-    pool.Write(marshaledXor)
-    pool.Write(clientId)
 
-    if err := sendResponse(writer, pool.Bytes()); err != nil {
-        return err
-    }
+    return encodeHandshake(HS_SERVER_HELLO, append(fields, negotiated.fields()...)...)
+}
 
-    return nil
+func genServerFinished(ticket []byte, confirmation []byte) ([]byte, error) {
+    return encodeHandshake(HS_SERVER_FINISHED,
+        handshakeField{HS_FIELD_TICKET, ticket},
+        handshakeField{HS_FIELD_KEY_CONFIRMATION, confirmation})
 }
 
 /* Sanity test for POST_BODY_KEY_CHARSET */
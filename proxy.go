@@ -0,0 +1,177 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package websock
+
+import (
+    "io"
+    "net"
+    "errors"
+    "syscall"
+    "encoding/binary"
+    "net/http"
+    "net/url"
+    "time"
+
+    "github.com/AlexRuzin/util"
+)
+
+/************************************************************
+ * HTTP proxies                                             *
+ ************************************************************/
+
+/*
+ * By default the client reaches the gate through the proxy named by HTTP_PROXY,
+ *  HTTPS_PROXY and NO_PROXY, as http.ProxyFromEnvironment. WithProxy names the proxy
+ *  explicitly, with the http, https or socks5 scheme, and WithProxyAuth sets the Basic
+ *  credentials sent to whichever proxy is used, unless its URI already carries them. An
+ *  https gate URI is tunnelled through the proxy with CONNECT, and the WebSocket upgrade
+ *  uses the same proxy.
+ *
+ * Proxies commonly cut a request that has been idle for longer than some timeout, which
+ *  a held poll may well be. A client that reaches the gate through a proxy therefore asks
+ *  the server to answer each poll within PROXY_POLL_TIMEOUT, or within the time given to
+ *  WithPollTimeout, by sending the limit in the body of CONTROL_POLL:
+ *
+ *  [2 bytes big-endian, seconds, 0 for C2ResponseTimeout][1 byte, POLL_FLAG_*, optional]
+ *
+ * The server holds the poll for the lesser of the limit and C2ResponseTimeout. A poll that
+ *  is cut regardless, by a gateway error, a timeout or a reset connection, is sent again
+ *  up to POLL_RETRIES times before the circuit is considered lost. A refused connection
+ *  or a failed lookup is not retried.
+ *
+ * The answer to a cut poll may have left the server, and a new poll supersedes any poll
+ *  the server still holds for the client. The server therefore keeps the frame it last
+ *  answered a poll with until the next poll acknowledges it. A poll sent again is marked
+ *  with POLL_FLAG_RETRY, and is answered with that frame once more, which the client
+ *  drops as a replay if it had arrived after all. Any other poll acknowledges it.
+ */
+const (
+    PROXY_POLL_TIMEOUT          = 20 * time.Second
+    POLL_RETRIES                = 3
+    POLL_RETRY_DELAY            = 1 * time.Second
+
+    POLL_FLAG_RETRY             byte = 1 << 0
+)
+
+var ERROR_PROXY_TIMEOUT         = util.RetErrStr("request was cut by a proxy or gateway")
+
+/* Applies the proxy options to the transport once every option has been set */
+func (f *NetChannelClient) configureProxy() error {
+    var proxy = http.ProxyFromEnvironment
+    if f.proxyURL != nil {
+        proxy = http.ProxyURL(f.proxyURL)
+    }
+
+    if f.proxyAuth != nil {
+        var (
+            base        = proxy
+            auth        = f.proxyAuth
+        )
+        proxy = func(request *http.Request) (*url.URL, error) {
+            proxyURL, err := base(request)
+            if err != nil || proxyURL == nil || proxyURL.User != nil {
+                return proxyURL, err
+            }
+
+            var withAuth = *proxyURL
+            withAuth.User = auth
+            return &withAuth, nil
+        }
+    }
+    f.transport.Proxy = proxy
+
+    /* Only a circuit that is carried by a proxy bounds its polls by default */
+    if f.pollTimeout == 0 {
+        proxyURL, err := proxy(&http.Request{URL: f.controllerURL})
+        if err != nil {
+            return err
+        }
+        if proxyURL != nil {
+            f.pollTimeout = PROXY_POLL_TIMEOUT
+        }
+    }
+
+    return nil
+}
+
+/* A poll that was cut on its way to or from the server, rather than refused */
+func isTransientPollError(err error) bool {
+    var (
+        netError        net.Error
+        requestError    *url.Error
+    )
+    switch {
+    case errors.Is(err, ERROR_PROXY_TIMEOUT):
+        return true
+    case errors.As(err, &netError) && netError.Timeout():
+        return true
+    case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.ErrUnexpectedEOF):
+        return true
+    case errors.As(err, &requestError):
+        /* The connection was closed before the response arrived */
+        return errors.Is(requestError.Err, io.EOF)
+    }
+
+    return false
+}
+
+/* The body of CONTROL_POLL, empty unless the poll is bounded or sent again */
+func encodePoll(timeout time.Duration, retry bool) []byte {
+    if timeout <= 0 && !retry {
+        return nil
+    }
+
+    var seconds = (timeout + time.Second - 1) / time.Second
+    if seconds < 0 {
+        seconds = 0
+    }
+    if seconds > 0xffff {
+        seconds = 0xffff
+    }
+
+    var body = binary.BigEndian.AppendUint16(nil, uint16(seconds))
+    if retry {
+        body = append(body, POLL_FLAG_RETRY)
+    }
+    return body
+}
+
+func isPollRetry(body []byte) bool {
+    return len(body) > 2 && (body[2] & POLL_FLAG_RETRY) > 0
+}
+
+/* How long the server holds a poll with the given body, at most C2ResponseTimeout */
+func decodePollTimeout(body []byte, limit time.Duration) time.Duration {
+    if len(body) < 2 {
+        return limit
+    }
+
+    if timeout := time.Duration(binary.BigEndian.Uint16(body)) * time.Second; timeout != 0 && timeout < limit {
+        return timeout
+    }
+
+    return limit
+}
+
+/* EOF */
@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package websock
+
+import (
+    "crypto/aes"
+    "crypto/rand"
+    "crypto/cipher"
+    "encoding/binary"
+
+    "golang.org/x/crypto/chacha20poly1305"
+
+    "github.com/AlexRuzin/cryptog"
+    "github.com/AlexRuzin/util"
+)
+
+/*
+ * Record layer. Every frame (see encodeFrame) is sealed into a single record:
+ *
+ *  [1 byte cipher suite][4 byte key epoch][12 byte nonce][AEAD ciphertext + 16 byte tag]
+ *
+ * The nonce is freshly generated for each record. The key epoch identifies which
+ *  generation of the traffic key sealed the record (see trafficState). The header and
+ *  the direction of travel are bound as additional data, so a record that is modified,
+ *  truncated or reflected back at its sender is rejected before any frame decoding takes
+ *  place.
+ *
+ * CIPHER_LEGACY_RC4 is the original cryptog RC4 stream, which carries no header and
+ *  relies on an MD5 sum appended to the frame. It is only negotiated when the client
+ *  sets FLAG_LEGACY_RC4 and the server permits it (see negotiate.go), and exists so
+ *  that existing deployments can be migrated. Legacy records are never rekeyed.
+ */
+type CipherSuite uint8
+const (
+    CIPHER_LEGACY_RC4           CipherSuite = iota
+    CIPHER_AES256_GCM
+    CIPHER_CHACHA20_POLY1305
+)
+
+const (
+    recordEpochSize             = 4
+    recordNonceSize             = 12
+    recordHeaderSize            = 1 + recordEpochSize + recordNonceSize
+)
+
+var (
+    ERROR_RECORD_AUTH           = util.RetErrStr("record failed authentication")
+    ERROR_RECORD_TRUNCATED      = util.RetErrStr("record is truncated")
+    ERROR_RECORD_SUITE          = util.RetErrStr("record uses an unknown cipher suite")
+    ERROR_RECORD_SUITE_MISMATCH = util.RetErrStr("record uses a cipher suite that was not negotiated")
+)
+
+func (f CipherSuite) String() string {
+    switch f {
+    case CIPHER_LEGACY_RC4:
+        return "RC4 (legacy)"
+    case CIPHER_AES256_GCM:
+        return "AES-256-GCM"
+    case CIPHER_CHACHA20_POLY1305:
+        return "ChaCha20-Poly1305"
+    }
+
+    return "unknown"
+}
+
+/* key is one of the traffic keys derived by deriveSessionKeys() */
+func newRecordAEAD(suite CipherSuite, key []byte) (cipher.AEAD, error) {
+    switch suite {
+    case CIPHER_AES256_GCM:
+        block, err := aes.NewCipher(key)
+        if err != nil {
+            return nil, err
+        }
+        return cipher.NewGCM(block)
+
+    case CIPHER_CHACHA20_POLY1305:
+        return chacha20poly1305.New(key)
+    }
+
+    return nil, ERROR_RECORD_SUITE
+}
+
+func recordAdditionalData(header []byte, direction FlagVal) []byte {
+    var dirByte byte = 0
+    if (direction & FLAG_DIRECTION_TO_SERVER) > 0 {
+        dirByte = 1
+    } else if (direction & FLAG_DIRECTION_TO_CLIENT) > 0 {
+        dirByte = 2
+    }
+
+    var aad = make([]byte, 0, 1 + recordEpochSize + 1)
+    aad = append(aad, header[:1 + recordEpochSize]...)
+    return append(aad, dirByte)
+}
+
+func sealRecord(plaintext []byte, key []byte, epoch uint32, suite CipherSuite, direction FlagVal) ([]byte, error) {
+    if suite == CIPHER_LEGACY_RC4 {
+        return cryptog.RC4_Encrypt(plaintext, cryptog.RC4_PrepareKey(key))
+    }
+
+    aead, err := newRecordAEAD(suite, key)
+    if err != nil {
+        return nil, err
+    }
+
+    var record = make([]byte, recordHeaderSize, recordHeaderSize + len(plaintext) + aead.Overhead())
+    record[0] = byte(suite)
+    binary.BigEndian.PutUint32(record[1:], epoch)
+    var nonce = record[1 + recordEpochSize:recordHeaderSize]
+    if _, err := rand.Read(nonce); err != nil {
+        return nil, err
+    }
+
+    return aead.Seal(record, nonce, plaintext, recordAdditionalData(record, direction)), nil
+}
+
+/* The key epoch of a sealed record */
+func recordEpoch(record []byte) (uint32, error) {
+    if len(record) < recordHeaderSize {
+        return 0, ERROR_RECORD_TRUNCATED
+    }
+
+    return binary.BigEndian.Uint32(record[1:]), nil
+}
+
+/*
+ * Opens a record sealed with the negotiated suite. With CIPHER_LEGACY_RC4 the record is
+ *  assumed to be a raw RC4 stream. Otherwise the record is refused unless its header
+ *  names the same suite, so that a peer cannot switch a circuit to another AEAD
+ */
+func openRecord(record []byte, key []byte, suite CipherSuite, direction FlagVal) ([]byte, error) {
+    if suite == CIPHER_LEGACY_RC4 {
+        return cryptog.RC4_Decrypt(record, cryptog.RC4_PrepareKey(key))
+    }
+
+    if len(record) < recordHeaderSize {
+        return nil, ERROR_RECORD_TRUNCATED
+    }
+    if CipherSuite(record[0]) != suite {
+        return nil, ERROR_RECORD_SUITE_MISMATCH
+    }
+
+    aead, err := newRecordAEAD(suite, key)
+    if err != nil {
+        return nil, err
+    }
+    if len(record) < recordHeaderSize + aead.Overhead() {
+        return nil, ERROR_RECORD_TRUNCATED
+    }
+
+    plaintext, err := aead.Open(nil, record[1 + recordEpochSize:recordHeaderSize], record[recordHeaderSize:],
+        recordAdditionalData(record, direction))
+    if err != nil {
+        return nil, ERROR_RECORD_AUTH
+    }
+
+    return plaintext, nil
+}
+
+/*
+ * Replay protection. Every frame carries a sequence number that its sender
+ *  increments for each record. The receiver tracks the highest number seen, and a
+ *  bitmap of the REPLAY_WINDOW_SIZE numbers below it, so records may arrive out of
+ *  order (i.e. a cancelled poll racing a Write), but never twice. Anything older than
+ *  the window is rejected as well.
+ */
+const REPLAY_WINDOW_SIZE        = 64
+
+var ERROR_REPLAY                = util.RetErrStr("record was replayed or is too old")
+
+type replayWindow struct {
+    highest                     uint64
+    bitmap                      uint64
+}
+
+func (f *replayWindow) accept(sequence uint64) error {
+    if sequence == 0 {
+        return ERROR_REPLAY
+    }
+
+    if sequence > f.highest {
+        var shift = sequence - f.highest
+        if shift >= REPLAY_WINDOW_SIZE {
+            f.bitmap = 0
+        } else {
+            f.bitmap <<= shift
+        }
+        f.bitmap |= 1
+        f.highest = sequence
+        return nil
+    }
+
+    var offset = f.highest - sequence
+    if offset >= REPLAY_WINDOW_SIZE || (f.bitmap & (1 << offset)) != 0 {
+        return ERROR_REPLAY
+    }
+    f.bitmap |= 1 << offset
+
+    return nil
+}
+
+/* EOF */
@@ -0,0 +1,296 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package websock
+
+import (
+    "time"
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/gob"
+    "encoding/binary"
+
+    "github.com/AlexRuzin/util"
+)
+
+/************************************************************
+ * Session resumption                                       *
+ ************************************************************/
+
+/*
+ * After every key exchange the server issues a ticket, which is sent in the
+ *  HS_FIELD_TICKET field of HS_SERVER_FINISHED. The ticket is a record sealed under a
+ *  key that only the server holds, and carries the ClientIdString of the NetInstance
+ *  along with the resumption secret derived by deriveSessionKeys().
+ *
+ * A client that loses its circuit repeats the key exchange with a fresh ECDH key,
+ *  but presents the ticket in place of its credentials:
+ *
+ *  [CLIENT_AUTH_TICKET][2 byte ticket length][ticket][32 byte HMAC-SHA256]
+ *
+ * The HMAC is keyed with the resumption secret, over clientAuthTranscript(). If the
+ *  ticket opens, has not expired and the NetInstance still exists, then the new traffic
+ *  keys are kept for that NetInstance instead of creating a new one. The ClientIdString,
+ *  Identity and any queued data are kept, and IncomingHandler is not invoked again.
+ *
+ * A ticket is good for a single resumption. It carries the generation of the NetInstance
+ *  it was issued for, which is moved on as the ticket is redeemed, so that a captured
+ *  resumption can not be replayed. The new keys are only installed once the client has
+ *  sealed a record under them, until which the circuit continues under the previous
+ *  keys. An exchange that nobody follows up on therefore leaves the circuit untouched.
+ *  The client keeps the receiving key of the previous exchange, for a frame the server
+ *  sealed before the circuit was resumed, see openServerRecord().
+ */
+const DEFAULT_TICKET_LIFETIME   = 24 * time.Hour
+
+var ERROR_TICKET_INVALID        = util.RetErrStr("resumption ticket is invalid or has expired")
+
+type resumptionTicket struct {
+    ClientID                    string
+    Secret                      []byte
+    Expires                     int64
+    Generation                  uint64
+}
+
+/* The keys of a resumption, installed by openClientRecord() once the client uses them */
+type pendingResume struct {
+    curve                       CurveID
+    postQuantum                 bool
+    negotiated                  Capabilities
+    txKey                       *trafficState
+    rxKey                       *trafficState
+}
+
+/* Returns nil if tickets are disabled, see WithTicketLifetime */
+func (f *NetChannelService) issueTicket(clientId string, secret []byte, generation uint64) []byte {
+    if f.ticketLifetime == 0 {
+        return nil
+    }
+
+    var ticket = &bytes.Buffer{}
+    if err := gob.NewEncoder(ticket).Encode(resumptionTicket{
+        ClientID:   clientId,
+        Secret:     secret,
+        Expires:    time.Now().Add(f.ticketLifetime).Unix(),
+        Generation: generation,
+    }); err != nil {
+        return nil
+    }
+
+    sealed, err := sealRecord(ticket.Bytes(), f.ticketKey, 0, CIPHER_AES256_GCM, 0)
+    if err != nil || len(sealed) > 0xffff {
+        return nil
+    }
+
+    return sealed
+}
+
+func (f *NetChannelService) openTicket(sealed []byte) (*resumptionTicket, error) {
+    if f.ticketLifetime == 0 {
+        return nil, ERROR_TICKET_INVALID
+    }
+
+    plaintext, err := openRecord(sealed, f.ticketKey, CIPHER_AES256_GCM, 0)
+    if err != nil {
+        return nil, ERROR_TICKET_INVALID
+    }
+
+    var ticket = &resumptionTicket{}
+    if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(ticket); err != nil {
+        return nil, ERROR_TICKET_INVALID
+    }
+    if time.Now().Unix() > ticket.Expires {
+        return nil, ERROR_TICKET_INVALID
+    }
+
+    return ticket, nil
+}
+
+/* The ticket and resumption secret of the last key exchange, nil once the circuit is terminated */
+func (f *NetChannelClient) resumption() (ticket []byte, secret []byte) {
+    f.rxLock.Lock()
+    defer f.rxLock.Unlock()
+
+    return f.ticket, f.resumptionSecret
+}
+
+func (f *NetChannelClient) forgetTicket() {
+    f.rxLock.Lock()
+    f.ticket = nil
+    f.resumptionSecret = nil
+    f.rxLock.Unlock()
+}
+
+/*
+ * Opens a record sent by the server, under the receiving key of the previous exchange if
+ *  it does not open under the current one
+ */
+func (f *NetChannelClient) openServerRecord(record []byte) ([]byte, *frame, error) {
+    rawData, decoded, err := decryptRecord(record, f.rxKey, f.negotiated.CipherSuite, FLAG_DIRECTION_TO_CLIENT)
+    if err == nil {
+        return rawData, decoded, nil
+    }
+
+    f.rxLock.Lock()
+    var (
+        previous        = f.previousRxKey
+        suite           = f.previousSuite
+    )
+    f.rxLock.Unlock()
+    if previous == nil {
+        return nil, nil, err
+    }
+
+    if rawData, decoded, previousErr := decryptRecord(record, previous, suite,
+        FLAG_DIRECTION_TO_CLIENT); previousErr == nil || previousErr == ERROR_REPLAY {
+        return rawData, decoded, previousErr
+    }
+    return nil, nil, err
+}
+
+func genResumptionProof(ticket []byte, secret []byte, transcript []byte) []byte {
+    var proof = []byte{CLIENT_AUTH_TICKET}
+    proof = binary.BigEndian.AppendUint16(proof, uint16(len(ticket)))
+    proof = append(proof, ticket...)
+
+    mac := hmac.New(sha256.New, secret)
+    mac.Write(transcript)
+    return mac.Sum(proof)
+}
+
+/* Returns the NetInstance to be reattached */
+func (f *NetChannelService) verifyResumption(proof []byte, transcript []byte) (*NetInstance, error) {
+    if len(proof) < 3 || proof[0] != CLIENT_AUTH_TICKET {
+        return nil, ERROR_TICKET_INVALID
+    }
+
+    var length = int(binary.BigEndian.Uint16(proof[1:]))
+    if len(proof) != 3 + length + sha256.Size {
+        return nil, ERROR_TICKET_INVALID
+    }
+
+    ticket, err := f.openTicket(proof[3:3 + length])
+    if err != nil {
+        return nil, err
+    }
+
+    mac := hmac.New(sha256.New, ticket.Secret)
+    mac.Write(transcript)
+    if !hmac.Equal(mac.Sum(nil), proof[3 + length:]) {
+        return nil, ERROR_TICKET_INVALID
+    }
+
+    instance := f.lookupClient(ticket.ClientID)
+    if instance == nil || instance.isClosed() || !instance.redeemTicket(ticket.Generation) {
+        return nil, ERROR_TICKET_INVALID
+    }
+
+    return instance, nil
+}
+
+/* Moves the generation on, so that the ticket and every ticket issued before it are void */
+func (f *NetInstance) redeemTicket(generation uint64) bool {
+    f.iOSync.Lock()
+    defer f.iOSync.Unlock()
+
+    if generation != f.ticketGeneration {
+        return false
+    }
+    f.ticketGeneration += 1
+    return true
+}
+
+/* The generation carried by the next ticket issued for the NetInstance */
+func (f *NetInstance) generation() uint64 {
+    f.iOSync.Lock()
+    defer f.iOSync.Unlock()
+
+    return f.ticketGeneration
+}
+
+/* Keeps the keys of a new exchange until the client proves that it holds them */
+func (f *NetInstance) resume(curve CurveID, postQuantum bool, negotiated *Capabilities, txKey *trafficState,
+    rxKey *trafficState) {
+    f.iOSync.Lock()
+    defer f.iOSync.Unlock()
+
+    f.pending = &pendingResume{
+        curve:          curve,
+        postQuantum:    postQuantum,
+        negotiated:     *negotiated,
+        txKey:          txKey,
+        rxKey:          rxKey,
+    }
+}
+
+/*
+ * Opens a record sent by the client. A record that opens under the keys of a pending
+ *  resumption installs them, otherwise the record is opened under the current keys
+ */
+func (f *NetInstance) openClientRecord(record []byte) (negotiated Capabilities, data []byte, decoded *frame,
+    err error) {
+    f.iOSync.Lock()
+    var pending = f.pending
+    f.iOSync.Unlock()
+
+    if pending != nil {
+        data, decoded, err = decryptRecord(record, pending.rxKey, pending.negotiated.CipherSuite,
+            FLAG_DIRECTION_TO_SERVER)
+        if err == nil {
+            f.installResumed(pending)
+            return pending.negotiated, data, decoded, nil
+        }
+    }
+
+    negotiated, _, rxKey := f.session()
+    data, decoded, err = decryptRecord(record, rxKey, negotiated.CipherSuite, FLAG_DIRECTION_TO_SERVER)
+    return negotiated, data, decoded, err
+}
+
+func (f *NetInstance) installResumed(pending *pendingResume) {
+    f.iOSync.Lock()
+    defer f.iOSync.Unlock()
+
+    /* A later resumption may have replaced the keys in the meantime */
+    if f.pending != pending {
+        return
+    }
+    f.pending       = nil
+    f.curve         = pending.curve
+    f.postQuantum   = pending.postQuantum
+    f.negotiated    = pending.negotiated
+    f.txKey         = pending.txKey
+    f.rxKey         = pending.rxKey
+
+    /*
+     * The answer to the poll that was cut as the circuit was lost is sent first, under the
+     *  previous keys. The client still holds them, and drops the frame as a replay if it
+     *  had arrived after all
+     */
+    if f.unacked != nil {
+        f.held = append([][]byte{f.unacked}, f.held...)
+        f.unacked = nil
+    }
+}
+
+/* EOF */
@@ -27,18 +27,20 @@ package websock
 import (
     "fmt"
     "sync"
+    "sync/atomic"
     "bytes"
     "strings"
     "io"
+    "os"
     "time"
+    "net"
     "net/http"
-    "crypto/elliptic"
     "crypto/rand"
-    "crypto/md5"
+    "crypto/tls"
+    "crypto/ed25519"
     "encoding/hex"
 
     "github.com/AlexRuzin/util"
-    "github.com/wsddn/go-ecdh"
 )
 
 /************************************************************
@@ -55,40 +57,107 @@ type NetChannelService struct {
     port                    int16
     pathGate                string
     clientMap               map[string]*NetInstance
+    clientLock              sync.Mutex
 
-    config                  *ProtocolConfig
-}
+    /* Key exchange policy */
+    allowedCurves           map[CurveID]bool
 
-/*
- * Global object representing the service instance
- */
-var channelService          *NetChannelService
+    /* Long-term identity used to sign the key exchange */
+    signingKey              ed25519.PrivateKey
 
-/*
- * Channel for inbound clients
- */
-var clientIO                chan *NetInstance
+    /* Client authentication policy */
+    authorizer              ClientAuthorizer
+    preSharedKeys           map[string][]byte
+
+    /* Rekey limits applied to each NetInstance */
+    rekeyLimits             rekeyLimits
+
+    /* Largest frame that a NetInstance will receive, see WithInstanceMaxFrameSize */
+    maxFrameSize            uint32
+
+    /* Compression algorithms in order of preference, see WithServiceCompression */
+    compression             []CompressionAlgorithm
+
+    /* Resumption tickets are sealed with ticketKey, which never leaves the server */
+    ticketKey               []byte
+    ticketLifetime          time.Duration
+
+    /* Debugging only, see WithServiceKeyLog */
+    keyLog                  *keyLogWriter
+
+    /* Set if the gate is served over TLS, see tls.go */
+    tlsConfig               *tls.Config
+
+    /* New clients waiting for Accept(), see listener.go */
+    accepted                chan *NetInstance
+    done                    chan struct{}
+    closeOnce               sync.Once
+    listener                net.Listener
+    httpServer              *http.Server
+
+    config                  *ProtocolConfig
+}
 
 type NetInstance struct {
     /* Unique identifier that represents the client connection */
     ClientIdString          string
 
+    /* Verified client credentials, nil if the client did not authenticate */
+    Identity                *ClientIdentity
+
     /* Non-exported members */
     service                 *NetChannelService
-    secret                  []byte
+    curve                   CurveID
+    postQuantum             bool
+    negotiated              Capabilities
+    txKey                   *trafficState
+    rxKey                   *trafficState
     clientId                []byte
     clientTX                *bytes.Buffer       /* Data waiting to be transmitted */
     clientRX                *rxElement          /* Data that is waiting to be read, using a custom FIFO queue */
+    rxSignal                readSignal          /* Wakes a blocked Read() */
+    txSignal                readSignal          /* Wakes a pending poll */
+    closed                  bool
     iOSync                  sync.Mutex
 
-    connected               bool
+    /* net.Conn deadlines and the addresses of the last HTTP connection, see conn.go */
+    deadlines               deadlines
+    addrs                   connAddrs
+
+    /* Fragmentation of queued data and reassembly of large writes, see fragment.go */
+    outbound                *outboundMessage
+    messageId               uint32
+    reassembly              reassembler
+
+    /* The frame last answered to a poll, and the number of the latest poll, see proxy.go */
+    unacked                 []byte
+    polls                   uint64
+
+    /* The generation of the last ticket issued, and the keys of a resumption, see resume.go */
+    ticketGeneration        uint64
+    pending                 *pendingResume
+
+    /* Frames already sealed for the client, sent before any other queued data */
+    held                    [][]byte
+
+    /* Set once the client has moved the circuit to a WebSocket, see websocket.go */
+    socket                  atomic.Pointer[socketConn]
+
+    connected               atomic.Bool         /* Set once Accept() has returned the instance */
 
     /* URI Path */
     RequestURI              string
 }
 
+/* A message taken from clientTX that is being sent one fragment per response */
+type outboundMessage struct {
+    data                    []byte
+    id                      uint32
+    offset                  int
+}
+
 func CreateServer(pathGate string, port int16, flags FlagVal, handler func(client *NetInstance,
-    server *NetChannelService) error) (*NetChannelService, error) {
+    server *NetChannelService) error, options ...ServiceOption) (*NetChannelService, error) {
 
     /* The FLAG_ENCRYPT switch must always be set to true */
     if (flags & FLAG_ENCRYPT) == 0 {
@@ -119,29 +188,163 @@ func CreateServer(pathGate string, port int16, flags FlagVal, handler func(clien
 
         /* Set the main config */
         config:             tmpConfig,
+
+        allowedCurves:      defaultAllowedCurves(),
+        rekeyLimits:        defaultRekeyLimits(),
+        maxFrameSize:       DEFAULT_MAX_FRAME_SIZE,
+        ticketKey:          make([]byte, trafficKeySize),
+        ticketLifetime:     DEFAULT_TICKET_LIFETIME,
+        accepted:           make(chan *NetInstance, ACCEPT_BACKLOG),
+        done:               make(chan struct{}),
+    }
+    if _, err := rand.Read(server.ticketKey); err != nil {
+        return nil, err
+    }
+
+    for _, option := range options {
+        if err := option(server); err != nil {
+            return nil, err
+        }
     }
-    channelService = server
 
     /* Start the inbound/outbound listener threads */
     util.Sleep(100 * time.Millisecond)
-    server.startListeners()
+    if err := server.startListeners(); err != nil {
+        return nil, err
+    }
 
     return server, nil
 }
 
+/*
+ * A closed NetInstance remains in clientMap for closeLinger, so that the next request of
+ *  the client is answered with CONTROL_TERMINATE, after which the instance is forgotten
+ */
+const closeLinger           = 5 * time.Second
+
 func (f *NetChannelService) closeClient(client *NetInstance) {
-    delete(f.clientMap, client.ClientIdString)
+    /* Data that is already queued may still be read, after which Read() returns io.EOF */
+    rxQueueSync.Lock()
+    var closed = client.closed
+    client.closed = true
+    rxQueueSync.Unlock()
+    client.rxSignal.notify()
+    client.txSignal.notify()
+
+    if !closed {
+        time.AfterFunc(closeLinger, func() {
+            f.forgetClient(client)
+        })
+    }
 }
 
-func (f *NetChannelService) CloseService() {
-    panic("Closing primary service for handling websock protocol")
-    if clientIO != nil {
-        close(clientIO)
+func (f *NetChannelService) forgetClient(client *NetInstance) {
+    f.clientLock.Lock()
+    defer f.clientLock.Unlock()
+
+    if f.clientMap[client.ClientIdString] == client {
+        delete(f.clientMap, client.ClientIdString)
     }
 }
 
-func (f *NetInstance) Close() {
+/*
+ * Session IDs are SESSION_ID_SIZE random bytes, and have no relation to any key material.
+ *  An ID is reserved in clientMap before it is sent to the client, as a nil entry which
+ *  lookupClient() treats as unknown, until registerClient() stores the NetInstance under
+ *  it. An ID that is already present in clientMap is never handed out again
+ */
+var ERROR_SESSION_ID_COLLISION  = util.RetErrStr("session ID is already in use")
+
+func (f *NetChannelService) reserveSessionId() ([]byte, error) {
+    f.clientLock.Lock()
+    defer f.clientLock.Unlock()
+
+    var sessionId = make([]byte, SESSION_ID_SIZE)
+    for i := 0; i != 4; i += 1 {
+        if _, err := rand.Read(sessionId); err != nil {
+            return nil, err
+        }
+
+        if _, exists := f.clientMap[hex.EncodeToString(sessionId)]; !exists {
+            f.clientMap[hex.EncodeToString(sessionId)] = nil
+            return sessionId, nil
+        }
+    }
+
+    return nil, ERROR_SESSION_ID_COLLISION
+}
+
+/* Drops a reservation made by reserveSessionId(), if the key exchange did not complete */
+func (f *NetChannelService) releaseSessionId(sessionId []byte) {
+    f.clientLock.Lock()
+    defer f.clientLock.Unlock()
+
+    var key = hex.EncodeToString(sessionId)
+    if client, exists := f.clientMap[key]; exists && client == nil {
+        delete(f.clientMap, key)
+    }
+}
+
+func (f *NetChannelService) registerClient(client *NetInstance) error {
+    f.clientLock.Lock()
+    defer f.clientLock.Unlock()
+
+    if existing, reserved := f.clientMap[client.ClientIdString]; !reserved || existing != nil {
+        return ERROR_SESSION_ID_COLLISION
+    }
+    f.clientMap[client.ClientIdString] = client
+
+    return nil
+}
+
+func (f *NetChannelService) lookupClient(clientId string) *NetInstance {
+    f.clientLock.Lock()
+    defer f.clientLock.Unlock()
+
+    return f.clientMap[clientId]
+}
+
+func (f *NetChannelService) CloseService() {
+    f.Close()
+}
+
+func (f *NetInstance) Close() error {
+    if f.isClosed() {
+        return net.ErrClosed
+    }
+
     f.service.closeClient(f)
+    return nil
+}
+
+func (f *NetInstance) Stats() SessionStats {
+    _, txKey, rxKey := f.session()
+    return collectStats(txKey, rxKey)
+}
+
+/* True if the circuit was negotiated using the hybrid ML-KEM exchange, see FLAG_HYBRID_MLKEM */
+func (f *NetInstance) PostQuantum() bool {
+    f.iOSync.Lock()
+    defer f.iOSync.Unlock()
+
+    return f.postQuantum
+}
+
+/* The protocol version and options selected in the last key exchange */
+func (f *NetInstance) Negotiated() Capabilities {
+    negotiated, _, _ := f.session()
+    return negotiated
+}
+
+/*
+ * The options and traffic keys of the last key exchange. A resumption replaces them
+ *  under iOSync at any time (see resume.go), so they are only read through here
+ */
+func (f *NetInstance) session() (negotiated Capabilities, txKey *trafficState, rxKey *trafficState) {
+    f.iOSync.Lock()
+    defer f.iOSync.Unlock()
+
+    return f.negotiated, f.txKey, f.rxKey
 }
 
 /*
@@ -151,62 +354,75 @@ func (f *NetInstance) Len() int {
     return f.queueLen()
 }
 
+/*
+ * Deprecated: Read() blocks until data arrives, use SetReadDeadline() to bound the
+ *  time it waits
+ */
 func (f *NetInstance) Wait(timeoutMilliseconds time.Duration) (responseLen int, err error) {
     return f.waitInternal(timeoutMilliseconds)
 }
 
+/*
+ * Blocks until data has arrived from the client, and reads at most len(p) bytes of it.
+ *  Data that does not fit in p remains queued for the next Read(). io.EOF is only
+ *  returned once the NetInstance has been closed and the queue is empty, and
+ *  os.ErrDeadlineExceeded once the read deadline has passed
+ */
 func (f *NetInstance) Read(p []byte) (read int, err error) {
-    read, err = f.readInternal(p)
-    if err != io.EOF {
-        return 0, err
-    }
-
-    return
+    return f.readInternal(p)
 }
 
+/* A successful Write() returns len(p) and a nil error */
 func (f *NetInstance) Write(p []byte) (wrote int, err error) {
+    if deadlinePassed(f.deadlines.writing()) {
+        return 0, os.ErrDeadlineExceeded
+    }
+
     wrote, err = f.writeInternal(p)
     if err != io.EOF {
         return 0, err
     }
 
-    return
+    return wrote, nil
 }
 
-func (f *NetChannelService) startListeners() {
-    /* Create the clientIO channel */
-    clientIO = make(chan *NetInstance)
-    go func (svc *NetChannelService) {
-        var wg sync.WaitGroup
-        wg.Add(1)
-        for {
-            client, ok := <- clientIO
-            if !ok {
-                break /* Close the processor */
-            }
+func (f *NetChannelService) startListeners() error {
+    listener, err := net.Listen("tcp", ":" + util.IntToString(int(f.port)))
+    if err != nil {
+        return err
+    }
+    f.listener = listener
 
-            svc.clientMap[client.ClientIdString] = client
-            if err := svc.IncomingHandler(client, svc); err != nil {
-                svc.closeClient(client)
-            }
+    /* Each service serves its own mux, so that another may take the path once it is closed */
+    var mux = http.NewServeMux()
+    mux.HandleFunc(f.pathGate, f.handleClientRequest)
+    f.httpServer = newHTTPServer(f.Flags, mux)
+    f.httpServer.TLSConfig = f.tlsConfig
 
-            client.connected = true
-        }
-
-        panic(util.RetErrStr("inbound client channel has been terminated"))
-    } (f)
+    /* IncomingHandler is served from Accept(), see listener.go */
+    if f.IncomingHandler != nil {
+        go f.serveIncoming()
+    }
 
+    f.sendDebug("Handling request for path :" + f.pathGate)
     go func(svc *NetChannelService) {
-        http.HandleFunc(svc.pathGate, handleClientRequest)
-        svc.sendDebug("Handling request for path :" + svc.pathGate)
-        if err := http.ListenAndServe(":" + util.IntToString(int(f.port)),nil); err != nil {
-            panic("panic: Failure in loading httpd -- port already used for another service?")
+        var err error
+        if svc.tlsConfig != nil {
+            /* The certificates are in TLSConfig, see WithServiceTLS */
+            err = svc.httpServer.ServeTLS(svc.listener, "", "")
+        } else {
+            err = svc.httpServer.Serve(svc.listener)
+        }
+        if err != http.ErrServerClosed {
+            panic("panic: Failure in loading httpd: " + err.Error())
         }
     } (f)
+
+    return nil
 }
 
 /* Create circuit -OR- process gate requests */
-func handleClientRequest(writer http.ResponseWriter, reader *http.Request) {
+func (f *NetChannelService) handleClientRequest(writer http.ResponseWriter, reader *http.Request) {
     defer reader.Body.Close()
 
     /* Contains the marshalled Public Key after the initial decoding */
@@ -214,7 +430,7 @@ func handleClientRequest(writer http.ResponseWriter, reader *http.Request) {
         marshalledPublicClientKey       *string
         keyStatus                       error
     )
-    if marshalledPublicClientKey, keyStatus = decodePublicKeyParameters(reader); keyStatus != nil {
+    if marshalledPublicClientKey, keyStatus = f.decodePublicKeyParameters(reader); keyStatus != nil {
         util.RetErrStr(keyStatus.Error())
     }
 
@@ -227,7 +443,7 @@ func handleClientRequest(writer http.ResponseWriter, reader *http.Request) {
          * If it's a command, then there should be only one parameter, which is:
          *  b64(ClientIdString) = <command>
          */
-         parseExistingClient(reader, &writer)
+         f.parseExistingClient(reader, &writer)
 
          return /* The appropriate ClientData has been stored, so no more need for this method */
     }
@@ -235,25 +451,87 @@ func handleClientRequest(writer http.ResponseWriter, reader *http.Request) {
     /*
      * Create a new client
      */
-    if err := handleNewClient(*marshalledPublicClientKey, reader, &writer); err != nil {
+    if err := f.handleNewClient(*marshalledPublicClientKey, reader, &writer); err != nil {
         util.DebugOut(err.Error())
     }
 
     return
 }
 
-func handleNewClient(marshalledKey string, reader *http.Request, writer *http.ResponseWriter) error {
-    /* Parse client-side public ECDH key*/
-    marshalled, err := getClientPublicKey(marshalledKey)
-    if err != nil || marshalled == nil {
+func (f *NetChannelService) handleNewClient(marshalledKey string, reader *http.Request, writer *http.ResponseWriter) error {
+    /* A closed service still serves existing circuits, but accepts no new ones */
+    if f.isClosed() {
+        sendBadErrorCode(*writer, ERROR_SERVICE_CLOSED)
+        return ERROR_SERVICE_CLOSED
+    }
+
+    /* Parse the HS_CLIENT_HELLO message, see handshake.go */
+    hello, clientPool, err := parseClientHello(marshalledKey)
+    if err != nil {
+        sendBadErrorCode(*writer, err)
+        return err
+    }
+
+    curveField, err := hello.field(HS_FIELD_CURVE, 1)
+    if err != nil {
+        sendBadErrorCode(*writer, err)
+        return err
+    }
+    var curveId = CurveID(curveField[0])
+    if !f.allowedCurves[curveId] || curveId.ecdhCurve() == nil {
+        sendBadErrorCode(*writer, ERROR_CURVE_NOT_ALLOWED)
+        return ERROR_CURVE_NOT_ALLOWED
+    }
+    ecurve := curveId.ecdhCurve()
+
+    clientPublic, err := hello.field(HS_FIELD_PUBLIC_KEY, curveId.publicKeySize())
+    if err != nil {
+        sendBadErrorCode(*writer, err)
+        return err
+    }
+    var clientAuth = hello.optional(HS_FIELD_CLIENT_AUTH)
+
+    /* Select the protocol version and options, see negotiate.go */
+    offered, err := parseCapabilities(hello)
+    if err != nil {
         sendBadErrorCode(*writer, err)
-        util.DebugOut(err.Error())
         return err
     }
+    negotiated, err := serviceCapabilities(f.Flags, f.maxFrameSize,
+        f.compression).negotiate(offered)
+    if err != nil {
+        sendBadErrorCode(*writer, err)
+        return err
+    }
+
+    /*
+     * Verify the client credentials and check them against the authorizer, before
+     *  any state is created for this client
+     */
+    var (
+        identity        *ClientIdentity = nil
+        resumed         *NetInstance = nil
+        authTranscript  = clientAuthTranscript(curveId, clientPublic)
+    )
+    if len(clientAuth) != 0 && clientAuth[0] == CLIENT_AUTH_TICKET {
+        if resumed, err = f.verifyResumption(clientAuth, authTranscript); err != nil {
+            sendBadErrorCode(*writer, err)
+            return err
+        }
+        identity = resumed.Identity
+    } else if identity, err = f.verifyClientAuth(clientAuth, authTranscript); err != nil {
+        sendBadErrorCode(*writer, err)
+        return err
+    }
+    if f.authorizer != nil {
+        if err := f.authorizer(identity, reader); err != nil {
+            sendBadErrorCode(*writer, ERROR_CLIENT_NOT_AUTHORIZED)
+            return err
+        }
+    }
 
-    ecurve := ecdh.NewEllipticECDH(elliptic.P384())
-    clientPublicKey, ok := ecurve.Unmarshal(marshalled)
-    if !ok {
+    clientPublicKey, err := ecurve.NewPublicKey(clientPublic)
+    if err != nil {
         sendBadErrorCode(*writer, util.RetErrStr("unmarshalling failed"))
         return util.RetErrStr("Failed to unmarshal the ecurve Public Key")
     }
@@ -262,54 +540,126 @@ func handleNewClient(marshalledKey string, reader *http.Request, writer *http.Re
      * Since the client public key is nominal return generate
      *  our own keypair
      */
-    serverPrivateKey, serverPublicKey, err := ecurve.GenerateKey(rand.Reader)
+    serverPrivateKey, err := ecurve.GenerateKey(rand.Reader)
     if err != nil {
         sendBadErrorCode(*writer, err)
         return err
     }
 
-    /* Transmit the server public key */
-    var serverPubKeyMarshalled = ecurve.Marshal(serverPublicKey)
-    if serverPubKeyMarshalled == nil {
-        sendBadErrorCode(*writer, util.RetErrStr("Failed to marshal server-side pub key"))
+    /* Generate the secret, this fails on low-order X25519 points */
+    secret, err := serverPrivateKey.ECDH(clientPublicKey)
+    if err != nil || len(secret) == 0 {
+        sendBadErrorCode(*writer, util.RetErrStr("Failed to generate a shared secret key"))
         return err
     }
-    clientId := md5.Sum(marshalled)
-    if err := sendPubKey(*writer, serverPubKeyMarshalled, clientId[:]); err != nil {
+
+    /* In hybrid mode the ML-KEM secret follows the ECDH secret, see clientKeyShare */
+    var kemCiphertext []byte = nil
+    if kemKey := hello.optional(HS_FIELD_KEM_KEY); kemKey != nil && (f.Flags & FLAG_HYBRID_MLKEM) > 0 {
+        kemSecret, ciphertext, err := encapsulateKEM(kemKey)
+        if err != nil {
+            sendBadErrorCode(*writer, err)
+            return err
+        }
+        secret = append(secret, kemSecret...)
+        kemCiphertext = ciphertext
+    }
+
+    /* A resumed client keeps its session ID, otherwise a new one is reserved */
+    var (
+        serverPubKeyMarshalled  = serverPrivateKey.PublicKey().Bytes()
+        clientId                []byte
+    )
+    if resumed != nil {
+        clientId = resumed.clientId
+    } else if clientId, err = f.reserveSessionId(); err != nil {
         sendBadErrorCode(*writer, err)
         return err
     }
-
-    /* Generate the secret */
-    secret, err := ecurve.GenerateSharedSecret(serverPrivateKey, clientPublicKey)
-    if len(secret) == 0 {
-        sendBadErrorCode(*writer, util.RetErrStr("Failed to generate a shared secret key"))
+    var failExchange = func(err error) error {
+        if resumed == nil {
+            f.releaseSessionId(clientId)
+        }
+        sendBadErrorCode(*writer, err)
         return err
     }
 
-    if (channelService.Flags & FLAG_DEBUG) > 1 {
+    /* Sign both ephemeral keys if the server holds a long-term identity */
+    var serverIdentity []byte = nil
+    if f.signingKey != nil {
+        serverIdentity = signServerIdentity(f.signingKey,
+            serverSignatureTranscript(curveId, clientPublic, serverPubKeyMarshalled, clientId))
+    }
+
+    /* Derive the session keys over the exact handshake bytes, and confirm them to the client */
+    response, err := genPubKeyResponse(serverPubKeyMarshalled, clientId, serverIdentity, kemCiphertext,
+        negotiated)
+    if err != nil {
+        return failExchange(err)
+    }
+    var transcript = handshakeTranscript(clientPool, response)
+    keys, err := deriveSessionKeys(secret, transcript)
+    if err != nil {
+        return failExchange(err)
+    }
+
+    var generation uint64 = 0
+    if resumed != nil {
+        generation = resumed.generation()
+    }
+    var ticket = f.issueTicket(hex.EncodeToString(clientId), keys.resumption, generation)
+    finished, err := genServerFinished(ticket, keys.confirmation(transcript, ticket))
+    if err != nil {
+        return failExchange(err)
+    }
+
+    if err := f.sendResponse(*writer, append(response, finished...)); err != nil {
+        return failExchange(err)
+    }
+    f.keyLog.log(hex.EncodeToString(clientId), keys)
+
+    if (f.Flags & FLAG_DEBUG) > 1 {
         util.DebugOut("Server-side secret:")
         util.DebugOutHex(secret)
     }
 
+    var (
+        txKey               = newTrafficState(keys.serverToClient, f.rekeyLimits)
+        rxKey               = newTrafficState(keys.clientToServer, f.rekeyLimits)
+    )
+    if resumed != nil {
+        /* The NetInstance is already known to IncomingHandler, the keys wait for the client to use them */
+        resumed.resume(curveId, kemCiphertext != nil, negotiated, txKey, rxKey)
+        return nil
+    }
+
     var instance = &NetInstance{
-        service:            channelService,
-        secret:             secret,
-        clientId:           clientId[:],
-        ClientIdString:     hex.EncodeToString(clientId[:]),
+        service:            f,
+        curve:              curveId,
+        postQuantum:        kemCiphertext != nil,
+        negotiated:         *negotiated,
+        Identity:           identity,
+        txKey:              txKey,
+        rxKey:              rxKey,
+        clientId:           clientId,
+        ClientIdString:     hex.EncodeToString(clientId),
         clientRX:           nil,
         clientTX:           &bytes.Buffer{},
-        connected:          false,
+        rxSignal:           newReadSignal(),
+        txSignal:           newReadSignal(),
         RequestURI:         reader.RequestURI,
     }
+    instance.addrs.setFromRequest(reader)
 
-    /* Send the signal to startListeners() */
-    clientIO <- instance
+    if err := f.registerClient(instance); err != nil {
+        return err
+    }
 
-    return nil
+    /* Hand the client to Accept() */
+    return f.enqueueAccept(instance)
 }
 
-func parseExistingClient(reader *http.Request, writer *http.ResponseWriter) {
+func (f *NetChannelService) parseExistingClient(reader *http.Request, writer *http.ResponseWriter) {
     /*
      * Parameter for key negotiation does not exist. This implies that either someone is not using
      *  the server in the designed fashion, or that there is another command request coming from
@@ -329,8 +679,9 @@ func parseExistingClient(reader *http.Request, writer *http.ResponseWriter) {
         if decodedKey, err = util.B64D(k); err != nil {
             continue
         }
-        client := channelService.clientMap[string(decodedKey)]
+        client := f.lookupClient(string(decodedKey))
         if client != nil {
+
             /*
              * An active connection exists.
              *
@@ -341,27 +692,64 @@ func parseExistingClient(reader *http.Request, writer *http.ResponseWriter) {
              */
             value := key[k]
             var (
-                clientId       string
+                record         []byte = nil
+                negotiated     Capabilities
                 data           []byte = nil
-                txUnit         *transferUnit = nil
+                decoded        *frame = nil
             )
-            if clientId, data, txUnit, err = decryptData(value[0], client.secret);
-                err != nil || strings.Compare(clientId, client.ClientIdString) != 0 {
-                channelService.closeClient(client)
+            if record, err = util.B64D(value[0]); err == nil {
+                negotiated, data, decoded, err = client.openClientRecord(record)
+            }
+            if err != nil {
+                /*
+                 * Anyone who knows the ClientIdString can post a forged or replayed record, so
+                 *  the record is dropped and counted in SessionStats, but the circuit remains up
+                 */
+                if (f.Flags & FLAG_DEBUG) > 0 {
+                    util.DebugOut("[" + client.ClientIdString + "] Record rejected: " + err.Error())
+                }
+                sendBadErrorCode(*writer, err)
+                return
+            }
+            if err := checkFrameSize(decoded, negotiated.MaxFrameSize); err != nil {
+                sendBadErrorCode(*writer, err)
                 return
             }
+            client.addrs.setFromRequest(reader)
 
-            if (channelService.Flags & FLAG_COMPRESS) > 0 && (txUnit.Flags & FLAG_COMPRESS) > 0 {
-                var streamStatus error = nil
-                data, streamStatus = util.DecompressStream(data)
-                if streamStatus != nil {
-                    channelService.closeClient(client)
-                    return
+            /* Once the data queued for it has been sent, the client is told the instance is closed */
+            if client.isClosed() && !client.hasQueued() {
+                client.sendControl(*writer, CONTROL_TERMINATE, nil)
+                f.forgetClient(client)
+                return
+            }
+
+            /* A client with FLAG_WEBSOCKET moves the circuit to a WebSocket, see websocket.go */
+            if decoded.frameType == FRAME_CONTROL && client.isSocketUpgrade(reader, data) {
+                client.serveSocket(*writer, reader)
+                return
+            }
+
+            /* Control messages are never delivered to Read(), see control.go */
+            if decoded.frameType == FRAME_CONTROL {
+                if err := client.parseControl(data, *writer); err != nil {
+                    f.closeClient(client)
                 }
+                return
+            }
+
+            if data, err = client.receiveData(decoded, data); err != nil {
+                sendBadErrorCode(*writer, err)
+                return
+            }
+            if data == nil {
+                /* Nothing is delivered to Read() until the message is complete */
+                (*writer).WriteHeader(http.StatusOK)
+                return
             }
 
             if err := client.parseClientData(data, *writer); err != nil {
-                channelService.closeClient(client)
+                f.closeClient(client)
             }
 
             return /* The appropriate ClientData has been stored, so no more need for this method */
@@ -369,7 +757,7 @@ func parseExistingClient(reader *http.Request, writer *http.ResponseWriter) {
     }
 }
 
-func decodePublicKeyParameters(reader *http.Request) (clientKey *string, err error) {
+func (f *NetChannelService) decodePublicKeyParameters(reader *http.Request) (clientKey *string, err error) {
     /* Get remote client public key base64 marshalled string */
     clientKey = nil
     if err := reader.ParseForm(); err != nil {
@@ -378,8 +766,8 @@ func decodePublicKeyParameters(reader *http.Request) (clientKey *string, err err
     }
 
     for key := range reader.Form {
-        for i := len(channelService.config.PostBodyKeyCharset); i != 0; i -= 1 {
-            var tmpKey = string(channelService.config.PostBodyKeyCharset[i - 1])
+        for i := len(f.config.PostBodyKeyCharset); i != 0; i -= 1 {
+            var tmpKey = string(f.config.PostBodyKeyCharset[i - 1])
 
             decodedKey, err := util.B64D(key)
             if err != nil {
@@ -398,92 +786,274 @@ func decodePublicKeyParameters(reader *http.Request) (clientKey *string, err err
     return clientKey, nil
 }
 
-func (f *NetInstance) cmdWaitAndTransmitData(writer http.ResponseWriter) error {
-    var timeout = f.service.config.C2ResponseTimeout
-    for ; timeout != 0; timeout -= 1 {
-        if f.clientTX.Len() != 0 {
+/*
+ * Write() and Close() wake the poll, otherwise it is answered once C2ResponseTimeout passes,
+ *  or sooner if the client asks for it in the body of the poll, see proxy.go
+ */
+func (f *NetInstance) cmdWaitAndTransmitData(writer http.ResponseWriter, body []byte) error {
+    var (
+        deadline    = time.Now().Add(decodePollTimeout(body,
+                        time.Duration(f.service.config.C2ResponseTimeout) * time.Second))
+        retry       = isPollRetry(body)
+        poll        = f.startPoll(retry)
+    )
+    for {
+        /* The answer to the cut poll is sent again, it may also arrive while this one is held */
+        if unacked := f.unackedFrame(poll, retry); unacked != nil {
+            return f.service.sendResponse(writer, unacked)
+        }
+        if f.hasQueued() || f.isClosed() || !f.isCurrentPoll(poll) || !f.txSignal.wait(deadline) {
             break
         }
-        util.Sleep(1 * time.Second)
     }
 
-    if timeout == 0 || f.clientTX.Len() == 0 {
+    /* The client has sent another poll, which is passed any wakeup that reached this one */
+    if !f.isCurrentPoll(poll) {
+        f.txSignal.notify()
+        writer.WriteHeader(http.StatusOK)
+        return nil
+    }
+
+    /* Tell the client that the NetInstance has been closed */
+    if f.isClosed() && !f.hasQueued() {
+        f.service.forgetClient(f)
+        return f.sendControl(writer, CONTROL_TERMINATE, nil)
+    }
+
+    if !f.hasQueued() {
         /* Time out -- no data to be sent */
         writer.WriteHeader(http.StatusOK)
         return nil
     }
 
-    defer f.clientTX.Reset()
+    return f.transmitQueued(writer, poll)
+}
+
+/*
+ * Supersedes the poll that is held for the client, if any. A poll that is not sent again
+ *  acknowledges the frame the previous one was answered with
+ */
+func (f *NetInstance) startPoll(retry bool) uint64 {
+    f.iOSync.Lock()
+    f.polls += 1
+    var poll = f.polls
+    if !retry {
+        f.unacked = nil
+    }
+    f.iOSync.Unlock()
+
+    /* Wakes the superseded poll */
+    f.txSignal.notify()
+    return poll
+}
+
+func (f *NetInstance) isCurrentPoll(poll uint64) bool {
+    f.iOSync.Lock()
+    defer f.iOSync.Unlock()
+
+    return f.polls == poll
+}
+
+func (f *NetInstance) unackedFrame(poll uint64, retry bool) []byte {
+    f.iOSync.Lock()
+    defer f.iOSync.Unlock()
+
+    if !retry || f.polls != poll {
+        return nil
+    }
+    return f.unacked
+}
+
+func (f *NetInstance) hasQueued() bool {
+    f.iOSync.Lock()
+    defer f.iOSync.Unlock()
+
+    return len(f.held) != 0 || f.outbound != nil || f.clientTX.Len() != 0
+}
+
+/* Answers the poll with the data queued by Write(), which is kept until acknowledged */
+func (f *NetInstance) transmitQueued(writer http.ResponseWriter, poll uint64) error {
+    encrypted, err := f.nextQueued()
+    if err != nil {
+        return err
+    }
+
+    if encrypted == nil {
+        writer.WriteHeader(http.StatusOK)
+        return nil
+    }
+
+    f.iOSync.Lock()
+    f.unacked = encrypted
+    var superseded = f.polls != poll
+    f.iOSync.Unlock()
+    if superseded {
+        /* The poll that superseded this one may be a retry, which is answered with the frame */
+        f.txSignal.notify()
+    }
+
+    return f.service.sendResponse(writer, encrypted)
+}
+
+/*
+ * Seals the next frame of the data queued by Write(), or returns nil if nothing is
+ *  queued. Data larger than the negotiated frame size is held in outbound, and sent
+ *  one fragment per frame
+ */
+func (f *NetInstance) nextQueued() ([]byte, error) {
+    f.iOSync.Lock()
+    if len(f.held) != 0 {
+        var held = f.held[0]
+        f.held = f.held[1:]
+        f.iOSync.Unlock()
+        return held, nil
+    }
+
+    var (
+        negotiated      = f.negotiated
+        txKey           = f.txKey
+    )
+    if f.outbound == nil && f.clientTX.Len() != 0 {
+        f.outbound = &outboundMessage{
+            data:   bytes.Clone(f.clientTX.Bytes()),
+        }
+        f.clientTX.Reset()
+    }
 
     var (
-        outputStream = f.clientTX.Bytes()
-        otherFlags FlagVal = 0
+        outputStream    []byte = nil
+        fragment        *fragmentHeader = nil
     )
+    if f.outbound != nil {
+        if f.outbound.offset == 0 && len(f.outbound.data) <= int(negotiated.MaxFrameSize) {
+            outputStream = f.outbound.data
+            f.outbound = nil
+        } else {
+            if f.outbound.offset == 0 {
+                f.messageId += 1
+                f.outbound.id = f.messageId
+            }
 
-    if (f.service.Flags & FLAG_COMPRESS) > 0 && len(outputStream) > util.GetCompressedSize(outputStream) {
-        otherFlags |= FLAG_COMPRESS
-        var streamStatus error = nil
-        outputStream, streamStatus = util.CompressStream(outputStream)
-        if streamStatus != nil {
-            panic(streamStatus)
+            outputStream, fragment = nextFragment(f.outbound.data, f.outbound.id, f.outbound.offset,
+                negotiated.MaxFrameSize)
+            if f.outbound.offset += len(outputStream); f.outbound.offset == len(f.outbound.data) {
+                f.outbound = nil
+            }
         }
     }
+    f.iOSync.Unlock()
 
-    encrypted, _ := encryptData(outputStream, f.secret, FLAG_DIRECTION_TO_CLIENT, otherFlags, f.ClientIdString)
-    return sendResponse(writer, encrypted)
+    if outputStream == nil {
+        return nil, nil
+    }
+
+    outputStream, otherFlags, err := compressPayload(negotiated.Compression, outputStream)
+    if err != nil {
+        return nil, err
+    }
+
+    return encryptFragment(outputStream, fragment, txKey, negotiated.CipherSuite,
+        FLAG_DIRECTION_TO_CLIENT, otherFlags)
 }
 
-func (f *NetInstance) parseClientData(rawData []byte, writer http.ResponseWriter) error {
-    /*
-     * Check for internal commands first
-     */
-    if util.IsAsciiPrintable(string(rawData)) {
-        var command = string(rawData)
+/*
+ * Puts a frame from nextQueued() that could not be sent back at the head of the queue.
+ *  If it arrived after all, the client drops the second copy as a replay
+ */
+func (f *NetInstance) requeue(encrypted []byte) {
+    f.iOSync.Lock()
+    defer f.iOSync.Unlock()
 
-        switch command {
-        case f.service.config.CheckStream: // FLAG_CHECK_STREAM_DATA
-            return f.cmdWaitAndTransmitData(writer)
+    f.held = append([][]byte{encrypted}, f.held...)
+}
 
-        case f.service.config.TestStream: // FLAG_TEST_CONNECTION
-            encrypted, _ := encryptData(rawData, f.secret, FLAG_DIRECTION_TO_CLIENT, 0, f.ClientIdString)
-            return sendResponse(writer, encrypted)
+/* Returns the data of a complete message, or nil until the last fragment of it has arrived */
+func (f *NetInstance) receiveData(decoded *frame, data []byte) ([]byte, error) {
+    /* Only frames sent with FRAME_FLAG_COMPRESSED are decompressed, see compress.go */
+    negotiated, _, _ := f.session()
+    data, err := decompressPayload(negotiated.Compression, decoded, data, negotiated.MaxFrameSize)
+    if err != nil {
+        return nil, err
+    }
 
-        case f.service.config.TermConnect: // FLAG_TERMINATE_CONNECTION
-            /* FIXME */
-            return ERROR_TERMINATE
-        }
+    if decoded.fragment != nil {
+        return f.reassembly.add(decoded.fragment, data)
     }
+    return data, nil
+}
 
-    /* Decompression, if required, has already taken place in handleClientRequest() by parsing the TransmissionUnit flags */
+func (f *NetInstance) parseClientData(rawData []byte, writer http.ResponseWriter) error {
+    /* Decompression and reassembly have already taken place in receiveData() */
     f.enqueue(rawData)
 
-    /* If there is any data to return, then send it over */
-    var otherFlags FlagVal = 0
-    if f.clientTX.Len() > 0 {
-        defer f.clientTX.Reset()
+    /* Queued data is left for the pending poll, so that the client receives it in order */
+    writer.WriteHeader(http.StatusOK)
+    return nil
+}
 
-        var outputStream []byte = f.clientTX.Bytes()
+/* An unknown control message is refused, but the circuit remains up */
+func (f *NetInstance) parseControl(payload []byte, writer http.ResponseWriter) error {
+    message, err := decodeControl(payload)
+    if err != nil {
+        sendBadErrorCode(writer, err)
+        return nil
+    }
 
-        if (f.service.Flags & FLAG_COMPRESS) > 0 && len(outputStream) > util.GetCompressedSize(outputStream) {
-            otherFlags |= FLAG_COMPRESS
+    if message.controlType == CONTROL_POLL { // FLAG_CHECK_STREAM_DATA
+        return f.cmdWaitAndTransmitData(writer, message.body)
+    }
 
-            var streamStatus error = nil
-            outputStream, streamStatus = util.CompressStream(outputStream)
-            if streamStatus != nil {
-                panic(streamStatus)
-            }
-        }
+    reply, err := f.answerControl(message)
+    if reply == nil {
+        sendBadErrorCode(writer, err)
+        return nil
+    }
+    if err != nil {
+        f.sendControl(writer, reply.controlType, reply.body)
+        return err
+    }
+
+    return f.sendControl(writer, reply.controlType, reply.body)
+}
 
-        encrypted, _ := encryptData(outputStream, f.secret, FLAG_DIRECTION_TO_CLIENT, otherFlags, f.ClientIdString)
-        return sendResponse(writer, encrypted)
+/*
+ * The answer to a control message other than CONTROL_POLL. ERROR_TERMINATE is returned
+ *  along with the answer once the client closes the circuit
+ */
+func (f *NetInstance) answerControl(message *controlMessage) (*controlMessage, error) {
+    switch message.controlType {
+    case CONTROL_TEST: // FLAG_TEST_CONNECTION
+        return &controlMessage{controlType: CONTROL_TEST, body: message.body}, nil
+
+    case CONTROL_PING:
+        return &controlMessage{controlType: CONTROL_ACK, body: message.body}, nil
+
+    case CONTROL_REKEY:
+        /* The acknowledgement is the first record sealed under the new key */
+        _, txKey, _ := f.session()
+        txKey.requestRekey()
+        return &controlMessage{controlType: CONTROL_ACK}, nil
+
+    case CONTROL_TERMINATE: // FLAG_TERMINATE_CONNECTION
+        return &controlMessage{controlType: CONTROL_ACK}, ERROR_TERMINATE
     }
-    writer.WriteHeader(http.StatusOK)
 
-    return nil
+    return nil, ERROR_CONTROL_UNEXPECTED
+}
+
+func (f *NetInstance) sendControl(writer http.ResponseWriter, controlType byte, body []byte) error {
+    negotiated, txKey, _ := f.session()
+    encrypted, err := encryptControl(&controlMessage{controlType: controlType, body: body}, txKey,
+        negotiated.CipherSuite, FLAG_DIRECTION_TO_CLIENT)
+    if err != nil {
+        return err
+    }
+
+    return f.service.sendResponse(writer, encrypted)
 }
 
 func (f *NetInstance) waitInternal(timeoutMilliseconds time.Duration) (responseLen int, err error) {
-    if f.connected == false {
+    if !f.connected.Load() {
         return 0, util.RetErrStr("client not connected")
     }
 
@@ -491,7 +1061,7 @@ func (f *NetInstance) waitInternal(timeoutMilliseconds time.Duration) (responseL
     err = WAIT_TIMEOUT_REACHED
 
     for i := timeoutMilliseconds / 100; i != 0; i -= 1 {
-        if f.connected == false {
+        if f.isClosed() {
             responseLen = -1
             err = WAIT_CLOSED
             break
@@ -510,31 +1080,30 @@ func (f *NetInstance) waitInternal(timeoutMilliseconds time.Duration) (responseL
 }
 
 func (f *NetInstance) readInternal(p []byte) (int, error) {
-    if f.connected == false {
-        return 0, util.RetErrStr("client not connected")
-    }
-
-    f.iOSync.Lock()
-    defer f.iOSync.Unlock()
-
-    rawData, _ := f.dequeue()
-    if len(rawData) == 0 {
-        return 0, nil
+    for {
+        read, closed := f.readQueue(p)
+        switch {
+        case read != 0:
+            return read, nil
+        case closed:
+            return 0, io.EOF
+        case len(p) == 0:
+            return 0, nil
+        case !f.rxSignal.wait(f.deadlines.reading()):
+            return 0, os.ErrDeadlineExceeded
+        }
     }
-
-    copy(p, rawData)
-    return len(rawData), io.EOF
 }
 
 func (f *NetInstance) writeInternal(p []byte) (int, error) {
-    if f.connected == false {
-        return 0, util.RetErrStr("client not connected")
+    if f.isClosed() {
+        return 0, ERROR_NOT_CONNECTED
     }
 
     f.iOSync.Lock()
-    defer f.iOSync.Unlock()
-
     f.clientTX.Write(p)
+    f.iOSync.Unlock()
+    f.txSignal.notify()
 
     return len(p), io.EOF
 }
@@ -550,7 +1119,16 @@ type rxElement struct {
 }
 var rxQueueSync     sync.Mutex
 
+func (f *NetInstance) isClosed() bool {
+    rxQueueSync.Lock()
+    defer rxQueueSync.Unlock()
+
+    return f.closed
+}
+
 func (f *NetInstance) enqueue(p []byte) {
+    defer f.rxSignal.notify()
+
     rxQueueSync.Lock()
     defer rxQueueSync.Unlock()
 
@@ -573,27 +1151,29 @@ func (f *NetInstance) enqueue(p []byte) {
     f.clientRX = f.clientRX.last
 }
 
-func (f *NetInstance) dequeue() ([]byte, error) {
+/* Reads the oldest queued data into p. An element that is only partly read remains queued */
+func (f *NetInstance) readQueue(p []byte) (read int, closed bool) {
     rxQueueSync.Lock()
     defer rxQueueSync.Unlock()
 
-    if f.clientRX == nil {
-        return nil, nil
-    }
+    for read != len(p) && f.clientRX != nil {
+        oldest := f.clientRX
+        for ; oldest.next != nil; oldest = oldest.next {}
 
-    if f.clientRX.next == nil {
-        out := f.clientRX.data.Bytes()
-        f.clientRX = nil
-        return out, nil
-    }
+        copied, _ := oldest.data.Read(p[read:])
+        read += copied
+        if oldest.data.Len() != 0 {
+            continue
+        }
 
-    endElement := f.clientRX
-    for ;endElement.next != nil; endElement = endElement.next {}
-    var out = endElement.data.Bytes()
-    t := endElement.last
-    t.next = nil
+        if oldest.last == nil {
+            f.clientRX = nil
+        } else {
+            oldest.last.next = nil
+        }
+    }
 
-    return out, nil
+    return read, f.closed
 }
 
 func (f *NetInstance) queueLen() int {
@@ -621,15 +1201,14 @@ func sendBadErrorCode(writer http.ResponseWriter, err error) {
     return
 }
 
-func sendResponse(writer http.ResponseWriter, data []byte) error {
+func (f *NetChannelService) sendResponse(writer http.ResponseWriter, data []byte) error {
     if len(data) == 0 {
         return util.RetErrStr("sendResponse: Invalid parameter")
     }
 
     var b64Encoded = util.B64E(data)
 
-    writer.Header().Set("Content-Type", channelService.config.ContentType)
-    writer.Header().Set("Connection", "close")
+    writer.Header().Set("Content-Type", f.config.ContentType)
     writer.WriteHeader(http.StatusOK)
 
     fmt.Fprintln(writer, b64Encoded)
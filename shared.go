@@ -43,13 +43,18 @@ const (
     FLAG_TERMINATE_CONNECTION
     FLAG_TEST_CONNECTION
     FLAG_CHECK_STREAM_DATA
+    FLAG_LEGACY_RC4             /* Offer (client) or accept (server) the original RC4 record cipher -- migration only */
+    FLAG_CHACHA20_POLY1305      /* Prefer ChaCha20-Poly1305 over AES-256-GCM when negotiating the cipher suite */
+    FLAG_HYBRID_MLKEM           /* Combine ECDH with ML-KEM-768 in the key exchange, if both sides set it */
+    FLAG_WEBSOCKET              /* Carry the circuit over an RFC 6455 WebSocket, if both sides set it */
+    FLAG_H2C                    /* Send requests as HTTP/2 streams over cleartext TCP, the server must set it as well */
 )
 
-type internalCommands struct {
-    flags                   FlagVal
-    command                 string
-    comment                 string
-}
+/*
+ * Length of the random session ID issued by the server for each NetInstance, which is
+ *  hex encoded as the ClientIdString
+ */
+const SESSION_ID_SIZE       = 16
 
 /*
  * NOTE: this function is not implemented
@@ -68,36 +73,65 @@ var (
     ERROR_SERVER_DOWN       = util.RetErrStr("server is down")
     ERROR_SERVER_UP         = util.RetErrStr("server is up")
     ERROR_INVALID_URI       = util.RetErrStr("invalid URI -- DNS resolve issue?")
-    ERROR_TERMINATE         = util.RetErrStr("client requested a terminate command")
+    ERROR_TERMINATE         = util.RetErrStr("circuit was terminated")
+    ERROR_NOT_CONNECTED     = util.RetErrStr("circuit is not connected")
 )
 
-func returnCommandString(flag FlagVal, config ProtocolConfig) ([]byte, error) {
-    var iCommands = []internalCommands{
-        {flags: FLAG_TEST_CONNECTION,
-            command: config.TestStream},
+/*
+ * Wakes a Read() that is blocked waiting for data, when data arrives or the circuit is
+ *  closed. At most one notification is held, so the reader must recheck its state
+ *  after every wakeup
+ */
+type readSignal chan struct{}
 
-        {flags: FLAG_CHECK_STREAM_DATA,
-            command: config.CheckStream},
+func newReadSignal() readSignal {
+    return make(readSignal, 1)
+}
 
-        {flags: FLAG_TERMINATE_CONNECTION,
-            command: config.TermConnect},
+func (f readSignal) notify() {
+    select {
+    case f <- struct{}{}:
+    default:
     }
+}
 
-    /* Internal commands are based on the FlagVal bit flag */
-    var output = func (flags FlagVal) []byte {
-        for k := range iCommands {
-            if (iCommands[k].flags & flags) > 0 {
-                return []byte(iCommands[k].command)
-            }
-        }
-        return nil
-    } (flag)
-
-    if output == nil {
-        return nil, util.RetErrStr("flag does not suppose a command string")
+/*
+ * Record counters for a circuit, returned by NetInstance.Stats() and NetChannelClient.Stats()
+ */
+type SessionStats struct {
+    RecordsSent             uint64
+    RecordsReceived         uint64
+    BytesSent               uint64
+    BytesReceived           uint64
+
+    /* Number of traffic key ratchets, in both directions */
+    Rekeys                  uint64
+
+    /* Records that were dropped, see ERROR_REPLAY and ERROR_RECORD_AUTH */
+    ReplaysRejected         uint64
+    RecordsRejected         uint64
+}
+
+func collectStats(tx *trafficState, rx *trafficState) (stats SessionStats) {
+    if tx == nil || rx == nil {
+        return
     }
 
-    return output, nil
+    tx.lock.Lock()
+    stats.RecordsSent       = tx.records
+    stats.BytesSent         = tx.bytes
+    stats.Rekeys            = uint64(tx.epoch)
+    tx.lock.Unlock()
+
+    rx.lock.Lock()
+    stats.RecordsReceived   = rx.records
+    stats.BytesReceived     = rx.bytes
+    stats.Rekeys            += uint64(rx.epoch)
+    stats.ReplaysRejected   = rx.replays
+    stats.RecordsRejected   = rx.rejected
+    rx.lock.Unlock()
+
+    return
 }
 
 func (f *NetChannelService) sendDebug(s string) {
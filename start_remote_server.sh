@@ -6,5 +6,5 @@ JSON_CONFIG="`pwd`/config/remote.server.json"
 go clean
 go build
 
-go test -v $SRC_DIR/client.go $SRC_DIR/server.go $SRC_DIR/pke.go $SRC_DIR/config.go $SRC_DIR/shared.go $SRC_DIR/websock_test.go -args -config $JSON_CONFIG 
+go test -v $SRC_DIR/client.go $SRC_DIR/server.go $SRC_DIR/pke.go $SRC_DIR/config.go $SRC_DIR/shared.go $SRC_DIR/record.go $SRC_DIR/options.go $SRC_DIR/auth.go $SRC_DIR/keyschedule.go $SRC_DIR/resume.go $SRC_DIR/handshake.go $SRC_DIR/keylog.go $SRC_DIR/frame.go $SRC_DIR/negotiate.go $SRC_DIR/fragment.go $SRC_DIR/conn.go $SRC_DIR/listener.go $SRC_DIR/control.go $SRC_DIR/compress.go $SRC_DIR/transport.go $SRC_DIR/websocket.go $SRC_DIR/tls.go $SRC_DIR/proxy.go $SRC_DIR/websock_test.go -args -config $JSON_CONFIG 
 
@@ -0,0 +1,124 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package websock
+
+import (
+    "crypto/sha256"
+    "crypto/tls"
+    "crypto/x509"
+    "encoding/hex"
+
+    "github.com/AlexRuzin/util"
+)
+
+/************************************************************
+ * TLS on the gate transport                                *
+ ************************************************************/
+
+/*
+ * A gate URI may use the https scheme, for deployments behind infrastructure that
+ *  requires it. TLS only wraps the HTTP transport, and the circuit is still encrypted
+ *  and authenticated with its own key exchange and traffic keys, so a TLS terminating
+ *  proxy sees nothing but sealed records.
+ *
+ * The client verifies the server certificate as configured by WithTLSConfig, against
+ *  the system roots by default. WithPinnedSPKI additionally requires a certificate of
+ *  the verified chain to carry one of the pinned public keys, identified by
+ *  SPKIFingerprint(). A server with a self-signed certificate may be trusted by its pin
+ *  alone, by combining the pin with InsecureSkipVerify in the tls.Config, in which case
+ *  only the leaf certificate is matched against the pins.
+ *
+ * The server serves TLS on its listener once WithServiceTLS or WithServiceTLSConfig is
+ *  passed to CreateServer. With FLAG_H2C, HTTP/2 is negotiated over TLS by ALPN.
+ */
+var ERROR_SPKI_MISMATCH         = util.RetErrStr("server certificate does not match a pinned public key")
+
+/* Hex encoded SHA-256 of the SubjectPublicKeyInfo of a certificate, see WithPinnedSPKI */
+func SPKIFingerprint(cert *x509.Certificate) string {
+    sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+    return hex.EncodeToString(sum[:])
+}
+
+/* Applies the TLS options to the transport once every option has been set */
+func (f *NetChannelClient) configureTLS() error {
+    if f.controllerURL.Scheme != "https" {
+        if f.tlsConfig != nil || len(f.pinnedSPKI) != 0 {
+            return util.RetErrStr("TLS options require an https gate URI")
+        }
+        return nil
+    }
+
+    var config = &tls.Config{}
+    if f.tlsConfig != nil {
+        config = f.tlsConfig.Clone()
+    }
+
+    if len(f.pinnedSPKI) != 0 {
+        var (
+            pins        = f.pinnedSPKI
+            verify      = config.VerifyConnection
+        )
+        config.VerifyConnection = func(state tls.ConnectionState) error {
+            if verify != nil {
+                if err := verify(state); err != nil {
+                    return err
+                }
+            }
+            return verifySPKI(state, pins)
+        }
+    }
+
+    f.transport.TLSClientConfig = config
+    return nil
+}
+
+/*
+ * The server may present any certificate after its leaf, so only the verified chains are
+ *  matched. Without verification nothing ties the rest of the chain to the leaf, and only
+ *  the leaf itself is matched
+ */
+func verifySPKI(state tls.ConnectionState, pins []string) error {
+    var candidates []*x509.Certificate
+    switch {
+    case len(state.VerifiedChains) != 0:
+        for _, chain := range state.VerifiedChains {
+            candidates = append(candidates, chain...)
+        }
+    case len(state.PeerCertificates) != 0:
+        candidates = state.PeerCertificates[:1]
+    }
+
+    for _, cert := range candidates {
+        var fingerprint = SPKIFingerprint(cert)
+        for _, pin := range pins {
+            if fingerprint == pin {
+                return nil
+            }
+        }
+    }
+
+    return ERROR_SPKI_MISMATCH
+}
+
+/* EOF */
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package websock
+
+import (
+    "net"
+    "net/http"
+    "time"
+)
+
+/************************************************************
+ * HTTP connection reuse                                    *
+ ************************************************************/
+
+/*
+ * Every NetChannelClient holds a single http.Transport for its lifetime, so that the key
+ *  exchange, polls and writes of a circuit reuse the same keep-alive connections rather
+ *  than paying for a TCP setup per request. The poll remains outstanding on one
+ *  connection while a Write() is sent on another, so at most MAX_IDLE_CONNS connections
+ *  are kept open to the server.
+ *
+ * The server holds an idle connection for SERVER_IDLE_TIMEOUT, longer than the client
+ *  keeps one for CLIENT_IDLE_TIMEOUT, so that the client never sends a request on a
+ *  connection that the server is about to close. Data queued on a NetInstance is only
+ *  returned in answer to a poll, so that it arrives in order whichever connection
+ *  carries it.
+ *
+ * With FLAG_H2C, the client speaks HTTP/2 over cleartext TCP with prior knowledge (h2c),
+ *  so the poll and every Write() are concurrent streams over a single connection. A
+ *  server with FLAG_H2C accepts h2c alongside HTTP/1.1, so clients with and without the
+ *  flag may connect to it, but a client with FLAG_H2C requires a server that sets it.
+ *  Over TLS, the flag negotiates HTTP/2 by ALPN instead, see tls.go.
+ */
+const (
+    MAX_IDLE_CONNS              = 4
+    CLIENT_IDLE_TIMEOUT         = 30 * time.Second
+    SERVER_IDLE_TIMEOUT         = 90 * time.Second
+    DIAL_TIMEOUT                = 30 * time.Second
+)
+
+func newTransport(flags FlagVal) *http.Transport {
+    var dialer = &net.Dialer{
+        Timeout:    DIAL_TIMEOUT,
+        KeepAlive:  CLIENT_IDLE_TIMEOUT,
+    }
+
+    var transport = &http.Transport{
+        DialContext:            dialer.DialContext,
+        MaxIdleConns:           MAX_IDLE_CONNS,
+        MaxIdleConnsPerHost:    MAX_IDLE_CONNS,
+        IdleConnTimeout:        CLIENT_IDLE_TIMEOUT,
+
+        /* Records are already compressed, see compress.go */
+        DisableCompression:     true,
+    }
+
+    if (flags & FLAG_H2C) > 0 {
+        transport.Protocols = new(http.Protocols)
+        transport.Protocols.SetUnencryptedHTTP2(true)
+        transport.Protocols.SetHTTP2(true)
+    }
+
+    return transport
+}
+
+func newHTTPServer(flags FlagVal, handler http.Handler) *http.Server {
+    var server = &http.Server{
+        Handler:                handler,
+        IdleTimeout:            SERVER_IDLE_TIMEOUT,
+    }
+
+    if (flags & FLAG_H2C) > 0 {
+        server.Protocols = new(http.Protocols)
+        server.Protocols.SetHTTP1(true)
+        server.Protocols.SetUnencryptedHTTP2(true)
+        server.Protocols.SetHTTP2(true)
+    }
+
+    return server
+}
+
+/* EOF */
@@ -24,6 +24,7 @@ package websock
 
 import (
     "os"
+    "syscall"
     "flag"
     "testing"
     "errors"
@@ -31,10 +32,31 @@ import (
     "sync/atomic"
     "time"
     "io"
+    "net"
+    "bytes"
+    "context"
+    "strings"
+    "net/url"
+    "net/http"
+    "net/http/httptest"
+    "net/http/httputil"
+    "slices"
+    "math/big"
+    "crypto/tls"
+    "crypto/rand"
+    "crypto/ecdsa"
+    "crypto/x509"
+    "crypto/mlkem"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "encoding/hex"
+    "encoding/binary"
+    "encoding/base64"
     "encoding/json"
     "io/ioutil"
 
     "github.com/AlexRuzin/util"
+    "github.com/gorilla/websocket"
 )
 
 /*
@@ -43,8 +65,6 @@ import (
  */
 const JSON_FILENAME                 string = "config/config.json"
 
-const DEFAULT_RX_WAIT_DURATION      time.Duration = 5000 /* milliseconds */
-
 /*
  * For example, the config.json file uses the following key/value structure:
  *
@@ -397,7 +417,7 @@ func clientTX(config ConfigInput) {
     func () {
         if config.ClientTX == true {
             go func(config ConfigInput) {
-                if mainClient.connected == false {
+                if !mainClient.connected.Load() {
                     panic("Failed to connect to server")
                 }
 
@@ -437,14 +457,16 @@ func clientTX(config ConfigInput) {
 
     /* Receive data */
     go func (config ConfigInput) {
+        var rawData = make([]byte, 65536)
         for {
-            if incomingLength, rxStatus := mainClient.Wait(DEFAULT_RX_WAIT_DURATION); rxStatus == WAIT_DATA_RECEIVED {
-                rawData := make([]byte, incomingLength)
-                mainClient.Read(rawData)
-                D(" (" + util.IntToString(int(clientDebugCounter)) + ") from server to client (receive): (" +
-                    util.IntToString(incomingLength) + " bytes): " + string(rawData))
-                atomic.AddInt32(&clientDebugCounter, 1)
+            incomingLength, err := mainClient.Read(rawData)
+            if err != nil {
+                D("client read terminated: " + err.Error())
+                return
             }
+            D(" (" + util.IntToString(int(clientDebugCounter)) + ") from server to client (receive): (" +
+                util.IntToString(incomingLength) + " bytes): " + string(rawData[:incomingLength]))
+            atomic.AddInt32(&clientDebugCounter, 1)
         }
     } (config)
 }
@@ -501,16 +523,16 @@ func serverTX(config ConfigInput) {
             go func(client *NetInstance) {
                 //atomic.AddInt32(&totalReadThreads, 1)
 
+                var rawData = make([]byte, 65536)
                 for {
-                    if incomingLength, rxStatus := v.Wait(DEFAULT_RX_WAIT_DURATION); rxStatus == WAIT_DATA_RECEIVED {
-                        rawData := make([]byte, incomingLength)
-                        v.Read(rawData)
-                        D(" (" + util.IntToString(int(serverDebugCounter)) +") from client to server: (receive)(" +
-                            util.IntToString(incomingLength) + " bytes): " + string(rawData))
-                        atomic.AddInt32(&serverDebugCounter, 1)
+                    incomingLength, err := client.Read(rawData)
+                    if err != nil {
+                        D("[" + client.ClientIdString + "] server read terminated: " + err.Error())
+                        return
                     }
-
-                    util.Sleep(100 * time.Millisecond)
+                    D(" (" + util.IntToString(int(serverDebugCounter)) +") from client to server: (receive)(" +
+                        util.IntToString(incomingLength) + " bytes): " + string(rawData[:incomingLength]))
+                    atomic.AddInt32(&serverDebugCounter, 1)
                 }
 
                 //atomic.AddInt32(&totalReadThreads, -1)
@@ -543,12 +565,7 @@ func transmitRawData(minLen uint, maxLen uint, staticData bool, handler func(p [
     }
 
     /* Invoke the transmit method */
-    var txStatus = handler(rawData)
-    if txStatus != io.EOF {
-        return txStatus
-    }
-
-    return nil
+    return handler(rawData)
 }
 
 func handlerClientTx(p []byte) error {
@@ -557,15 +574,15 @@ func handlerClientTx(p []byte) error {
     atomic.AddInt32(&clientDebugCounter, 1)
 
     txLen, err := mainClient.Write(p)
-    if err != io.EOF {
+    if err != nil {
         return err
     }
 
     if txLen != len(p) {
-        return errors.New("handlerClientTx() reports unexpected EOF in write stream")
+        return errors.New("handlerClientTx() reports a short write")
     }
 
-    return io.EOF
+    return nil
 }
 
 func handlerServerTx(p []byte) error {
@@ -573,7 +590,7 @@ func handlerServerTx(p []byte) error {
     for _, v := range mainServer.clientMap {
         //D("transmitting data to client: " + v.ClientIdString)
         txLen, writeStatus := v.Write(p)
-        if writeStatus != io.EOF {
+        if writeStatus != nil {
             return writeStatus
         }
         D(" (" + util.IntToString(int(serverDebugCounter)) + ") server to client (transmit) [" +
@@ -581,11 +598,2147 @@ func handlerServerTx(p []byte) error {
         atomic.AddInt32(&serverDebugCounter, 1)
 
         if txLen != len(p) {
-            return errors.New("handlerServerTx() reports unexpected EOF in write stream")
+            return errors.New("handlerServerTx() reports a short write")
+        }
+    }
+
+    return nil
+}
+
+func TestRecordTamper(t *testing.T) {
+    for _, suite := range []CipherSuite{CIPHER_AES256_GCM, CIPHER_CHACHA20_POLY1305} {
+        var secret = newTrafficState(make([]byte, trafficKeySize), defaultRekeyLimits())
+        encrypted, err := encryptData([]byte("tamper test"), secret, suite, FLAG_DIRECTION_TO_SERVER, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if data, _, err := decryptData(util.B64E(encrypted), secret, suite,
+            FLAG_DIRECTION_TO_SERVER); err != nil || string(data) != "tamper test" {
+            t.Fatalf("%s: round trip failed: %v", suite, err)
+        }
+
+        /* Reflected back at the sender */
+        if _, _, err := decryptData(util.B64E(encrypted), secret, suite,
+            FLAG_DIRECTION_TO_CLIENT); err != ERROR_RECORD_AUTH {
+            t.Fatalf("%s: reflected record accepted: %v", suite, err)
+        }
+
+        /* Opened as if the circuit had negotiated the other suite */
+        var other = CIPHER_AES256_GCM
+        if suite == other {
+            other = CIPHER_CHACHA20_POLY1305
+        }
+        if _, _, err := decryptData(util.B64E(encrypted), secret, other,
+            FLAG_DIRECTION_TO_SERVER); err != ERROR_RECORD_SUITE_MISMATCH {
+            t.Fatalf("%s: record accepted under %s: %v", suite, other, err)
+        }
+
+        encrypted[len(encrypted) - 1] ^= 0x01
+        if _, _, err := decryptData(util.B64E(encrypted), secret, suite,
+            FLAG_DIRECTION_TO_SERVER); err != ERROR_RECORD_AUTH {
+            t.Fatalf("%s: modified record accepted: %v", suite, err)
+        }
+    }
+}
+
+func TestRekeyRatchet(t *testing.T) {
+    var (
+        key         = make([]byte, trafficKeySize)
+        sender      = newTrafficState(key, rekeyLimits{bytes: 64})
+        receiver    = newTrafficState(key, rekeyLimits{})
+        inFlight    []byte
+    )
+
+    for i := 0; i != 8; i += 1 {
+        record, err := sender.seal(make([]byte, 48), CIPHER_AES256_GCM, FLAG_DIRECTION_TO_CLIENT)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        /* Hold back the last record of epoch 1, and deliver it after the switch to epoch 2 */
+        if i == 3 {
+            inFlight = record
+            continue
+        }
+        if _, err := receiver.open(record, CIPHER_AES256_GCM, FLAG_DIRECTION_TO_CLIENT); err != nil {
+            t.Fatalf("record %d: %v", i, err)
+        }
+
+        if i == 4 {
+            if _, err := receiver.open(inFlight, CIPHER_AES256_GCM, FLAG_DIRECTION_TO_CLIENT); err != nil {
+                t.Fatalf("in-flight record: %v", err)
+            }
+        }
+    }
+
+    if sender.epoch != 3 || receiver.epoch != sender.epoch {
+        t.Fatalf("unexpected epochs: sender %d, receiver %d", sender.epoch, receiver.epoch)
+    }
+}
+
+func TestReplayWindow(t *testing.T) {
+    var (
+        key         = make([]byte, trafficKeySize)
+        sender      = newTrafficState(key, rekeyLimits{})
+        receiver    = newTrafficState(key, rekeyLimits{})
+        records     []string
+    )
+
+    for i := 0; i != REPLAY_WINDOW_SIZE + 3; i += 1 {
+        record, err := encryptData([]byte("replay"), sender, CIPHER_AES256_GCM, FLAG_DIRECTION_TO_CLIENT, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+        records = append(records, util.B64E(record))
+    }
+
+    /* Deliver the second record before the first, then replay both */
+    for _, k := range []int{1, 0} {
+        if _, _, err := decryptData(records[k], receiver, CIPHER_AES256_GCM, FLAG_DIRECTION_TO_CLIENT); err != nil {
+            t.Fatalf("record %d: %v", k, err)
+        }
+    }
+    for _, k := range []int{0, 1} {
+        if _, _, err := decryptData(records[k], receiver, CIPHER_AES256_GCM, FLAG_DIRECTION_TO_CLIENT); err != ERROR_REPLAY {
+            t.Fatalf("replayed record %d: expected ERROR_REPLAY, got %v", k, err)
+        }
+    }
+
+    /* Once the window has moved past record 2, it is rejected even though it was never seen */
+    if _, _, err := decryptData(records[len(records) - 1], receiver, CIPHER_AES256_GCM, FLAG_DIRECTION_TO_CLIENT); err != nil {
+        t.Fatal(err)
+    }
+    if _, _, err := decryptData(records[2], receiver, CIPHER_AES256_GCM, FLAG_DIRECTION_TO_CLIENT); err != ERROR_REPLAY {
+        t.Fatalf("stale record: expected ERROR_REPLAY, got %v", err)
+    }
+
+    var stats = collectStats(sender, receiver)
+    if stats.RecordsSent != uint64(len(records)) || stats.RecordsReceived != 3 || stats.ReplaysRejected != 3 {
+        t.Fatalf("unexpected stats: %+v", stats)
+    }
+}
+
+func TestResumptionTicket(t *testing.T) {
+    var service = &NetChannelService{
+        clientMap:          make(map[string]*NetInstance),
+        ticketKey:          make([]byte, trafficKeySize),
+        ticketLifetime:     DEFAULT_TICKET_LIFETIME,
+    }
+    var (
+        instance    = &NetInstance{ClientIdString: "resumed"}
+        secret      = []byte("resumption secret")
+        transcript  = []byte("transcript")
+    )
+    service.clientMap[instance.ClientIdString] = instance
+
+    var client = &NetChannelClient{
+        ticket:             service.issueTicket(instance.ClientIdString, secret, instance.generation()),
+        resumptionSecret:   secret,
+    }
+    if found, err := service.verifyResumption(client.genClientAuth(transcript), transcript); err != nil || found != instance {
+        t.Fatalf("valid ticket: %v", err)
+    }
+
+    /* A ticket is only redeemed once, a replay of the same proof is refused */
+    if _, err := service.verifyResumption(client.genClientAuth(transcript), transcript); err != ERROR_TICKET_INVALID {
+        t.Fatalf("replayed ticket: expected ERROR_TICKET_INVALID, got %v", err)
+    }
+    client.ticket = service.issueTicket(instance.ClientIdString, secret, instance.generation())
+    if found, err := service.verifyResumption(client.genClientAuth(transcript), transcript); err != nil || found != instance {
+        t.Fatalf("ticket of the next generation: %v", err)
+    }
+
+    /* A proof for another exchange, a forged ticket, or a closed NetInstance */
+    if _, err := service.verifyResumption(client.genClientAuth(transcript), []byte("other")); err != ERROR_TICKET_INVALID {
+        t.Fatalf("wrong transcript: expected ERROR_TICKET_INVALID, got %v", err)
+    }
+    client.ticket[len(client.ticket) - 1] ^= 1
+    if _, err := service.verifyResumption(client.genClientAuth(transcript), transcript); err != ERROR_TICKET_INVALID {
+        t.Fatalf("forged ticket: expected ERROR_TICKET_INVALID, got %v", err)
+    }
+    client.ticket = service.issueTicket(instance.ClientIdString, secret, instance.generation())
+    delete(service.clientMap, instance.ClientIdString)
+    if _, err := service.verifyResumption(client.genClientAuth(transcript), transcript); err != ERROR_TICKET_INVALID {
+        t.Fatalf("closed instance: expected ERROR_TICKET_INVALID, got %v", err)
+    }
+
+    /* The keys of a resumption are only installed once the client seals a record under them */
+    var (
+        oldKey      = bytes.Repeat([]byte{1}, trafficKeySize)
+        newKey      = bytes.Repeat([]byte{2}, trafficKeySize)
+        negotiated  = Capabilities{PROTOCOL_VERSION, CIPHER_AES256_GCM, COMPRESSION_NONE, MIN_FRAME_SIZE}
+        seal        = func(key []byte) []byte {
+            record, err := encryptFragment([]byte("record"), nil, newTrafficState(key, defaultRekeyLimits()),
+                CIPHER_AES256_GCM, FLAG_DIRECTION_TO_SERVER, 0)
+            if err != nil {
+                t.Fatal(err)
+            }
+            return record
+        }
+    )
+    instance = &NetInstance{negotiated: negotiated, rxKey: newTrafficState(oldKey, defaultRekeyLimits())}
+    var rxKey = newTrafficState(newKey, defaultRekeyLimits())
+    instance.resume(CURVE_X25519, false, &negotiated, newTrafficState(newKey, defaultRekeyLimits()), rxKey)
+    if _, _, current := instance.session(); current == rxKey {
+        t.Fatalf("keys were installed before the client used them")
+    }
+    if _, _, _, err := instance.openClientRecord(seal(oldKey)); err != nil {
+        t.Fatalf("the circuit did not continue under the previous keys: %v", err)
+    }
+    if _, _, _, err := instance.openClientRecord(seal(newKey)); err != nil || instance.curve != CURVE_X25519 {
+        t.Fatalf("record under the new keys: %v", err)
+    }
+    if _, _, current := instance.session(); current != rxKey {
+        t.Fatalf("keys were not installed once the client used them")
+    }
+    if _, _, _, err := instance.openClientRecord(seal(oldKey)); err == nil {
+        t.Fatalf("previous keys are still accepted")
+    }
+}
+
+/* A resumption replaces the keys of a NetInstance that is in use, run with -race */
+func TestResumeDuringIO(t *testing.T) {
+    var (
+        key         = make([]byte, trafficKeySize)
+        negotiated  = Capabilities{PROTOCOL_VERSION, CIPHER_AES256_GCM, COMPRESSION_NONE, MIN_FRAME_SIZE}
+        instance    = &NetInstance{
+            service:    &NetChannelService{},
+            negotiated: negotiated,
+            txKey:      newTrafficState(key, defaultRekeyLimits()),
+            rxKey:      newTrafficState(key, defaultRekeyLimits()),
+            clientTX:   &bytes.Buffer{},
+            rxSignal:   newReadSignal(),
+            txSignal:   newReadSignal(),
+        }
+        done        = make(chan struct{})
+    )
+    go func() {
+        defer close(done)
+        for i := 0; i != 100; i += 1 {
+            instance.resume(CURVE_P384, false, &negotiated, newTrafficState(key, defaultRekeyLimits()),
+                newTrafficState(key, defaultRekeyLimits()))
+            record, err := encryptFragment([]byte("resumed"), nil, newTrafficState(key, defaultRekeyLimits()),
+                CIPHER_AES256_GCM, FLAG_DIRECTION_TO_SERVER, 0)
+            if err == nil {
+                _, _, _, err = instance.openClientRecord(record)
+            }
+            if err != nil {
+                t.Errorf("openClientRecord: %v", err)
+                return
+            }
+        }
+    } ()
+
+    for i := 0; i != 100; i += 1 {
+        instance.Write([]byte("queued"))
+        if encrypted, err := instance.nextQueued(); err != nil || encrypted == nil {
+            t.Fatalf("nextQueued: %v", err)
+        }
+        instance.Stats()
+    }
+    <-done
+}
+
+func TestSessionIdCollision(t *testing.T) {
+    var service = &NetChannelService{
+        clientMap:          make(map[string]*NetInstance),
+    }
+
+    sessionId, err := service.reserveSessionId()
+    if err != nil || len(sessionId) != SESSION_ID_SIZE {
+        t.Fatalf("reserveSessionId: %v", err)
+    }
+
+    /* A reserved ID is not visible until the NetInstance is registered, and is only registered once */
+    var first = &NetInstance{ClientIdString: hex.EncodeToString(sessionId)}
+    if service.lookupClient(first.ClientIdString) != nil {
+        t.Fatal("reserved session ID resolves to a NetInstance")
+    }
+    if err := service.registerClient(first); err != nil {
+        t.Fatal(err)
+    }
+    var second = &NetInstance{ClientIdString: first.ClientIdString}
+    if err := service.registerClient(second); err != ERROR_SESSION_ID_COLLISION {
+        t.Fatalf("expected ERROR_SESSION_ID_COLLISION, got %v", err)
+    }
+    if service.lookupClient(first.ClientIdString) != first {
+        t.Fatal("existing NetInstance was overwritten")
+    }
+
+    /* Neither an unreserved ID, nor closing a NetInstance that was refused, affects clientMap */
+    if err := service.registerClient(&NetInstance{ClientIdString: "unreserved"}); err != ERROR_SESSION_ID_COLLISION {
+        t.Fatalf("expected ERROR_SESSION_ID_COLLISION, got %v", err)
+    }
+    service.closeClient(second)
+    if service.lookupClient(first.ClientIdString) != first {
+        t.Fatal("existing NetInstance was closed")
+    }
+}
+
+func TestHandshakeParsing(t *testing.T) {
+    message, err := encodeHandshake(HS_CLIENT_HELLO,
+        handshakeField{HS_FIELD_CURVE, []byte{byte(CURVE_X25519)}},
+        handshakeField{HS_FIELD_PUBLIC_KEY, make([]byte, CURVE_X25519.publicKeySize())},
+        handshakeField{HS_FIELD_CLIENT_AUTH, nil})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    hello, length, err := parseHandshake(message, HS_CLIENT_HELLO)
+    if err != nil || length != len(message) {
+        t.Fatalf("parseHandshake: %v", err)
+    }
+    if _, err := hello.field(HS_FIELD_PUBLIC_KEY, CURVE_X25519.publicKeySize()); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := hello.field(HS_FIELD_PUBLIC_KEY, CURVE_P384.publicKeySize()); err != ERROR_HANDSHAKE_MALFORMED {
+        t.Fatalf("wrong field size: expected ERROR_HANDSHAKE_MALFORMED, got %v", err)
+    }
+    if hello.optional(HS_FIELD_CLIENT_AUTH) != nil {
+        t.Fatal("omitted field is present")
+    }
+
+    /* Every truncation of the message must be refused, rather than panic */
+    for i := 0; i != len(message); i += 1 {
+        if _, _, err := parseHandshake(message[:i], HS_CLIENT_HELLO); err == nil {
+            t.Fatalf("truncated to %d bytes: accepted", i)
+        }
+    }
+
+    var tampered = append([]byte{}, message...)
+    tampered[0] = HANDSHAKE_VERSION + 1
+    if _, _, err := parseHandshake(tampered, HS_CLIENT_HELLO); err != ERROR_HANDSHAKE_VERSION {
+        t.Fatalf("version: expected ERROR_HANDSHAKE_VERSION, got %v", err)
+    }
+    if _, _, err := parseHandshake(message, HS_SERVER_HELLO); err != ERROR_HANDSHAKE_MALFORMED {
+        t.Fatalf("message type: expected ERROR_HANDSHAKE_MALFORMED, got %v", err)
+    }
+
+    duplicate, _ := encodeHandshake(HS_CLIENT_HELLO,
+        handshakeField{HS_FIELD_CURVE, []byte{byte(CURVE_X25519)}},
+        handshakeField{HS_FIELD_CURVE, []byte{byte(CURVE_P384)}})
+    if _, _, err := parseHandshake(duplicate, HS_CLIENT_HELLO); err != ERROR_HANDSHAKE_MALFORMED {
+        t.Fatalf("duplicate field: expected ERROR_HANDSHAKE_MALFORMED, got %v", err)
+    }
+
+    if _, _, err := parseClientHello(util.B64E(append(message, 0))); err != ERROR_HANDSHAKE_MALFORMED {
+        t.Fatalf("trailing data: expected ERROR_HANDSHAKE_MALFORMED, got %v", err)
+    }
+}
+
+/* Serves a gate on a loopback port, and returns the gate URI */
+func newTestGate(t testing.TB, flags FlagVal, options ...ServiceOption) (*NetChannelService, string) {
+    var pathGate = "/gate.php"
+    service, err := CreateServer(pathGate, 0, FLAG_ENCRYPT | flags, nil, options...)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { service.Close() })
+
+    return service, "http://" + service.Addr().String() + pathGate
+}
+
+/* Sends message from the client to the server, and back */
+func roundTrip(t testing.TB, client *NetChannelClient, conn net.Conn, message []byte) {
+    var buffer = make([]byte, len(message))
+    client.SetReadDeadline(time.Now().Add(5 * time.Second))
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+    if _, err := client.Write(message); err != nil {
+        t.Fatalf("client Write: %v", err)
+    }
+    if _, err := io.ReadFull(conn, buffer); err != nil || !bytes.Equal(buffer, message) {
+        t.Fatalf("server did not receive the message: %v", err)
+    }
+    if _, err := conn.Write(message); err != nil {
+        t.Fatalf("server Write: %v", err)
+    }
+    if _, err := io.ReadFull(client, buffer); err != nil || !bytes.Equal(buffer, message) {
+        t.Fatalf("client did not receive the message: %v", err)
+    }
+}
+
+/* Nothing that failed its key exchange may reach Accept() */
+func expectNoneAccepted(t testing.TB, service *NetChannelService) {
+    if len(service.accepted) != 0 {
+        t.Fatalf("a refused client was queued for Accept")
+    }
+}
+
+func TestCurveNegotiation(t *testing.T) {
+    service, gateURI := newTestGate(t, 0, WithAllowedCurves(CURVE_P384, CURVE_X25519))
+
+    /* X25519 from the client hello to data in both directions */
+    client, err := BuildChannel(gateURI, FLAG_ENCRYPT, WithCurve(CURVE_X25519))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := client.InitializeCircuit(); err != nil {
+        t.Fatalf("X25519 key exchange: %v", err)
+    }
+    defer client.Close()
+    conn, err := service.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if curve := conn.(*NetInstance).curve; curve != CURVE_X25519 {
+        t.Fatalf("expected the circuit to use X25519, got %s", curve)
+    }
+    roundTrip(t, client, conn, []byte("x25519"))
+
+    /* P-256 is supported, but not permitted by this server */
+    refused, err := BuildChannel(gateURI, FLAG_ENCRYPT, WithCurve(CURVE_P256))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := refused.InitializeCircuit(); err == nil || !strings.Contains(err.Error(), ERROR_CURVE_NOT_ALLOWED.Error()) {
+        t.Fatalf("expected the server to refuse P-256, got %v", err)
+    }
+    expectNoneAccepted(t, service)
+}
+
+/*
+ * Removes tag from the b64 encoded handshake message of type msgType, and returns it
+ *  encoded again. Returns "" if encoded does not start with such a message
+ */
+func stripHandshakeField(encoded string, msgType byte, tag byte) string {
+    decoded, err := util.B64D(encoded)
+    if err != nil {
+        return ""
+    }
+    message, length, err := parseHandshake(decoded, msgType)
+    if err != nil {
+        return ""
+    }
+
+    var fields []handshakeField
+    for fieldTag, value := range message.fields {
+        if fieldTag != tag {
+            fields = append(fields, handshakeField{fieldTag, value})
+        }
+    }
+    stripped, _ := encodeHandshake(msgType, fields...)
+    return util.B64E(append(stripped, decoded[length:]...))
+}
+
+func TestServerIdentity(t *testing.T) {
+    _, signingKey, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+    var serverKey = signingKey.Public().(ed25519.PublicKey)
+    _, gateURI := newTestGate(t, 0, WithSigningKey(signingKey))
+    gateURL, _ := url.Parse(gateURI)
+
+    /* A man-in-the-middle that strips the identity block from HS_SERVER_HELLO */
+    var strip = httputil.NewSingleHostReverseProxy(&url.URL{Scheme: gateURL.Scheme, Host: gateURL.Host})
+    strip.ModifyResponse = func(response *http.Response) error {
+        body, err := io.ReadAll(response.Body)
+        if err != nil {
+            return err
+        }
+        if stripped := stripHandshakeField(string(body), HS_SERVER_HELLO, HS_FIELD_SERVER_IDENTITY); stripped != "" {
+            body = []byte(stripped)
+        }
+        response.Body = io.NopCloser(bytes.NewReader(body))
+        response.ContentLength = int64(len(body))
+        response.Header.Del("Content-Length")
+        return nil
+    }
+    var mitm = httptest.NewServer(strip)
+    defer mitm.Close()
+    var mitmURI = mitm.URL + gateURL.Path
+
+    var tests = []struct{
+        name        string
+        uri         string
+        option      ChannelOption
+        expected    error
+    }{
+        {"pinned key", gateURI, WithPinnedServerKey(serverKey), nil},
+        {"pinned fingerprint", gateURI, WithServerFingerprint(KeyFingerprint(serverKey)), nil},
+        {"wrong key", gateURI, WithPinnedServerKey(otherKey), ERROR_SERVER_AUTH},
+        {"wrong fingerprint", gateURI, WithServerFingerprint(KeyFingerprint(otherKey)), ERROR_SERVER_AUTH},
+        {"stripped identity", mitmURI, WithPinnedServerKey(serverKey), ERROR_SERVER_AUTH},
+        {"stripped identity, fingerprint", mitmURI, WithServerFingerprint(KeyFingerprint(serverKey)),
+            ERROR_SERVER_AUTH},
+    }
+    for _, test := range tests {
+        client, err := BuildChannel(test.uri, FLAG_ENCRYPT, test.option)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if err := client.InitializeCircuit(); err != test.expected {
+            t.Fatalf("%s: expected %v, got %v", test.name, test.expected, err)
+        }
+        client.Close()
+    }
+
+    /* A valid identity block, replayed into another key exchange */
+    var (
+        client          = &NetChannelClient{serverKey: serverKey}
+        transcript      = serverSignatureTranscript(CURVE_P384, []byte("client"), []byte("server"), []byte("id"))
+        identity        = signServerIdentity(signingKey, transcript)
+    )
+    if err := client.verifyServerIdentity(identity, transcript); err != nil {
+        t.Fatalf("valid identity refused: %v", err)
+    }
+    transcript = serverSignatureTranscript(CURVE_P384, []byte("client"), []byte("server"), []byte("other id"))
+    if err := client.verifyServerIdentity(identity, transcript); err != ERROR_SERVER_AUTH {
+        t.Fatalf("replayed identity: expected ERROR_SERVER_AUTH, got %v", err)
+    }
+}
+
+func TestHybridKEM(t *testing.T) {
+    decapsulationKey, err := mlkem.GenerateKey768()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    serverSecret, ciphertext, err := encapsulateKEM(decapsulationKey.EncapsulationKey().Bytes())
+    if err != nil {
+        t.Fatal(err)
+    }
+    clientSecret, err := decapsulationKey.Decapsulate(ciphertext)
+    if err != nil || !bytes.Equal(clientSecret, serverSecret) {
+        t.Fatalf("ML-KEM secrets do not match: %v", err)
+    }
+
+    if _, _, err := encapsulateKEM(make([]byte, 32)); err == nil {
+        t.Fatal("malformed encapsulation key accepted")
+    }
+}
+
+/* Both sides run the key exchange, and the circuit carries data both ways */
+func hybridExchange(t *testing.T, gateURI string, service *NetChannelService, flags FlagVal) *NetChannelClient {
+    client, err := BuildChannel(gateURI, FLAG_ENCRYPT | flags)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := client.InitializeCircuit(); err != nil {
+        t.Fatalf("key exchange: %v", err)
+    }
+    t.Cleanup(func() { client.Close() })
+    conn, err := service.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if client.PostQuantum() != conn.(*NetInstance).PostQuantum() {
+        t.Fatalf("client and server disagree on the hybrid exchange")
+    }
+    roundTrip(t, client, conn, []byte("hybrid"))
+
+    return client
+}
+
+func TestHybridHandshake(t *testing.T) {
+    var tests = []struct{
+        name        string
+        server      FlagVal
+        client      FlagVal
+        postQuantum bool
+    }{
+        {"both hybrid", FLAG_HYBRID_MLKEM, FLAG_HYBRID_MLKEM, true},
+        {"classic server", 0, FLAG_HYBRID_MLKEM, false},
+        {"classic client", FLAG_HYBRID_MLKEM, 0, false},
+        {"both classic", 0, 0, false},
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            service, gateURI := newTestGate(t, test.server)
+            if client := hybridExchange(t, gateURI, service, test.client); client.PostQuantum() != test.postQuantum {
+                t.Fatalf("expected PostQuantum() %v, got %v", test.postQuantum, client.PostQuantum())
+            }
+        })
+    }
+}
+
+/* Stripping a KEM field in transit must not downgrade the circuit to the classic exchange */
+func TestHybridDowngrade(t *testing.T) {
+    _, gateURI := newTestGate(t, FLAG_HYBRID_MLKEM)
+    gateURL, _ := url.Parse(gateURI)
+    var proxy = httputil.NewSingleHostReverseProxy(&url.URL{Scheme: gateURL.Scheme, Host: gateURL.Host})
+
+    /* Strips HS_FIELD_KEM_KEY from the client hello, which is one of the form values */
+    var stripKey = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+        body, err := io.ReadAll(request.Body)
+        if err != nil {
+            http.Error(writer, err.Error(), http.StatusBadGateway)
+            return
+        }
+        if form, err := url.ParseQuery(string(body)); err == nil {
+            for key, values := range form {
+                if stripped := stripHandshakeField(values[0], HS_CLIENT_HELLO, HS_FIELD_KEM_KEY); stripped != "" {
+                    form.Set(key, stripped)
+                    body = []byte(form.Encode())
+                }
+            }
+        }
+        request.Body = io.NopCloser(bytes.NewReader(body))
+        request.ContentLength = int64(len(body))
+        proxy.ServeHTTP(writer, request)
+    })
+
+    /* Strips HS_FIELD_KEM_CIPHERTEXT from the server hello */
+    var stripCiphertext = httputil.NewSingleHostReverseProxy(&url.URL{Scheme: gateURL.Scheme, Host: gateURL.Host})
+    stripCiphertext.ModifyResponse = func(response *http.Response) error {
+        body, err := io.ReadAll(response.Body)
+        if err != nil {
+            return err
+        }
+        if stripped := stripHandshakeField(string(body), HS_SERVER_HELLO, HS_FIELD_KEM_CIPHERTEXT); stripped != "" {
+            body = []byte(stripped)
+        }
+        response.Body = io.NopCloser(bytes.NewReader(body))
+        response.ContentLength = int64(len(body))
+        response.Header.Del("Content-Length")
+        return nil
+    }
+
+    for name, handler := range map[string]http.Handler{"key": stripKey, "ciphertext": stripCiphertext} {
+        var mitm = httptest.NewServer(handler)
+        client, err := BuildChannel(mitm.URL + gateURL.Path, FLAG_ENCRYPT | FLAG_HYBRID_MLKEM)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if err := client.InitializeCircuit(); err != ERROR_KEY_CONFIRMATION {
+            t.Fatalf("stripped %s: expected ERROR_KEY_CONFIRMATION, got %v", name, err)
+        }
+        client.Close()
+        mitm.Close()
+    }
+}
+
+func TestKeyLog(t *testing.T) {
+    var (
+        keys        = &sessionKeys{
+            clientToServer: bytes.Repeat([]byte{1}, trafficKeySize),
+            serverToClient: bytes.Repeat([]byte{2}, trafficKeySize),
+        }
+        output      = &bytes.Buffer{}
+        sender      = newTrafficState(keys.serverToClient, rekeyLimits{bytes: 1})
+    )
+    (&keyLogWriter{writer: output}).log("session", keys)
+
+    keyLog, err := ParseKeyLog(io.MultiReader(strings.NewReader("# comment\n\nOTHER_LABEL x y\n"), output))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if sessions := keyLog.Sessions(); len(sessions) != 1 || sessions[0] != "session" {
+        t.Fatalf("unexpected sessions: %v", sessions)
+    }
+    if clientId, ok := keyLog.MatchParameter(util.B64E([]byte("session"))); !ok || clientId != "session" {
+        t.Fatal("MatchParameter did not match the logged circuit")
+    }
+
+    /* The second record is sealed after a rekey, under a key derived from the logged key */
+    for i := 0; i != 2; i += 1 {
+        encrypted, err := encryptData([]byte("logged"), sender, CIPHER_AES256_GCM, FLAG_DIRECTION_TO_CLIENT, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        record, err := keyLog.DecryptRecord("session", util.B64E(encrypted), false)
+        if err != nil {
+            t.Fatalf("record %d: %v", i, err)
+        }
+        if string(record.Data) != "logged" || record.Epoch != uint32(i) || record.Sequence != uint64(i + 1) {
+            t.Fatalf("record %d: unexpected contents %+v", i, record)
+        }
+        if _, err := keyLog.DecryptRecord("session", util.B64E(encrypted), true); err != ERROR_KEYLOG_NO_KEY {
+            t.Fatalf("record %d, wrong direction: expected ERROR_KEYLOG_NO_KEY, got %v", i, err)
+        }
+    }
+
+    /* The epoch in the header is only trusted up to maxEpochSkip past the highest one opened */
+    encrypted, err := encryptData([]byte("logged"), sender, CIPHER_AES256_GCM, FLAG_DIRECTION_TO_CLIENT, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, test := range []struct{
+        epoch       uint32
+        expected    error
+    }{
+        {1 + maxEpochSkip, ERROR_KEYLOG_NO_KEY},
+        {2 + maxEpochSkip, ERROR_RECORD_EPOCH},
+        {0xffffffff, ERROR_RECORD_EPOCH},
+    } {
+        var forged = append([]byte{}, encrypted...)
+        binary.BigEndian.PutUint32(forged[1:], test.epoch)
+        if _, err := keyLog.DecryptRecord("session", util.B64E(forged), false); err != test.expected {
+            t.Fatalf("epoch %d: expected %v, got %v", test.epoch, test.expected, err)
+        }
+    }
+
+    /* A compressed frame that does not decompress is reported, rather than returned as is */
+    encrypted, err = encryptData([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, sender, CIPHER_AES256_GCM,
+        FLAG_DIRECTION_TO_CLIENT, FLAG_COMPRESS)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if record, err := keyLog.DecryptRecord("session", util.B64E(encrypted), false); err == nil ||
+        err == ERROR_KEYLOG_NO_KEY {
+        t.Fatalf("expected a decompression error, got %v (%+v)", err, record)
+    }
+
+    if _, err := ParseKeyLog(strings.NewReader(KEYLOG_LABEL + " session 00\n")); err != ERROR_KEYLOG_MALFORMED {
+        t.Fatalf("expected ERROR_KEYLOG_MALFORMED, got %v", err)
+    }
+}
+
+func TestFrameCodec(t *testing.T) {
+    var sent = &frame{
+        frameType:  FRAME_DATA,
+        flags:      FRAME_FLAG_TO_CLIENT | FRAME_FLAG_COMPRESSED,
+        sequence:   0x0102030405060708,
+        payload:    []byte("frame payload"),
+    }
+    encoded, err := encodeFrame(sent)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(encoded) != frameHeaderSize + len(sent.payload) || encoded[0] != FRAME_VERSION {
+        t.Fatalf("unexpected encoding %x", encoded)
+    }
+
+    received, err := decodeFrame(encoded)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if received.frameType != sent.frameType || received.flags != sent.flags || received.sequence != sent.sequence ||
+        !bytes.Equal(received.payload, sent.payload) || !received.compressed() {
+        t.Fatalf("frame changed in transit: %+v", received)
+    }
+
+    /* Every truncation is refused, as is a trailing byte */
+    for i := 0; i != len(encoded); i += 1 {
+        if _, err := decodeFrame(encoded[:i]); err == nil {
+            t.Fatalf("truncated frame of %d bytes was accepted", i)
+        }
+    }
+    if _, err := decodeFrame(append(append([]byte{}, encoded...), 0)); err != ERROR_FRAME_MALFORMED {
+        t.Fatalf("expected ERROR_FRAME_MALFORMED for a trailing byte, got %v", err)
+    }
+
+    var malformed = []struct{
+        offset      int
+        value       byte
+        expected    error
+    }{
+        {0, FRAME_VERSION + 1, ERROR_FRAME_VERSION},
+        {1, 0xff, ERROR_FRAME_MALFORMED},                                   /* Unknown frame type */
+        {2, 0x80, ERROR_FRAME_MALFORMED},                                   /* Unknown flag */
+        {3, byte(FRAME_FLAG_TO_SERVER | FRAME_FLAG_TO_CLIENT), ERROR_FRAME_MALFORMED},
+        {3, 0, ERROR_FRAME_MALFORMED},                                      /* No direction */
+    }
+    for _, test := range malformed {
+        var modified = append([]byte{}, encoded...)
+        modified[test.offset] = test.value
+        if _, err := decodeFrame(modified); err != test.expected {
+            t.Fatalf("byte %d = %#x: expected %v, got %v", test.offset, test.value, test.expected, err)
         }
     }
+}
+
+/* The server's preference decides, even where the client lists another mutual option first */
+func TestServerPreference(t *testing.T) {
+    service, gateURI := newTestGate(t, FLAG_COMPRESS, WithServiceCompression(COMPRESSION_SNAPPY, COMPRESSION_GZIP))
+    client, err := BuildChannel(gateURI, FLAG_ENCRYPT | FLAG_CHACHA20_POLY1305,
+        WithCompression(COMPRESSION_GZIP, COMPRESSION_SNAPPY))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := client.InitializeCircuit(); err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+    conn, err := service.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var expected = Capabilities{PROTOCOL_VERSION, CIPHER_AES256_GCM, COMPRESSION_SNAPPY, DEFAULT_MAX_FRAME_SIZE}
+    if client.Negotiated() != expected || conn.(*NetInstance).Negotiated() != expected {
+        t.Fatalf("expected %+v, got %+v on the client and %+v on the server", expected, client.Negotiated(),
+            conn.(*NetInstance).Negotiated())
+    }
+    roundTrip(t, client, conn, bytes.Repeat([]byte("preference "), 100))
+}
+
+func TestCapabilityNegotiation(t *testing.T) {
+    var negotiate = func(clientFlags FlagVal, clientFrame uint32, serverFlags FlagVal,
+        serverFrame uint32) (*Capabilities, error) {
+        var offered = clientCapabilities(clientFlags, clientFrame, nil)
+        hello, err := encodeHandshake(HS_CLIENT_HELLO, offered.fields()...)
+        if err != nil {
+            return nil, err
+        }
+        message, _, err := parseHandshake(hello, HS_CLIENT_HELLO)
+        if err != nil {
+            return nil, err
+        }
+        parsed, err := parseCapabilities(message)
+        if err != nil {
+            return nil, err
+        }
+        selected, err := serviceCapabilities(serverFlags, serverFrame, nil).negotiate(parsed)
+        if err != nil {
+            return nil, err
+        }
 
-    return io.EOF
+        /* The client must accept exactly what the server selected */
+        response, err := encodeHandshake(HS_SERVER_HELLO, selected.fields()...)
+        if err != nil {
+            return nil, err
+        }
+        if message, _, err = parseHandshake(response, HS_SERVER_HELLO); err != nil {
+            return nil, err
+        }
+        accepted, err := offered.accept(message)
+        if err != nil {
+            return nil, err
+        }
+        if *accepted != *selected {
+            t.Fatalf("client accepted %+v, server selected %+v", accepted, selected)
+        }
+
+        return selected, nil
+    }
+
+    var tests = []struct{
+        clientFlags     FlagVal
+        serverFlags     FlagVal
+        expected        Capabilities
+        err             error
+    }{
+        {0, 0, Capabilities{PROTOCOL_VERSION, CIPHER_AES256_GCM, COMPRESSION_NONE, MIN_FRAME_SIZE}, nil},
+        {FLAG_CHACHA20_POLY1305, 0, Capabilities{PROTOCOL_VERSION, CIPHER_AES256_GCM, COMPRESSION_NONE, MIN_FRAME_SIZE}, nil},
+        {0, FLAG_CHACHA20_POLY1305, Capabilities{PROTOCOL_VERSION, CIPHER_CHACHA20_POLY1305, COMPRESSION_NONE, MIN_FRAME_SIZE}, nil},
+        {FLAG_COMPRESS, 0, Capabilities{PROTOCOL_VERSION, CIPHER_AES256_GCM, COMPRESSION_NONE, MIN_FRAME_SIZE}, nil},
+        {FLAG_COMPRESS, FLAG_COMPRESS, Capabilities{PROTOCOL_VERSION, CIPHER_AES256_GCM, COMPRESSION_ZSTD, MIN_FRAME_SIZE}, nil},
+        {0, FLAG_LEGACY_RC4, Capabilities{PROTOCOL_VERSION, CIPHER_AES256_GCM, COMPRESSION_NONE, MIN_FRAME_SIZE}, nil},
+        {FLAG_LEGACY_RC4, FLAG_LEGACY_RC4, Capabilities{PROTOCOL_VERSION, CIPHER_LEGACY_RC4, COMPRESSION_NONE, MIN_FRAME_SIZE}, nil},
+        {FLAG_LEGACY_RC4, 0, Capabilities{}, ERROR_NO_COMMON_SUITE},
+    }
+    for i, test := range tests {
+        selected, err := negotiate(test.clientFlags, MIN_FRAME_SIZE, test.serverFlags, DEFAULT_MAX_FRAME_SIZE)
+        if err != test.err {
+            t.Fatalf("test %d: expected %v, got %v", i, test.err, err)
+        }
+        if err == nil && *selected != test.expected {
+            t.Fatalf("test %d: expected %+v, got %+v", i, test.expected, *selected)
+        }
+    }
+
+    /* The smaller frame size wins, in either direction */
+    if selected, err := negotiate(0, DEFAULT_MAX_FRAME_SIZE, 0, MIN_FRAME_SIZE * 2); err != nil ||
+        selected.MaxFrameSize != MIN_FRAME_SIZE * 2 {
+        t.Fatalf("unexpected frame size negotiation: %v %v", selected, err)
+    }
+
+    /* A selection that was never offered is refused */
+    var offered = clientCapabilities(0, DEFAULT_MAX_FRAME_SIZE, nil)
+    for _, selected := range []Capabilities{
+        {PROTOCOL_VERSION + 1, CIPHER_AES256_GCM, COMPRESSION_NONE, MIN_FRAME_SIZE},
+        {PROTOCOL_VERSION, CIPHER_LEGACY_RC4, COMPRESSION_NONE, MIN_FRAME_SIZE},
+        {PROTOCOL_VERSION, CIPHER_AES256_GCM, COMPRESSION_GZIP, MIN_FRAME_SIZE},
+        {PROTOCOL_VERSION, CIPHER_AES256_GCM, COMPRESSION_NONE, DEFAULT_MAX_FRAME_SIZE + 1},
+    } {
+        response, _ := encodeHandshake(HS_SERVER_HELLO, selected.fields()...)
+        message, _, _ := parseHandshake(response, HS_SERVER_HELLO)
+        if _, err := offered.accept(message); err != ERROR_NEGOTIATION {
+            t.Fatalf("selection %+v: expected ERROR_NEGOTIATION, got %v", selected, err)
+        }
+    }
+}
+
+func TestFragmentReassembly(t *testing.T) {
+    var (
+        message     = bytes.Repeat([]byte("0123456789"), 250)
+        receiver    = &reassembler{}
+        fragments   [][]byte
+        headers     []*fragmentHeader
+    )
+    for offset := 0; offset != len(message); {
+        fragment, header := nextFragment(message, 7, offset, MIN_FRAME_SIZE)
+        if len(fragment) > int(MIN_FRAME_SIZE) {
+            t.Fatalf("fragment of %d bytes exceeds the frame size", len(fragment))
+        }
+
+        /* The fragment header must survive the frame codec */
+        encoded, err := encodeFrame(&frame{frameType: FRAME_DATA, flags: FRAME_FLAG_TO_SERVER, fragment: header,
+            payload: fragment})
+        if err != nil {
+            t.Fatal(err)
+        }
+        decoded, err := decodeFrame(encoded)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if decoded.fragment == nil || *decoded.fragment != *header || !bytes.Equal(decoded.payload, fragment) {
+            t.Fatalf("fragment at offset %d changed in transit", offset)
+        }
+        if err := checkFrameSize(decoded, MIN_FRAME_SIZE); err != nil {
+            t.Fatal(err)
+        }
+
+        fragments = append(fragments, fragment)
+        headers = append(headers, header)
+        offset += len(fragment)
+    }
+    if len(fragments) != 3 {
+        t.Fatalf("expected 3 fragments, got %d", len(fragments))
+    }
+
+    /* Nothing is delivered until the last fragment, and a gap discards the message */
+    if output, err := receiver.add(headers[0], fragments[0]); err != nil || output != nil {
+        t.Fatalf("first fragment: %v %v", output, err)
+    }
+    if _, err := receiver.add(headers[2], fragments[2]); err != ERROR_FRAGMENT_INVALID {
+        t.Fatalf("expected ERROR_FRAGMENT_INVALID for a gap, got %v", err)
+    }
+    if _, err := receiver.add(headers[1], fragments[1]); err != ERROR_FRAGMENT_INVALID {
+        t.Fatalf("expected the message to be discarded, got %v", err)
+    }
+
+    var output []byte
+    for i := range fragments {
+        var err error
+        if output, err = receiver.add(headers[i], fragments[i]); err != nil {
+            t.Fatal(err)
+        }
+        if (output != nil) != (i == len(fragments) - 1) {
+            t.Fatalf("fragment %d: unexpected delivery", i)
+        }
+    }
+    if !bytes.Equal(output, message) {
+        t.Fatal("reassembled message does not match")
+    }
+
+    /* The number and size of incomplete messages are bounded */
+    for i := 0; i != maxPartialMessages; i += 1 {
+        if _, err := receiver.add(&fragmentHeader{uint32(i), 0, 2}, []byte{0}); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if _, err := receiver.add(&fragmentHeader{maxPartialMessages, 0, 2}, []byte{0}); err != ERROR_FRAGMENT_INVALID {
+        t.Fatalf("expected ERROR_FRAGMENT_INVALID beyond maxPartialMessages, got %v", err)
+    }
+    if _, err := (&reassembler{}).add(&fragmentHeader{0, 0, MAX_MESSAGE_SIZE + 1}, []byte{0});
+        err != ERROR_FRAGMENT_INVALID {
+        t.Fatalf("expected ERROR_FRAGMENT_INVALID beyond MAX_MESSAGE_SIZE, got %v", err)
+    }
+    if err := checkFrameSize(&frame{payload: message}, MIN_FRAME_SIZE); err != ERROR_FRAME_TOO_LARGE {
+        t.Fatalf("expected ERROR_FRAME_TOO_LARGE, got %v", err)
+    }
+}
+
+func TestInstanceReader(t *testing.T) {
+    var (
+        service     = &NetChannelService{clientMap: make(map[string]*NetInstance)}
+        instance    = &NetInstance{service: service, rxSignal: newReadSignal(), clientTX: &bytes.Buffer{}}
+    )
+    instance.enqueue([]byte("hello"))
+    instance.enqueue([]byte("world"))
+
+    /* Short buffers receive partial reads, which may span queued elements */
+    var output []byte
+    for _, expected := range []string{"hel", "low", "orl", "d"} {
+        var buffer = make([]byte, 3)
+        read, err := instance.Read(buffer)
+        if err != nil || string(buffer[:read]) != expected {
+            t.Fatalf("expected %q, got %q (%v)", expected, buffer[:read], err)
+        }
+        output = append(output, buffer[:read]...)
+    }
+    if string(output) != "helloworld" {
+        t.Fatalf("unexpected output %q", output)
+    }
+
+    /* A Read() on an empty queue blocks until data arrives */
+    go func() {
+        time.Sleep(50 * time.Millisecond)
+        instance.enqueue([]byte("late data"))
+    } ()
+    var buffer = make([]byte, 9)
+    if _, err := io.ReadFull(instance, buffer); err != nil || string(buffer) != "late data" {
+        t.Fatalf("io.ReadFull: %q %v", buffer, err)
+    }
+
+    /* A successful Write() returns a nil error */
+    if wrote, err := instance.Write([]byte("queued")); err != nil || wrote != 6 {
+        t.Fatalf("Write: %d %v", wrote, err)
+    }
+
+    /* Queued data is still delivered after close, followed by io.EOF */
+    instance.enqueue([]byte("final"))
+    service.closeClient(instance)
+    remaining, err := io.ReadAll(instance)
+    if err != nil || string(remaining) != "final" {
+        t.Fatalf("io.ReadAll: %q %v", remaining, err)
+    }
+    if _, err := instance.Write([]byte("closed")); err != ERROR_NOT_CONNECTED {
+        t.Fatalf("expected ERROR_NOT_CONNECTED after close, got %v", err)
+    }
+}
+
+func TestInstanceConn(t *testing.T) {
+    var (
+        service     = &NetChannelService{clientMap: make(map[string]*NetInstance)}
+        instance    = &NetInstance{service: service, rxSignal: newReadSignal(), clientTX: &bytes.Buffer{}}
+        conn        net.Conn = instance
+        buffer      = make([]byte, 16)
+    )
+
+    /* A blocked Read() fails with a timeout once the read deadline passes */
+    conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+    var start = time.Now()
+    _, err := conn.Read(buffer)
+    if !errors.Is(err, os.ErrDeadlineExceeded) || time.Since(start) < 50 * time.Millisecond {
+        t.Fatalf("expected os.ErrDeadlineExceeded after the deadline, got %v", err)
+    }
+    if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+        t.Fatalf("deadline error is not a net.Error timeout")
+    }
+
+    /* Without a deadline, Read() blocks until data arrives */
+    conn.SetReadDeadline(time.Time{})
+    go func() {
+        time.Sleep(50 * time.Millisecond)
+        instance.enqueue([]byte("data"))
+    } ()
+    read, err := conn.Read(buffer)
+    if err != nil || string(buffer[:read]) != "data" {
+        t.Fatalf("Read: %q %v", buffer[:read], err)
+    }
+
+    /* Setting a deadline applies to a Read() that is already blocked */
+    go func() {
+        time.Sleep(50 * time.Millisecond)
+        conn.SetReadDeadline(time.Now())
+    } ()
+    if _, err := conn.Read(buffer); !errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Fatalf("expected os.ErrDeadlineExceeded from a blocked Read, got %v", err)
+    }
+
+    conn.SetWriteDeadline(time.Now().Add(-time.Second))
+    if _, err := conn.Write([]byte("late")); !errors.Is(err, os.ErrDeadlineExceeded) {
+        t.Fatalf("expected os.ErrDeadlineExceeded from Write, got %v", err)
+    }
+    conn.SetDeadline(time.Time{})
+    if _, err := conn.Write([]byte("on time")); err != nil {
+        t.Fatalf("Write: %v", err)
+    }
+
+    /* The addresses follow the HTTP connection of each request */
+    var request = httptest.NewRequest("POST", "/gate", nil)
+    request.RemoteAddr = "192.0.2.7:40000"
+    request = request.WithContext(context.WithValue(request.Context(), http.LocalAddrContextKey,
+        &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 8080}))
+    instance.addrs.setFromRequest(request)
+    if conn.RemoteAddr().String() != "192.0.2.7:40000" || conn.LocalAddr().String() != "192.0.2.1:8080" {
+        t.Fatalf("unexpected addresses %s %s", conn.LocalAddr(), conn.RemoteAddr())
+    }
+
+    if err := conn.Close(); err != nil {
+        t.Fatalf("Close: %v", err)
+    }
+    if err := conn.Close(); !errors.Is(err, net.ErrClosed) {
+        t.Fatalf("expected net.ErrClosed on the second Close, got %v", err)
+    }
+}
+
+func TestServiceAccept(t *testing.T) {
+    var newService = func() *NetChannelService {
+        return &NetChannelService{
+            clientMap:  make(map[string]*NetInstance),
+            accepted:   make(chan *NetInstance, ACCEPT_BACKLOG),
+            done:       make(chan struct{}),
+        }
+    }
+    var newInstance = func(service *NetChannelService) *NetInstance {
+        return &NetInstance{service: service, rxSignal: newReadSignal(), clientTX: &bytes.Buffer{}}
+    }
+
+    var (
+        service                 = newService()
+        listener   net.Listener = service
+        instance                = newInstance(service)
+    )
+    if err := service.enqueueAccept(instance); err != nil {
+        t.Fatalf("enqueueAccept: %v", err)
+    }
+    conn, err := listener.Accept()
+    if err != nil || conn != net.Conn(instance) || !instance.connected.Load() {
+        t.Fatalf("Accept did not return the queued client: %v", err)
+    }
+
+    /* Close() unblocks a pending Accept(), and no new clients are queued afterwards */
+    var result = make(chan error)
+    go func() {
+        _, err := listener.Accept()
+        result <- err
+    } ()
+    time.Sleep(50 * time.Millisecond)
+    if err := listener.Close(); err != nil {
+        t.Fatalf("Close: %v", err)
+    }
+    if err := <-result; !errors.Is(err, net.ErrClosed) {
+        t.Fatalf("expected net.ErrClosed from a pending Accept, got %v", err)
+    }
+    if err := listener.Close(); !errors.Is(err, net.ErrClosed) {
+        t.Fatalf("expected net.ErrClosed on the second Close, got %v", err)
+    }
+    var late = newInstance(service)
+    if err := service.enqueueAccept(late); err != ERROR_SERVICE_CLOSED || !late.isClosed() {
+        t.Fatalf("expected ERROR_SERVICE_CLOSED after Close, got %v", err)
+    }
+    if listener.Addr() == nil {
+        t.Fatalf("Addr returned nil")
+    }
+
+    /* Clients still waiting for Accept() are closed with the service */
+    service = newService()
+    var queued = []*NetInstance{newInstance(service), newInstance(service)}
+    for _, client := range queued {
+        service.enqueueAccept(client)
+    }
+    service.CloseService()
+    for _, client := range queued {
+        if !client.isClosed() {
+            t.Fatalf("a queued client was left open after Close")
+        }
+    }
+    if _, err := service.Accept(); !errors.Is(err, net.ErrClosed) {
+        t.Fatalf("expected net.ErrClosed from Accept after Close, got %v", err)
+    }
+
+    /* Close() also stops the HTTP server of the gate */
+    gateService, gateURI := newTestGate(t, 0)
+    response, err := http.Get(gateURI)
+    if err != nil {
+        t.Fatalf("gate is not serving: %v", err)
+    }
+    response.Body.Close()
+    gateService.Close()
+    if _, err := (&http.Client{Timeout: time.Second}).Get(gateURI); err == nil {
+        t.Fatalf("gate is still serving after Close")
+    }
+
+    /* The path is free again after Close(), and services on the same path each serve their own circuits */
+    for _, flags := range []FlagVal{0, FLAG_CHACHA20_POLY1305} {
+        gateService, gateURI := newTestGate(t, flags)
+        client, err := BuildChannel(gateURI, FLAG_ENCRYPT)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if err := client.InitializeCircuit(); err != nil {
+            t.Fatalf("key exchange on a reused path: %v", err)
+        }
+        defer client.Close()
+        conn, err := gateService.Accept()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if suite := conn.(*NetInstance).Negotiated().CipherSuite; suite != CipherSuite(aeadSuites(flags)[0]) {
+            t.Fatalf("circuit was served by another service, which selected %v", suite)
+        }
+        roundTrip(t, client, conn, []byte("reused path"))
+    }
+
+    /* IncomingHandler is invoked for every accepted client, which is closed if it returns an error */
+    service = newService()
+    var handled = make(chan *NetInstance, 2)
+    service.IncomingHandler = func(client *NetInstance, server *NetChannelService) error {
+        handled <- client
+        if client.ClientIdString == "refused" {
+            return ERROR_CLIENT_NOT_AUTHORIZED
+        }
+        return nil
+    }
+    go service.serveIncoming()
+    defer service.Close()
+
+    var accepted, refused = newInstance(service), newInstance(service)
+    refused.ClientIdString = "refused"
+    service.enqueueAccept(accepted)
+    service.enqueueAccept(refused)
+    if <-handled != accepted || <-handled != refused {
+        t.Fatalf("IncomingHandler was not invoked in order")
+    }
+    time.Sleep(50 * time.Millisecond)
+    if accepted.isClosed() || !refused.isClosed() {
+        t.Fatalf("only the refused client should be closed")
+    }
+}
+
+func TestClientAuthentication(t *testing.T) {
+    allowedKey, signingKey, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, unlistedKey, _ := ed25519.GenerateKey(rand.Reader)
+    var psk = bytes.Repeat([]byte{0x5a}, 32)
+    service, gateURI := newTestGate(t, 0,
+        WithPreSharedKeys(map[string][]byte{"branch": psk}),
+        WithAuthorizer(AllowClients(KeyFingerprint(allowedKey), "branch")))
+
+    /* Refused clients never reach Accept(), and so never reach IncomingHandler either */
+    var refused = []struct{
+        name        string
+        options     []ChannelOption
+        expected    error
+    }{
+        {"wrong PSK", []ChannelOption{WithPreSharedKey("branch", bytes.Repeat([]byte{0xa5}, 32))}, ERROR_CLIENT_AUTH},
+        {"unknown PSK ID", []ChannelOption{WithPreSharedKey("other", psk)}, ERROR_CLIENT_AUTH},
+        {"unlisted key", []ChannelOption{WithClientKey(unlistedKey)}, ERROR_CLIENT_NOT_AUTHORIZED},
+        {"no credentials", nil, ERROR_CLIENT_NOT_AUTHORIZED},
+    }
+    for _, test := range refused {
+        client, err := BuildChannel(gateURI, FLAG_ENCRYPT, test.options...)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if err := client.InitializeCircuit(); err == nil || !strings.Contains(err.Error(), test.expected.Error()) {
+            t.Fatalf("%s: expected %v, got %v", test.name, test.expected, err)
+        }
+        expectNoneAccepted(t, service)
+    }
+
+    /* The verified identity is exposed on the NetInstance */
+    var accepted = []struct{
+        name        string
+        option      ChannelOption
+        expected    ClientIdentity
+    }{
+        {"listed key", WithClientKey(signingKey),
+            ClientIdentity{PublicKey: allowedKey, Fingerprint: KeyFingerprint(allowedKey)}},
+        {"PSK", WithPreSharedKey("branch", psk), ClientIdentity{KeyID: "branch", Fingerprint: "branch"}},
+    }
+    for _, test := range accepted {
+        client, err := BuildChannel(gateURI, FLAG_ENCRYPT, test.option)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if err := client.InitializeCircuit(); err != nil {
+            t.Fatalf("%s: %v", test.name, err)
+        }
+        defer client.Close()
+        conn, err := service.Accept()
+        if err != nil {
+            t.Fatal(err)
+        }
+        var identity = conn.(*NetInstance).Identity
+        if identity == nil || !bytes.Equal(identity.PublicKey, test.expected.PublicKey) ||
+            identity.KeyID != test.expected.KeyID || identity.Fingerprint != test.expected.Fingerprint {
+            t.Fatalf("%s: unexpected identity %+v", test.name, identity)
+        }
+    }
+
+    /* A key proof signed by another key than the one it presents */
+    var (
+        transcript  = clientAuthTranscript(CURVE_P384, []byte("client"))
+        forged      = append([]byte{CLIENT_AUTH_KEY}, allowedKey...)
+    )
+    forged = append(forged, ed25519.Sign(unlistedKey, transcript)...)
+    if _, err := service.verifyClientAuth(forged, transcript); err != ERROR_CLIENT_AUTH {
+        t.Fatalf("forged key proof: expected ERROR_CLIENT_AUTH, got %v", err)
+    }
+}
+
+func TestControlFrames(t *testing.T) {
+    for _, payload := range [][]byte{nil, {0}, {CONTROL_UPGRADE + 1}} {
+        if _, err := decodeControl(payload); err != ERROR_CONTROL_UNEXPECTED {
+            t.Fatalf("control payload %x was accepted", payload)
+        }
+    }
+
+    /* Control frames are never compressed or fragmented */
+    for _, flags := range []uint16{FRAME_FLAG_COMPRESSED, FRAME_FLAG_FRAGMENT} {
+        encoded, err := encodeFrame(&frame{frameType: FRAME_CONTROL, flags: FRAME_FLAG_TO_SERVER | flags,
+            payload: []byte{CONTROL_POLL}, fragment: &fragmentHeader{length: 1}})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, err := decodeFrame(encoded); err != ERROR_FRAME_MALFORMED {
+            t.Fatalf("control frame with flags %#x was accepted", flags)
+        }
+    }
+
+    config, err := parseConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var service = &NetChannelService{clientMap: make(map[string]*NetInstance), config: config}
+
+    var (
+        key         = bytes.Repeat([]byte{0x42}, trafficKeySize)
+        instance    = &NetInstance{
+            service:    service,
+            negotiated: Capabilities{CipherSuite: CIPHER_AES256_GCM},
+            txKey:      newTrafficState(key, defaultRekeyLimits()),
+            clientTX:   &bytes.Buffer{},
+            rxSignal:   newReadSignal(),
+        }
+        clientRx    = newTrafficState(key, defaultRekeyLimits())
+    )
+    var reply = func(recorder *httptest.ResponseRecorder) *controlMessage {
+        payload, decoded, err := decryptData(recorder.Body.String(), clientRx, CIPHER_AES256_GCM, FLAG_DIRECTION_TO_CLIENT)
+        if err != nil || decoded.frameType != FRAME_CONTROL {
+            t.Fatalf("reply is not a control frame: %v", err)
+        }
+        message, err := decodeControl(payload)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return message
+    }
+
+    /* Application data that spells out a former command string is only data */
+    var recorder = httptest.NewRecorder()
+    if err := instance.parseClientData([]byte(config.TermConnect), recorder); err != nil || instance.isClosed() {
+        t.Fatalf("data frame was treated as a command: %v", err)
+    }
+    var buffer = make([]byte, len(config.TermConnect))
+    if read, _ := instance.Read(buffer); string(buffer[:read]) != config.TermConnect {
+        t.Fatalf("data frame was not delivered to Read")
+    }
+
+    recorder = httptest.NewRecorder()
+    if err := instance.parseControl(encodeControl(&controlMessage{CONTROL_PING, []byte("ping")}), recorder); err != nil {
+        t.Fatal(err)
+    }
+    if message := reply(recorder); message.controlType != CONTROL_ACK || string(message.body) != "ping" {
+        t.Fatalf("unexpected reply to CONTROL_PING: %+v", message)
+    }
+
+    /* The acknowledgement of CONTROL_REKEY is sealed under the next epoch */
+    recorder = httptest.NewRecorder()
+    if err := instance.parseControl([]byte{CONTROL_REKEY}, recorder); err != nil {
+        t.Fatal(err)
+    }
+    if message := reply(recorder); message.controlType != CONTROL_ACK || clientRx.epoch != 1 {
+        t.Fatalf("CONTROL_REKEY did not ratchet the server key")
+    }
+
+    recorder = httptest.NewRecorder()
+    if err := instance.parseControl([]byte{CONTROL_ACK}, recorder); err != nil || recorder.Code != 500 {
+        t.Fatalf("unexpected control message was not refused")
+    }
+
+    recorder = httptest.NewRecorder()
+    if err := instance.parseControl([]byte{CONTROL_TERMINATE}, recorder); err != ERROR_TERMINATE {
+        t.Fatalf("expected ERROR_TERMINATE, got %v", err)
+    }
+    if message := reply(recorder); message.controlType != CONTROL_ACK {
+        t.Fatalf("CONTROL_TERMINATE was not acknowledged")
+    }
+}
+
+func TestCompressionMatrix(t *testing.T) {
+    var settings = []struct{
+        name        string
+        flags       FlagVal
+        algorithms  []CompressionAlgorithm
+    }{
+        {"off", 0, nil},
+        {"FLAG_COMPRESS", FLAG_COMPRESS, nil},
+        {"gzip", 0, []CompressionAlgorithm{COMPRESSION_GZIP}},
+        {"zstd", 0, []CompressionAlgorithm{COMPRESSION_ZSTD}},
+        {"snappy", FLAG_COMPRESS, []CompressionAlgorithm{COMPRESSION_SNAPPY}},
+    }
+    var supported = func(flags FlagVal, algorithms []CompressionAlgorithm) []CompressionAlgorithm {
+        if algorithms == nil && (flags & FLAG_COMPRESS) > 0 {
+            return defaultCompression
+        }
+        return algorithms
+    }
+
+    var (
+        key             = bytes.Repeat([]byte{0x42}, trafficKeySize)
+        compressible    = bytes.Repeat([]byte("websock compression "), 200)
+        incompressible  = make([]byte, 4000)
+    )
+    if _, err := io.ReadFull(rand.Reader, incompressible); err != nil {
+        t.Fatal(err)
+    }
+
+    for _, client := range settings {
+        for _, server := range settings {
+            var name = "client " + client.name + ", server " + server.name
+
+            /* The server selects its first preference that the client offered */
+            var expected = COMPRESSION_NONE
+            for _, algorithm := range supported(server.flags, server.algorithms) {
+                if slices.Contains(supported(client.flags, client.algorithms), algorithm) {
+                    expected = algorithm
+                    break
+                }
+            }
+
+            var offered = clientCapabilities(client.flags, DEFAULT_MAX_FRAME_SIZE, client.algorithms)
+            hello, _ := encodeHandshake(HS_CLIENT_HELLO, offered.fields()...)
+            message, _, _ := parseHandshake(hello, HS_CLIENT_HELLO)
+            parsed, err := parseCapabilities(message)
+            if err != nil {
+                t.Fatalf("%s: %v", name, err)
+            }
+            selected, err := serviceCapabilities(server.flags, DEFAULT_MAX_FRAME_SIZE, server.algorithms).negotiate(parsed)
+            if err != nil || selected.Compression != expected {
+                t.Fatalf("%s: expected %s, got %+v %v", name, expected, selected, err)
+            }
+
+            for _, direction := range []FlagVal{FLAG_DIRECTION_TO_SERVER, FLAG_DIRECTION_TO_CLIENT} {
+                for _, data := range [][]byte{compressible, incompressible} {
+                    /* Only low-entropy data is compressed, and only if an algorithm was negotiated */
+                    var compressed = selected.Compression != COMPRESSION_NONE && bytes.Equal(data, compressible)
+
+                    var (
+                        sender      = newTrafficState(key, defaultRekeyLimits())
+                        receiver    = newTrafficState(key, defaultRekeyLimits())
+                    )
+                    payload, flags, err := compressPayload(selected.Compression, data)
+                    if err != nil {
+                        t.Fatalf("%s: %v", name, err)
+                    }
+                    encrypted, err := encryptData(payload, sender, selected.CipherSuite, direction, flags)
+                    if err != nil {
+                        t.Fatal(err)
+                    }
+                    payload, decoded, err := decryptData(util.B64E(encrypted), receiver, selected.CipherSuite, direction)
+                    if err != nil {
+                        t.Fatalf("%s: %v", name, err)
+                    }
+                    if decoded.compressed() != compressed {
+                        t.Fatalf("%s: expected the compressed flag to be %v", name, compressed)
+                    }
+                    payload, err = decompressPayload(selected.Compression, decoded, payload, selected.MaxFrameSize)
+                    if err != nil || !bytes.Equal(payload, data) {
+                        t.Fatalf("%s: round trip failed: %v", name, err)
+                    }
+                }
+            }
+        }
+    }
+
+    /* A compressed frame is refused on a circuit without compression */
+    compressed, _ := compress(COMPRESSION_GZIP, compressible)
+    var decoded = &frame{flags: FRAME_FLAG_TO_CLIENT | FRAME_FLAG_COMPRESSED}
+    if _, err := decompressPayload(COMPRESSION_NONE, decoded, compressed, DEFAULT_MAX_FRAME_SIZE); err != ERROR_DECOMPRESSION {
+        t.Fatalf("compressed frame was accepted without compression: %v", err)
+    }
+
+    /* Nothing is inflated beyond the negotiated frame size */
+    var oversized = make([]byte, MIN_FRAME_SIZE + 1)
+    for _, algorithm := range defaultCompression {
+        compressed, _ := compress(algorithm, oversized)
+        if _, err := decompressPayload(algorithm, decoded, compressed, MIN_FRAME_SIZE); err != ERROR_DECOMPRESSION {
+            t.Fatalf("%s: payload inflated beyond the frame size: %v", algorithm, err)
+        }
+        if _, err := decompressPayload(algorithm, decoded, compressed[:len(compressed) / 2], DEFAULT_MAX_FRAME_SIZE); err != ERROR_DECOMPRESSION {
+            t.Fatalf("%s: truncated payload was accepted: %v", algorithm, err)
+        }
+        if data, err := decompressAny(compressed, int(DEFAULT_MAX_FRAME_SIZE)); err != nil || !bytes.Equal(data, oversized) {
+            t.Fatalf("%s: algorithm was not detected: %v", algorithm, err)
+        }
+    }
+}
+
+/* Both ends of a circuit on service, as left by the key exchange */
+func newTestCircuit(service *NetChannelService, gateURL *url.URL, id string, config *ProtocolConfig) (*NetChannelClient, *NetInstance) {
+    var (
+        toServer    = bytes.Repeat([]byte{0x01}, trafficKeySize)
+        toClient    = bytes.Repeat([]byte{0x02}, trafficKeySize)
+        negotiated  = Capabilities{PROTOCOL_VERSION, CIPHER_AES256_GCM, COMPRESSION_NONE, MIN_FRAME_SIZE}
+        transport   = newTransport(0)
+    )
+    var instance = &NetInstance{
+        ClientIdString: id,
+        service:        service,
+        negotiated:     negotiated,
+        txKey:          newTrafficState(toClient, defaultRekeyLimits()),
+        rxKey:          newTrafficState(toServer, defaultRekeyLimits()),
+        clientTX:       &bytes.Buffer{},
+        rxSignal:       newReadSignal(),
+        txSignal:       newReadSignal(),
+    }
+    service.clientLock.Lock()
+    service.clientMap[id] = instance
+    service.clientLock.Unlock()
+
+    var client = &NetChannelClient{
+        controllerURL:  gateURL,
+        inputURI:       gateURL.String(),
+        clientIdString: id,
+        negotiated:     negotiated,
+        txKey:          newTrafficState(toServer, defaultRekeyLimits()),
+        rxKey:          newTrafficState(toClient, defaultRekeyLimits()),
+        transport:      transport,
+        httpClient:     &http.Client{Transport: transport},
+        config:         config,
+        rxSignal:       newReadSignal(),
+    }
+    client.connected.Store(true)
+
+    return client, instance
+}
+
+func TestWebSocketTransport(t *testing.T) {
+    config, err := parseConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var service = &NetChannelService{clientMap: make(map[string]*NetInstance), config: config,
+        Flags: FLAG_ENCRYPT | FLAG_WEBSOCKET}
+
+    var gate = httptest.NewServer(http.HandlerFunc(service.handleClientRequest))
+    defer gate.Close()
+    gateURL, _ := url.Parse(gate.URL + "/gate.php")
+
+    client, instance := newTestCircuit(service, gateURL, "socket", config)
+    if err := client.upgradeSocket(); err != nil || client.socket.Load() == nil {
+        t.Fatalf("upgrade was refused: %v", err)
+    }
+    client.SetReadDeadline(time.Now().Add(5 * time.Second))
+    instance.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+    /* Larger than the frame size, so that it is fragmented in both directions */
+    var (
+        message     = bytes.Repeat([]byte("websocket "), 300)
+        buffer      = make([]byte, len(message))
+    )
+    if wrote, err := client.Write(message); err != nil || wrote != len(message) {
+        t.Fatalf("Write: %d %v", wrote, err)
+    }
+    if _, err := io.ReadFull(instance, buffer); err != nil || !bytes.Equal(buffer, message) {
+        t.Fatalf("server did not receive the message: %v", err)
+    }
+
+    /* Queued data is pushed to the client, which never polls */
+    instance.Write(message)
+    if _, err := io.ReadFull(client, buffer); err != nil || !bytes.Equal(buffer, message) {
+        t.Fatalf("client did not receive the message: %v", err)
+    }
+
+    if _, err := client.Ping(); err != nil {
+        t.Fatalf("Ping: %v", err)
+    }
+    if err := client.Rekey(); err != nil || client.rxKey.epoch != 1 {
+        t.Fatalf("Rekey: %v", err)
+    }
+
+    /* Closing the NetInstance reaches the client over the socket */
+    instance.Close()
+    if read, err := client.Read(buffer); read != 0 || err != io.EOF {
+        t.Fatalf("expected io.EOF once the server closes, got %d %v", read, err)
+    }
+
+    /* A server without FLAG_WEBSOCKET refuses the upgrade, and the circuit remains up */
+    service.Flags &^= FLAG_WEBSOCKET
+    client, _ = newTestCircuit(service, gateURL, "polling", config)
+    if err := client.upgradeSocket(); err == nil || client.socket.Load() != nil {
+        t.Fatalf("upgrade was not refused")
+    }
+    if _, err := client.Ping(); err != nil {
+        t.Fatalf("circuit did not survive the refused upgrade: %v", err)
+    }
+}
+
+/* The server end of a WebSocket whose connection is already gone, so that every send fails */
+func newBrokenSocket(t *testing.T) *socketConn {
+    var accepted = make(chan *websocket.Conn, 1)
+    var server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+        if conn, err := upgrader.Upgrade(writer, request, nil); err == nil {
+            accepted <- conn
+        }
+    }))
+    defer server.Close()
+
+    conn, _, err := websocket.DefaultDialer.Dial("ws" + strings.TrimPrefix(server.URL, "http"), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+
+    var socket = newSocketConn(<-accepted, DEFAULT_MAX_FRAME_SIZE)
+    socket.conn.UnderlyingConn().Close()
+    return socket
+}
+
+func TestWebSocketSendFailure(t *testing.T) {
+    config, err := parseConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var service = &NetChannelService{clientMap: make(map[string]*NetInstance), config: config,
+        Flags: FLAG_ENCRYPT | FLAG_WEBSOCKET}
+
+    var gate = httptest.NewServer(http.HandlerFunc(service.handleClientRequest))
+    defer gate.Close()
+    gateURL, _ := url.Parse(gate.URL + "/gate.php")
+
+    /* The frame the socket failed to send reaches the client over the next socket */
+    var (
+        message     = []byte("sent once the socket is back")
+        buffer      = make([]byte, len(message))
+    )
+    client, instance := newTestCircuit(service, gateURL, "lost", config)
+    instance.Write(message)
+    instance.pushQueued(newBrokenSocket(t))
+    if !instance.hasQueued() {
+        t.Fatal("the frame that was not sent was dropped")
+    }
+
+    if err := client.upgradeSocket(); err != nil {
+        t.Fatalf("upgrade was refused: %v", err)
+    }
+    client.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if _, err := io.ReadFull(client, buffer); err != nil || !bytes.Equal(buffer, message) {
+        t.Fatalf("client did not receive the message: %v", err)
+    }
+
+    /* Nor is the instance forgotten before CONTROL_TERMINATE is sent */
+    client, instance = newTestCircuit(service, gateURL, "closed", config)
+    instance.Close()
+    instance.pushQueued(newBrokenSocket(t))
+    if service.lookupClient("closed") != instance {
+        t.Fatal("the instance was forgotten, but the client was never told it is closed")
+    }
+    client.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if _, err := client.Write(message); err == nil {
+        t.Fatal("Write succeeded on a closed instance")
+    }
+    if read, err := client.Read(buffer); read != 0 || err != io.EOF {
+        t.Fatalf("expected io.EOF once the server closes, got %d %v", read, err)
+    }
+}
+
+func TestH2CTransport(t *testing.T) {
+    var (
+        polling     = make(chan struct{})
+        release     = make(chan struct{})
+        server      = newHTTPServer(FLAG_H2C, nil)
+    )
+    server.Handler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+        if request.URL.Path == "/poll" {
+            /* Held open until the upload arrives, as a poll would be */
+            close(polling)
+            <-release
+        } else if request.URL.Path == "/upload" {
+            close(release)
+        }
+        writer.Write([]byte(request.Proto))
+    })
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    go server.Serve(listener)
+    defer server.Close()
+
+    var (
+        dials       int64
+        transport   = newTransport(FLAG_H2C)
+        dial        = transport.DialContext
+        baseURI     = "http://" + listener.Addr().String()
+    )
+    transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+        atomic.AddInt64(&dials, 1)
+        return dial(ctx, network, addr)
+    }
+    var client = &http.Client{Transport: transport}
+    var get = func(uri string) string {
+        response, err := client.Get(uri)
+        if err != nil {
+            t.Error(err)
+            return ""
+        }
+        defer response.Body.Close()
+        body, _ := io.ReadAll(response.Body)
+        return string(body)
+    }
+
+    /* The upload is sent while the poll is outstanding, as a second stream on the same connection */
+    var result = make(chan string)
+    go func() {
+        result <- get(baseURI + "/poll")
+    } ()
+    <-polling
+    if proto := get(baseURI + "/upload"); proto != "HTTP/2.0" {
+        t.Fatalf("upload was sent over %s", proto)
+    }
+    if proto := <-result; proto != "HTTP/2.0" {
+        t.Fatalf("poll was sent over %s", proto)
+    }
+    if atomic.LoadInt64(&dials) != 1 {
+        t.Fatalf("expected a single connection, %d were opened", dials)
+    }
+
+    /* Clients without FLAG_H2C are still served over HTTP/1.1 */
+    response, err := http.Get(baseURI + "/other")
+    if err != nil {
+        t.Fatal(err)
+    }
+    response.Body.Close()
+    if response.ProtoMajor != 1 {
+        t.Fatalf("expected HTTP/1.1, got %s", response.Proto)
+    }
+}
+
+func TestTLSPinning(t *testing.T) {
+    /* Self-signed certificates for the loopback address */
+    var selfSigned = func() (*ecdsa.PrivateKey, []byte) {
+        key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+        if err != nil {
+            t.Fatal(err)
+        }
+        var template = &x509.Certificate{
+            SerialNumber:   big.NewInt(1),
+            NotBefore:      time.Now().Add(-time.Hour),
+            NotAfter:       time.Now().Add(time.Hour),
+            IPAddresses:    []net.IP{net.IPv4(127, 0, 0, 1)},
+        }
+        der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return key, der
+    }
+    var serve = func(chain [][]byte, key *ecdsa.PrivateKey) string {
+        var server = newHTTPServer(0, nil)
+        server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{{Certificate: chain, PrivateKey: key}}}
+        server.Handler = http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {})
+        listener, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+            t.Fatal(err)
+        }
+        go server.ServeTLS(listener, "", "")
+        t.Cleanup(func() { server.Close() })
+        return "https://" + listener.Addr().String() + "/gate.php"
+    }
+
+    key, der := selfSigned()
+    cert, _ := x509.ParseCertificate(der)
+    var roots = x509.NewCertPool()
+    roots.AddCert(cert)
+
+    var (
+        gateURI     = serve([][]byte{der}, key)
+        pin         = SPKIFingerprint(cert)
+        otherPin    = strings.Repeat("00", 32)
+    )
+    var connect = func(gateURI string, options ...ChannelOption) error {
+        client, err := BuildChannel(gateURI, FLAG_ENCRYPT, options...)
+        if err != nil {
+            return err
+        }
+        response, err := client.httpClient.Get(gateURI)
+        if err != nil {
+            return err
+        }
+        response.Body.Close()
+        return nil
+    }
+
+    var tests = []struct{
+        name        string
+        options     []ChannelOption
+        expected    error
+    }{
+        {"trusted root", []ChannelOption{WithTLSConfig(&tls.Config{RootCAs: roots})}, nil},
+        {"trusted root and pin", []ChannelOption{WithTLSConfig(&tls.Config{RootCAs: roots}), WithPinnedSPKI(otherPin, pin)}, nil},
+        {"pin alone", []ChannelOption{WithTLSConfig(&tls.Config{InsecureSkipVerify: true}), WithPinnedSPKI(pin)}, nil},
+        {"wrong pin", []ChannelOption{WithTLSConfig(&tls.Config{RootCAs: roots}), WithPinnedSPKI(otherPin)}, ERROR_SPKI_MISMATCH},
+    }
+    for _, test := range tests {
+        if err := connect(gateURI, test.options...); !errors.Is(err, test.expected) {
+            t.Fatalf("%s: expected %v, got %v", test.name, test.expected, err)
+        }
+    }
+
+    /* Without verification only the leaf is pinned, the certificates after it prove nothing */
+    attackerKey, attackerDer := selfSigned()
+    var attackerURI = serve([][]byte{attackerDer, der}, attackerKey)
+    if err := connect(attackerURI, WithTLSConfig(&tls.Config{InsecureSkipVerify: true}),
+        WithPinnedSPKI(pin)); !errors.Is(err, ERROR_SPKI_MISMATCH) {
+        t.Fatalf("pinned certificate appended to another chain: expected ERROR_SPKI_MISMATCH, got %v", err)
+    }
+
+    /* The system roots do not hold a self-signed certificate */
+    var unknown x509.UnknownAuthorityError
+    if err := connect(gateURI); !errors.As(err, &unknown) {
+        t.Fatalf("untrusted certificate was accepted: %v", err)
+    }
+
+    if _, err := BuildChannel("ftp://127.0.0.1/gate.php", FLAG_ENCRYPT); err == nil {
+        t.Fatalf("ftp gate URI was accepted")
+    }
+    if _, err := BuildChannel("http://127.0.0.1/gate.php", FLAG_ENCRYPT, WithPinnedSPKI(pin)); err == nil {
+        t.Fatalf("TLS option was accepted with an http gate URI")
+    }
+    if _, err := BuildChannel(gateURI, FLAG_ENCRYPT, WithPinnedSPKI("not a fingerprint")); err == nil {
+        t.Fatalf("malformed fingerprint was accepted")
+    }
+}
+
+func TestProxy(t *testing.T) {
+    config, err := parseConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var service = &NetChannelService{clientMap: make(map[string]*NetInstance), config: config,
+        Flags: FLAG_ENCRYPT}
+
+    var gate = httptest.NewServer(http.HandlerFunc(service.handleClientRequest))
+    defer gate.Close()
+    gateURL, _ := url.Parse(gate.URL + "/gate.php")
+
+    /* A forward proxy that times out the first polls it is sent */
+    var (
+        forward         = httputil.NewSingleHostReverseProxy(gateURL)
+        cut             int32 = 2
+        authorization   atomic.Value
+    )
+    var proxy = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+        authorization.Store(request.Header.Get("Proxy-Authorization"))
+        if atomic.AddInt32(&cut, -1) >= 0 {
+            writer.WriteHeader(http.StatusGatewayTimeout)
+            return
+        }
+        forward.ServeHTTP(writer, request)
+    }))
+    defer proxy.Close()
+
+    /* The options are applied to the transport by BuildChannel */
+    if _, err := BuildChannel(gateURL.String(), FLAG_ENCRYPT, WithProxy("ftp://" + gateURL.Host)); err == nil {
+        t.Fatalf("ftp proxy URI was accepted")
+    }
+    if _, err := BuildChannel(gateURL.String(), FLAG_ENCRYPT, WithPollTimeout(time.Millisecond)); err == nil {
+        t.Fatalf("poll timeout below one second was accepted")
+    }
+    direct, err := BuildChannel(gateURL.String(), FLAG_ENCRYPT)
+    if err != nil || direct.pollTimeout != 0 {
+        t.Fatalf("a direct circuit bounds its polls: %v", err)
+    }
+
+    client, instance := newTestCircuit(service, gateURL, "proxied", config)
+    for _, option := range []ChannelOption{WithProxy(proxy.URL), WithProxyAuth("user", "secret")} {
+        if err := option(client); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := client.configureProxy(); err != nil || client.pollTimeout != PROXY_POLL_TIMEOUT {
+        t.Fatalf("configureProxy: %v %v", err, client.pollTimeout)
+    }
+    client.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+    /* The cut polls are sent again, and the circuit survives them */
+    checkWriteThread(client)
+    var (
+        message     = []byte("through the proxy")
+        buffer      = make([]byte, len(message))
+    )
+    instance.Write(message)
+    if _, err := io.ReadFull(client, buffer); err != nil || !bytes.Equal(buffer, message) {
+        t.Fatalf("client did not receive the message: %v", err)
+    }
+    var expected = "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+    if authorization.Load() != expected {
+        t.Fatalf("expected Proxy-Authorization %q, got %q", expected, authorization.Load())
+    }
+
+    /* The server answers a poll within the limit in its body, rather than C2ResponseTimeout */
+    var started = time.Now()
+    if read, _, err := client.writeStream(encodePoll(time.Second, false), FLAG_CHECK_STREAM_DATA); read != 0 ||
+        err != io.EOF {
+        t.Fatalf("bounded poll: %d %v", read, err)
+    }
+    if elapsed := time.Since(started); elapsed > 5 * time.Second {
+        t.Fatalf("poll was held for %v", elapsed)
+    }
+    if decodePollTimeout(nil, time.Minute) != time.Minute ||
+        decodePollTimeout(encodePoll(time.Hour, false), time.Minute) != time.Minute {
+        t.Fatalf("a poll may be held beyond C2ResponseTimeout")
+    }
+    client.Close()
+
+    /* Only a cut poll is sent again, not one the gate could not be reached for */
+    var transient = []struct{
+        err         error
+        expected    bool
+    }{
+        {ERROR_PROXY_TIMEOUT, true},
+        {&url.Error{Op: "Post", Err: os.ErrDeadlineExceeded}, true},
+        {&url.Error{Op: "Post", Err: io.EOF}, true},
+        {&url.Error{Op: "Post", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}, true},
+        {io.ErrUnexpectedEOF, true},
+        {&url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}}, false},
+        {&url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host",
+            Name: "gate.invalid", IsNotFound: true}}}, false},
+        {ERROR_RECORD_AUTH, false},
+    }
+    for _, test := range transient {
+        if isTransientPollError(test.err) != test.expected {
+            t.Fatalf("%v: expected transient %v", test.err, test.expected)
+        }
+    }
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    var refusedURI = "http://" + listener.Addr().String() + "/gate.php"
+    listener.Close()
+    if _, err := http.Post(refusedURI, "text/plain", nil); err == nil || isTransientPollError(err) {
+        t.Fatalf("a refused connection is retried: %v", err)
+    }
+}
+
+func TestPollRetry(t *testing.T) {
+    config, err := parseConfig()
+    if err != nil {
+        t.Fatal(err)
+    }
+    var service = &NetChannelService{clientMap: make(map[string]*NetInstance), config: config,
+        Flags: FLAG_ENCRYPT}
+
+    var gate = httptest.NewServer(http.HandlerFunc(service.handleClientRequest))
+    defer gate.Close()
+    gateURL, _ := url.Parse(gate.URL + "/gate.php")
+
+    /* A proxy that passes the next request to the gate, but cuts the response on its way back */
+    var (
+        forward         = httputil.NewSingleHostReverseProxy(gateURL)
+        cutNext         int32
+    )
+    var proxy = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+        if atomic.SwapInt32(&cutNext, 0) == 1 {
+            forward.ServeHTTP(httptest.NewRecorder(), request)
+            writer.WriteHeader(http.StatusBadGateway)
+            return
+        }
+        forward.ServeHTTP(writer, request)
+    }))
+    defer proxy.Close()
+
+    client, instance := newTestCircuit(service, gateURL, "retried", config)
+    if err := WithProxy(proxy.URL)(client); err != nil {
+        t.Fatal(err)
+    }
+    if err := client.configureProxy(); err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+
+    var poll = func(retry bool) (int, error) {
+        read, _, err := client.writeStream(encodePoll(time.Second, retry), FLAG_CHECK_STREAM_DATA)
+        if err == io.EOF {
+            err = nil
+        }
+        return read, err
+    }
+    var receive = func(expected string) {
+        var buffer = make([]byte, len(expected))
+        client.SetReadDeadline(time.Now().Add(5 * time.Second))
+        if _, err := io.ReadFull(client, buffer); err != nil || string(buffer) != expected {
+            t.Fatalf("expected %q, got %q: %v", expected, buffer, err)
+        }
+    }
+
+    /* The answer to a cut poll is sent again to the retry, and only to the retry */
+    instance.Write([]byte("first"))
+    atomic.StoreInt32(&cutNext, 1)
+    if _, err := poll(false); !errors.Is(err, ERROR_PROXY_TIMEOUT) || !isTransientPollError(err) {
+        t.Fatalf("expected the poll to be cut, got %v", err)
+    }
+    if read, err := poll(true); read == 0 || err != nil {
+        t.Fatalf("retried poll was not answered with the lost frame: %d %v", read, err)
+    }
+    receive("first")
+    if _, err := poll(true); err != ERROR_REPLAY {
+        t.Fatalf("a frame that arrived should be dropped as a replay, got %v", err)
+    }
+    if read, err := poll(false); read != 0 || err != nil {
+        t.Fatalf("acknowledged frame was sent again: %d %v", read, err)
+    }
+    if read, err := poll(true); read != 0 || err != nil {
+        t.Fatalf("acknowledged frame was sent to a retry: %d %v", read, err)
+    }
+
+    /* A poll that is still held once the client gives up on it does not take the data */
+    var cut, retried = make(chan error, 1), make(chan error, 1)
+    atomic.StoreInt32(&cutNext, 1)
+    go func() {
+        _, err := poll(false)
+        cut <- err
+    } ()
+    time.Sleep(200 * time.Millisecond)
+    go func() {
+        _, err := poll(true)
+        retried <- err
+    } ()
+    time.Sleep(200 * time.Millisecond)
+    instance.Write([]byte("second"))
+    if err := <-retried; err != nil {
+        t.Fatalf("retried poll: %v", err)
+    }
+    if err := <-cut; !errors.Is(err, ERROR_PROXY_TIMEOUT) {
+        t.Fatalf("expected the held poll to be cut, got %v", err)
+    }
+    receive("second")
+}
+
+/* The frame answered to the poll that was cut as the circuit was lost arrives once it is resumed */
+func TestResumeAfterCutPoll(t *testing.T) {
+    service, gateURI := newTestGate(t, 0)
+    gateURL, _ := url.Parse(gateURI)
+
+    /* A proxy that, while the link is down, passes requests to the gate but cuts every response */
+    var (
+        forward         = httputil.NewSingleHostReverseProxy(&url.URL{Scheme: gateURL.Scheme, Host: gateURL.Host})
+        down            atomic.Bool
+    )
+    var proxy = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+        if down.Load() {
+            forward.ServeHTTP(httptest.NewRecorder(), request)
+            writer.WriteHeader(http.StatusBadGateway)
+            return
+        }
+        forward.ServeHTTP(writer, request)
+    }))
+    defer proxy.Close()
+
+    client, err := BuildChannel(gateURI, FLAG_ENCRYPT, WithProxy(proxy.URL), WithPollTimeout(time.Second))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer client.Close()
+    if err := client.InitializeCircuit(); err != nil {
+        t.Fatal(err)
+    }
+    conn, err := service.Accept()
+    if err != nil {
+        t.Fatal(err)
+    }
+    roundTrip(t, client, conn, []byte("before the link went down"))
+
+    /* The held poll is answered, but the answer and every retry of it are cut */
+    down.Store(true)
+    var message = []byte("answered to the cut poll")
+    if _, err := conn.Write(message); err != nil {
+        t.Fatal(err)
+    }
+    for started := time.Now(); client.connected.Load(); time.Sleep(100 * time.Millisecond) {
+        if time.Since(started) > 15 * time.Second {
+            t.Fatalf("the circuit was not lost")
+        }
+    }
+
+    down.Store(false)
+    if err := client.InitializeCircuit(); err != nil {
+        t.Fatalf("resume: %v", err)
+    }
+    expectNoneAccepted(t, service)
+
+    var buffer = make([]byte, len(message))
+    client.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if _, err := io.ReadFull(client, buffer); err != nil || !bytes.Equal(buffer, message) {
+        t.Fatalf("the frame of the cut poll was lost: %q %v", buffer, err)
+    }
+    roundTrip(t, client, conn, []byte("after the circuit was resumed"))
+
+    /* A frame sealed under the previous keys is delivered once, and dropped as a replay after that */
+    var (
+        previousKey     = bytes.Repeat([]byte{1}, trafficKeySize)
+        resumed         = &NetChannelClient{
+            negotiated:     Capabilities{PROTOCOL_VERSION, CIPHER_AES256_GCM, COMPRESSION_NONE, MIN_FRAME_SIZE},
+            rxKey:          newTrafficState(bytes.Repeat([]byte{2}, trafficKeySize), defaultRekeyLimits()),
+            previousRxKey:  newTrafficState(previousKey, defaultRekeyLimits()),
+            previousSuite:  CIPHER_AES256_GCM,
+        }
+    )
+    record, err := encryptFragment(message, nil, newTrafficState(previousKey, defaultRekeyLimits()),
+        CIPHER_AES256_GCM, FLAG_DIRECTION_TO_CLIENT, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if data, _, err := resumed.openServerRecord(record); err != nil || !bytes.Equal(data, message) {
+        t.Fatalf("frame under the previous keys: %v", err)
+    }
+    if _, _, err := resumed.openServerRecord(record); err != ERROR_REPLAY {
+        t.Fatalf("expected ERROR_REPLAY for a frame that had arrived, got %v", err)
+    }
+}
+
+/*
+ * A request/response exchange over a single circuit, with and without keep-alive, and
+ *  over h2c. dials/op is the number of TCP connections the client opened for each exchange
+ */
+func BenchmarkChattySession(b *testing.B) {
+    service, gateURI := newTestGate(b, FLAG_H2C)
+
+    var modes = []struct{
+        name        string
+        flags       FlagVal
+        keepAlive   bool
+    }{
+        {"keep-alive", 0, true},
+        {"connection-close", 0, false},
+        {"h2c", FLAG_H2C, true},
+    }
+    for _, mode := range modes {
+        var keepAlive = mode.keepAlive
+
+        b.Run(mode.name, func(b *testing.B) {
+            client, err := BuildChannel(gateURI, FLAG_ENCRYPT | mode.flags)
+            if err != nil {
+                b.Fatal(err)
+            }
+            defer client.Close()
+
+            var (
+                dials   int64
+                dial    = client.transport.DialContext
+            )
+            client.transport.DisableKeepAlives = !keepAlive
+            client.transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+                atomic.AddInt64(&dials, 1)
+                return dial(ctx, network, addr)
+            }
+            if err := client.InitializeCircuit(); err != nil {
+                b.Fatal(err)
+            }
+            conn, err := service.Accept()
+            if err != nil {
+                b.Fatal(err)
+            }
+
+            var (
+                request     = []byte("request")
+                response    = []byte("response")
+                buffer      = make([]byte, 64)
+            )
+            atomic.StoreInt64(&dials, 0)
+            b.ResetTimer()
+            for i := 0; i < b.N; i += 1 {
+                if _, err := client.Write(request); err != nil {
+                    b.Fatal(err)
+                }
+                if _, err := io.ReadFull(conn, buffer[:len(request)]); err != nil {
+                    b.Fatal(err)
+                }
+                if _, err := conn.Write(response); err != nil {
+                    b.Fatal(err)
+                }
+                if _, err := io.ReadFull(client, buffer[:len(response)]); err != nil {
+                    b.Fatal(err)
+                }
+            }
+            b.StopTimer()
+            b.ReportMetric(float64(atomic.LoadInt64(&dials)) / float64(b.N), "dials/op")
+        })
+    }
 }
 
 func D(debug string) {
@@ -0,0 +1,369 @@
+/*
+ * Copyright (c) 2017 AlexRuzin (stan.ruzin@gmail.com)
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+
+package websock
+
+import (
+    "errors"
+    "net/http"
+    "net/url"
+    "os"
+    "sync"
+    "time"
+
+    "github.com/AlexRuzin/util"
+    "github.com/gorilla/websocket"
+)
+
+/************************************************************
+ * WebSocket transport                                      *
+ ************************************************************/
+
+/*
+ * When both sides set FLAG_WEBSOCKET, the client moves the circuit to an RFC 6455
+ *  WebSocket once the key exchange is complete, and no longer polls. The upgrade is a GET
+ *  request on the gate path, which carries a CONTROL_UPGRADE frame in the query in place
+ *  of the POST body, so that the upgrade is authenticated by the traffic key of the
+ *  circuit. Every message is a binary message holding a single record, sealed exactly as
+ *  it would be in a POST or a response:
+ *
+ *  Client -> server    data frames and control messages, as they are written
+ *  Server -> client    data frames as soon as they are queued by Write(), the answers to
+ *                       control messages, and CONTROL_TERMINATE once the NetInstance is
+ *                       closed
+ *
+ * A server without FLAG_WEBSOCKET refuses CONTROL_UPGRADE, as does a proxy that does not
+ *  pass the upgrade, in which case the client falls back to long-polling. If the socket
+ *  is lost, the client is disconnected, and InitializeCircuit() resumes the circuit and
+ *  upgrades it again.
+ */
+const (
+    /* Allowance for the frame header and record overhead, beyond the negotiated MaxFrameSize */
+    SOCKET_RECORD_OVERHEAD      = 4096
+
+    /* Keeps an idle socket open through NAT and proxies */
+    SOCKET_PING_INTERVAL        = 30 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+    /* Every record is authenticated, so the origin of the request does not matter */
+    CheckOrigin:    func(request *http.Request) bool { return true },
+}
+
+type socketConn struct {
+    conn                        *websocket.Conn
+    writeLock                   sync.Mutex          /* One writer at a time, as required by websocket.Conn */
+    done                        chan struct{}
+    closeOnce                   sync.Once
+
+    /* Client only, the answers to exchangeControl() */
+    controlLock                 sync.Mutex
+    replies                     chan *controlMessage
+}
+
+func newSocketConn(conn *websocket.Conn, maxFrameSize uint32) *socketConn {
+    conn.SetReadLimit(int64(maxFrameSize) + SOCKET_RECORD_OVERHEAD)
+
+    return &socketConn{
+        conn:       conn,
+        done:       make(chan struct{}),
+        replies:    make(chan *controlMessage, 1),
+    }
+}
+
+/* A zero deadline does not bound the write */
+func (f *socketConn) send(record []byte, deadline time.Time) error {
+    f.writeLock.Lock()
+    defer f.writeLock.Unlock()
+
+    f.conn.SetWriteDeadline(deadline)
+    if err := f.conn.WriteMessage(websocket.BinaryMessage, record); err != nil {
+        if deadlinePassed(deadline) {
+            return os.ErrDeadlineExceeded
+        }
+        return err
+    }
+
+    return nil
+}
+
+func (f *socketConn) ping() error {
+    f.writeLock.Lock()
+    defer f.writeLock.Unlock()
+
+    return f.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(SOCKET_PING_INTERVAL))
+}
+
+func (f *socketConn) close() {
+    f.closeOnce.Do(func() {
+        close(f.done)
+        f.conn.Close()
+    })
+}
+
+/* Sends a sealed control message, and waits for readSocket() to pass on the answer */
+func (f *socketConn) exchangeControl(encrypted []byte) (*controlMessage, error) {
+    f.controlLock.Lock()
+    defer f.controlLock.Unlock()
+
+    if err := f.send(encrypted, time.Time{}); err != nil {
+        return nil, err
+    }
+
+    select {
+    case reply := <-f.replies:
+        return reply, nil
+    case <-f.done:
+        return nil, ERROR_CONTROL_NO_REPLY
+    }
+}
+
+/************************************************************
+ * NetChannelClient                                         *
+ ************************************************************/
+
+func (f *NetChannelClient) upgradeSocket() error {
+    encrypted, err := encryptControl(&controlMessage{controlType: CONTROL_UPGRADE}, f.txKey,
+        f.negotiated.CipherSuite, FLAG_DIRECTION_TO_SERVER)
+    if err != nil {
+        return err
+    }
+
+    var (
+        socketURL   = *f.controllerURL
+        query       = url.Values{}
+    )
+    socketURL.Scheme = "ws"
+    if f.controllerURL.Scheme == "https" {
+        socketURL.Scheme = "wss"
+    }
+    for key, value := range f.postParameters(encrypted) {
+        query.Set(key, value)
+    }
+    socketURL.RawQuery = query.Encode()
+
+    var dialer = &websocket.Dialer{
+        NetDialContext:     f.transport.DialContext,
+        Proxy:              f.transport.Proxy,
+        TLSClientConfig:    f.transport.TLSClientConfig,
+        HandshakeTimeout:   DIAL_TIMEOUT,
+    }
+    conn, response, err := dialer.Dial(socketURL.String(), http.Header{"User-Agent": {f.config.UserAgent}})
+    if err != nil {
+        if response != nil {
+            response.Body.Close()
+        }
+        return err
+    }
+    f.addrs.set(conn.LocalAddr(), conn.RemoteAddr())
+
+    var socket = newSocketConn(conn, f.negotiated.MaxFrameSize)
+    if previous := f.socket.Swap(socket); previous != nil {
+        previous.close()
+    }
+    go f.readSocket(socket)
+
+    return nil
+}
+
+/* Takes the place of checkWriteThread() while the circuit is carried over socket */
+func (f *NetChannelClient) readSocket(socket *socketConn) {
+    defer socket.close()
+
+    for {
+        _, record, err := socket.conn.ReadMessage()
+        if err != nil {
+            break
+        }
+
+        rawData, decoded, err := f.openServerRecord(record)
+        if err != nil {
+            /* A forged or replayed record is dropped, see SessionStats */
+            continue
+        }
+
+        /* Every control message but CONTROL_TERMINATE answers exchangeControl() */
+        if decoded.frameType == FRAME_CONTROL {
+            if message, err := decodeControl(rawData); err == nil && message.controlType != CONTROL_TERMINATE {
+                select {
+                case socket.replies <- message:
+                default:
+                }
+                continue
+            }
+        }
+
+        if _, err := f.processFrame(rawData, decoded); err != nil {
+            break
+        }
+    }
+
+    /* The NetInstance may still exist, so the ticket is kept for InitializeCircuit() to resume with */
+    if f.socket.CompareAndSwap(socket, nil) {
+        f.connected.Store(false)
+        f.rxSignal.notify()
+    }
+}
+
+/************************************************************
+ * NetInstance                                              *
+ ************************************************************/
+
+func (f *NetInstance) isSocketUpgrade(request *http.Request, control []byte) bool {
+    return (f.service.Flags & FLAG_WEBSOCKET) > 0 && len(control) != 0 &&
+        control[0] == CONTROL_UPGRADE && websocket.IsWebSocketUpgrade(request)
+}
+
+/* Serves the circuit over a WebSocket until the socket is lost, or the circuit is closed */
+func (f *NetInstance) serveSocket(writer http.ResponseWriter, request *http.Request) {
+    conn, err := upgrader.Upgrade(writer, request, nil)
+    if err != nil {
+        /* The upgrader has already answered with an HTTP error */
+        return
+    }
+
+    negotiated, _, _ := f.session()
+    var socket = newSocketConn(conn, negotiated.MaxFrameSize)
+    if previous := f.socket.Swap(socket); previous != nil {
+        previous.close()
+    }
+    defer f.socket.CompareAndSwap(socket, nil)
+    defer socket.close()
+
+    go f.pushQueued(socket)
+
+    for {
+        _, record, err := conn.ReadMessage()
+        if err != nil {
+            return
+        }
+
+        /* Read for each record, since the circuit may be resumed on another connection */
+        negotiated, data, decoded, err := f.openClientRecord(record)
+        if err != nil {
+            /* Dropped and counted in SessionStats, as for a POST */
+            if (f.service.Flags & FLAG_DEBUG) > 0 {
+                util.DebugOut("[" + f.ClientIdString + "] Record rejected: " + err.Error())
+            }
+            continue
+        }
+        if err := checkFrameSize(decoded, negotiated.MaxFrameSize); err != nil {
+            return
+        }
+
+        if decoded.frameType == FRAME_CONTROL {
+            if err := f.answerSocketControl(socket, data); err != nil {
+                return
+            }
+            continue
+        }
+
+        if data, err = f.receiveData(decoded, data); err != nil {
+            return
+        }
+        if data != nil {
+            f.enqueue(data)
+        }
+    }
+}
+
+func (f *NetInstance) answerSocketControl(socket *socketConn, payload []byte) error {
+    message, err := decodeControl(payload)
+    if err != nil {
+        return nil
+    }
+
+    reply, err := f.answerControl(message)
+    if reply == nil {
+        /* An unknown control message is ignored, but the circuit remains up */
+        return nil
+    }
+
+    negotiated, txKey, _ := f.session()
+    encrypted, sealErr := encryptControl(reply, txKey, negotiated.CipherSuite, FLAG_DIRECTION_TO_CLIENT)
+    if sealErr != nil {
+        return sealErr
+    }
+    if sendErr := socket.send(encrypted, time.Time{}); sendErr != nil {
+        return sendErr
+    }
+
+    if errors.Is(err, ERROR_TERMINATE) {
+        f.service.closeClient(f)
+    }
+    return err
+}
+
+/*
+ * Sends the data queued by Write() as soon as it is queued, and tells the client once
+ *  the NetInstance is closed. A frame the socket fails to send is queued again, and
+ *  sent on whichever connection the client resumes on. If CONTROL_TERMINATE is not
+ *  sent, the instance is not forgotten, so that the next request of the client is
+ *  answered with it instead, see closeLinger
+ */
+func (f *NetInstance) pushQueued(socket *socketConn) {
+    defer socket.close()
+
+    var ticker = time.NewTicker(SOCKET_PING_INTERVAL)
+    defer ticker.Stop()
+
+    for {
+        encrypted, err := f.nextQueued()
+        if err != nil {
+            return
+        }
+        if encrypted != nil {
+            if err := socket.send(encrypted, time.Now().Add(SOCKET_PING_INTERVAL)); err != nil {
+                f.requeue(encrypted)
+                return
+            }
+            continue
+        }
+
+        if f.isClosed() {
+            negotiated, txKey, _ := f.session()
+            encrypted, err := encryptControl(&controlMessage{controlType: CONTROL_TERMINATE}, txKey,
+                negotiated.CipherSuite, FLAG_DIRECTION_TO_CLIENT)
+            if err != nil {
+                return
+            }
+            if err := socket.send(encrypted, time.Now().Add(SOCKET_PING_INTERVAL)); err != nil {
+                return
+            }
+            f.service.forgetClient(f)
+            return
+        }
+
+        select {
+        case <-f.txSignal:
+        case <-ticker.C:
+            if err := socket.ping(); err != nil {
+                return
+            }
+        case <-socket.done:
+            return
+        }
+    }
+}
+
+/* EOF */